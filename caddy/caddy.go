@@ -31,6 +31,8 @@ var bufPool = sync.Pool{
 type Vulcain struct {
 	// Path to an OpenAPI file documenting relations between resources (for non-hypermedia APIs)
 	OpenAPIFile string `json:"openapi_file,omitempty"`
+	// URL of an OpenAPI definition documenting relations between resources, used if OpenAPIFile isn't set
+	OpenAPIURL string `json:"openapi_url,omitempty"`
 	// Maximum number of resources to push
 	MaxPushes int `json:"max_pushes,omitempty"`
 	// To eable 103 Early Hints responses
@@ -59,6 +61,7 @@ func (v *Vulcain) Provision(ctx caddy.Context) error {
 
 	options := []vulcain.Option{
 		vulcain.WithOpenAPIFile(v.OpenAPIFile),
+		vulcain.WithOpenAPIURL(v.OpenAPIURL),
 		vulcain.WithMaxPushes(v.MaxPushes),
 		vulcain.WithLogger(ctx.Logger(v)),
 		vulcain.WithApiUrl(v.ApiUrl),
@@ -99,10 +102,14 @@ func (v Vulcain) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhtt
 		return nil
 	}
 
-	b, err := v.vulcain.Apply(r, w, rec.Buffer(), rec.Header())
-	if err != nil {
+	// Don't consume the buffer, it is used to send the response untransformed if Apply fails
+	b, err := v.vulcain.Apply(r, w, bytes.NewReader(rec.Buffer().Bytes()), rec.Header())
+	if b == nil {
 		return rec.WriteResponse()
 	}
+	if err != nil {
+		v.logger.Debug("some relations cannot be handled", zap.Error(err))
+	}
 
 	w.WriteHeader(rec.Status())
 	_, err = w.Write(b)
@@ -120,6 +127,8 @@ func (v Vulcain) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhtt
 //	vulcain {
 //	    # path to the OpenAPI file describing the relations (for non-hypermedia APIs)
 //	    openapi_file <path>
+//	    # URL of the OpenAPI definition, used if openapi_file isn't set
+//	    openapi_url <url>
 //	    # Maximum number of pushes to do (-1 for unlimited)
 //	    max_pushes -1
 //	}
@@ -134,6 +143,13 @@ func (v *Vulcain) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 
 				v.OpenAPIFile = d.Val()
 
+			case "openapi_url":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+
+				v.OpenAPIURL = d.Val()
+
 			case "max_pushes":
 				if !d.NextArg() {
 					return d.ArgErr()
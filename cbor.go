@@ -0,0 +1,101 @@
+package vulcain
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math"
+	"reflect"
+	"regexp"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// cborRe matches the CBOR content types (e.g. application/cbor or application/vnd.api+cbor)
+var cborRe = regexp.MustCompile(`(?i)\bcbor\b`)
+
+var (
+	cborDecMode, _ = cbor.DecOptions{DefaultMapType: reflect.TypeOf(map[string]interface{}(nil))}.DecMode()
+	cborEncMode, _ = cbor.CoreDetEncOptions().EncMode()
+)
+
+// ErrLossyCBOR occurs when a CBOR document contains values without JSON equivalent, it is sent untransformed
+var ErrLossyCBOR = errors.New("CBOR document cannot be converted to JSON without loss")
+
+// cborToJSON converts a CBOR document to JSON, so it can be traversed by the JSONProcessor
+// ErrLossyCBOR is returned if the document cannot be converted back to the same CBOR values (see isJSONCompatible)
+func cborToJSON(data []byte) ([]byte, error) {
+	var v interface{}
+	if err := cborDecMode.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+
+	if !isJSONCompatible(v) {
+		return nil, ErrLossyCBOR
+	}
+
+	return json.Marshal(v)
+}
+
+// isJSONCompatible tells if the decoded CBOR value survives a round trip through JSON
+// Byte strings, tags (including dates and bignums), simple values and integral floats (converted back to integers) don't
+func isJSONCompatible(v interface{}) bool {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for _, e := range v {
+			if !isJSONCompatible(e) {
+				return false
+			}
+		}
+	case []interface{}:
+		for _, e := range v {
+			if !isJSONCompatible(e) {
+				return false
+			}
+		}
+	case float64:
+		return v != math.Trunc(v) && !math.IsNaN(v) && !math.IsInf(v, 0)
+	case nil, bool, string, uint64, int64:
+	default:
+		return false
+	}
+
+	return true
+}
+
+// jsonToCBOR converts a JSON document back to CBOR, integers are encoded as CBOR integers
+func jsonToCBOR(data []byte) ([]byte, error) {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+
+	return cborEncMode.Marshal(convertJSONNumbers(v))
+}
+
+// convertJSONNumbers replaces the json.Number values by int64 or float64 values
+func convertJSONNumbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = convertJSONNumbers(e)
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = convertJSONNumbers(e)
+		}
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+
+		f, _ := v.Float64()
+
+		return f
+	}
+
+	return v
+}
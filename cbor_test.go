@@ -0,0 +1,94 @@
+package vulcain
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCBORToJSON(t *testing.T) {
+	data, _ := cbor.Marshal(map[string]interface{}{"id": 1, "title": "1984", "rating": 4.5, "tags": []interface{}{"a", -2, nil, true}})
+
+	j, err := cborToJSON(data)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"id": 1, "title": "1984", "rating": 4.5, "tags": ["a", -2, null, true]}`, string(j))
+
+	// Values without JSON equivalent aren't converted
+	for _, lossy := range []interface{}{
+		[]byte("img"),
+		cbor.Tag{Number: 1000, Content: "foo"},
+		cbor.Tag{Number: 1, Content: 0},
+		5.0,
+		math.Inf(1),
+		[]interface{}{"a", []byte("img")},
+	} {
+		data, _ := cbor.Marshal(map[string]interface{}{"value": lossy})
+
+		_, err := cborToJSON(data)
+		assert.ErrorIs(t, err, ErrLossyCBOR, "%#v", lossy)
+	}
+
+	c, err := jsonToCBOR([]byte(`{"id": 1, "rating": 4.5, "tags": ["a", 2]}`))
+	assert.NoError(t, err)
+
+	var v map[string]interface{}
+	assert.NoError(t, cbor.Unmarshal(c, &v))
+	assert.Equal(t, map[string]interface{}{"id": uint64(1), "rating": 4.5, "tags": []interface{}{"a", uint64(2)}}, v)
+
+	_, err = cborToJSON([]byte{0xff})
+	assert.Error(t, err)
+}
+
+func TestApplyCBOR(t *testing.T) {
+	header := http.Header{"Preload": []string{`"/author"`}, "Fields": []string{`"/author"`}}
+	responseHeader := http.Header{"Content-Type": []string{"application/cbor"}}
+
+	req := httptest.NewRequest("GET", "/books/1", nil)
+	assert.False(t, New().IsValidResponse(req, http.StatusOK, responseHeader))
+	assert.True(t, New(WithCBORSupport()).IsValidResponse(req, http.StatusOK, responseHeader))
+
+	v := New(WithCBORSupport())
+
+	rw := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	rw.Header().Set("Content-Type", "application/cbor")
+	req = newTestRequest(v, rw, "/books/1", header)
+	defer v.Finish(req, false)
+
+	body, _ := cbor.Marshal(map[string]interface{}{"author": "/authors/1", "title": "1984"})
+	b, err := v.Apply(req, rw, strings.NewReader(string(body)), rw.Header())
+	assert.NoError(t, err)
+
+	var doc map[string]interface{}
+	assert.NoError(t, cbor.Unmarshal(b, &doc))
+	assert.Equal(t, map[string]interface{}{"author": "/authors/1"}, doc)
+	assert.Equal(t, []string{"/authors/1"}, rw.pushed)
+
+	// The document is sent as is if it isn't modified
+	rw = &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	rw.Header().Set("Content-Type", "application/cbor")
+	req = newTestRequest(v, rw, "/books/1", http.Header{"Preload": []string{`"/author"`}})
+	defer v.Finish(req, false)
+
+	b, err = v.Apply(req, rw, strings.NewReader(string(body)), rw.Header())
+	assert.NoError(t, err)
+	assert.Equal(t, body, b)
+}
+
+func TestApplyLossyCBOR(t *testing.T) {
+	v := New(WithCBORSupport())
+
+	rw := httptest.NewRecorder()
+	rw.Header().Set("Content-Type", "application/cbor")
+	req := newTestRequest(v, rw, "/books/1", http.Header{"Fields": []string{`"/title"`}})
+	defer v.Finish(req, false)
+
+	body, _ := cbor.Marshal(map[string]interface{}{"title": "1984", "cover": []byte("img")})
+	b, err := v.Apply(req, rw, strings.NewReader(string(body)), rw.Header())
+	assert.ErrorIs(t, err, ErrLossyCBOR)
+	assert.Nil(t, b)
+}
@@ -0,0 +1,108 @@
+package vulcain
+
+import "net/http"
+
+// Sources of the directives
+const (
+	DirectiveSourceHeader = "header"
+	DirectiveSourceQuery  = "query"
+	// DirectiveSourceDefault is used for the directives set using WithDefaultFields and WithDefaultPreload
+	DirectiveSourceDefault = "default"
+	// DirectiveSourcePrefer is used for the "fields" directive applied because the client prefers a minimal representation (see WithPreferMinimal)
+	DirectiveSourcePrefer = "prefer"
+)
+
+// DirectiveTree is a serializable view of the "preload" and "fields" directives of a request, as understood by Apply
+type DirectiveTree struct {
+	// PreloadSource is the source of the "preload" directive (DirectiveSourceHeader, DirectiveSourceQuery or DirectiveSourceDefault), empty if there is no such directive
+	PreloadSource string `json:"preloadSource,omitempty"`
+	// FieldsSource is the source of the "fields" directive (DirectiveSourceHeader, DirectiveSourceQuery, DirectiveSourceDefault or DirectiveSourcePrefer), empty if there is no such directive
+	FieldsSource string `json:"fieldsSource,omitempty"`
+	// Truncated is true if "preload" selectors deeper than the limit set using WithMaxPushDepth have been removed
+	Truncated bool `json:"truncated,omitempty"`
+	// Root is the root node of the tree
+	Root *DirectiveNode `json:"root"`
+}
+
+// DirectiveNode is a node of a DirectiveTree
+type DirectiveNode struct {
+	// Pointer is the JSON pointer matched by this node
+	Pointer string `json:"pointer"`
+	// Preload tells if the node is targeted by a "preload" selector
+	Preload bool `json:"preload,omitempty"`
+	// Fields tells if the node is targeted by a "fields" selector
+	Fields bool `json:"fields,omitempty"`
+	// Negated tells if the node is excluded by a negated "fields" selector
+	Negated bool `json:"negated,omitempty"`
+	// Children are the child nodes
+	Children []*DirectiveNode `json:"children,omitempty"`
+}
+
+// ParseDirectives returns the directives of the request, without transforming anything.
+// It allows to diagnose why a relation isn't pushed or a field isn't kept.
+// ErrMixedFieldsSelectors is returned if regular and negated selectors are mixed in the "fields" directive, ErrTooManySelectors if the limit set using WithMaxSelectors is exceeded,
+// and a DirectiveError if a directive is malformed in strict mode (see WithStrictDirectives).
+func (v *Vulcain) ParseDirectives(req *http.Request) (*DirectiveTree, error) {
+	if v.strictDirectives {
+		if err := validateDirectives(req); err != nil {
+			return nil, err
+		}
+	}
+
+	f, p, fieldsHeader, fieldsQuery, preloadHeader, preloadQuery, defaults := v.extractDirectives(req)
+
+	var minimal bool
+	if !fieldsQuery && (!fieldsHeader || defaults) {
+		if m := v.minimalFields(req); m != nil {
+			f, minimal = m, true
+		}
+	}
+
+	if _, err := fieldsNegation(f); err != nil {
+		return nil, err
+	}
+
+	tree, err := v.buildTree(p, f)
+	if err != nil {
+		return nil, err
+	}
+
+	dt := &DirectiveTree{}
+	if v.maxPushDepth >= 0 {
+		dt.Truncated = tree.truncate(preload, v.maxPushDepth)
+	}
+
+	switch {
+	case defaults && preloadHeader:
+		dt.PreloadSource = DirectiveSourceDefault
+	case preloadHeader:
+		dt.PreloadSource = DirectiveSourceHeader
+	case preloadQuery:
+		dt.PreloadSource = DirectiveSourceQuery
+	}
+
+	switch {
+	case minimal:
+		dt.FieldsSource = DirectiveSourcePrefer
+	case defaults && fieldsHeader:
+		dt.FieldsSource = DirectiveSourceDefault
+	case fieldsHeader:
+		dt.FieldsSource = DirectiveSourceHeader
+	case fieldsQuery:
+		dt.FieldsSource = DirectiveSourceQuery
+	}
+
+	dt.Root = newDirectiveNode(tree)
+
+	return dt, nil
+}
+
+// newDirectiveNode converts a node and its children
+func newDirectiveNode(n *node) *DirectiveNode {
+	dn := &DirectiveNode{Pointer: n.String(), Preload: n.preload, Fields: n.fields, Negated: n.negated}
+	for _, c := range n.children {
+		dn.Children = append(dn.Children, newDirectiveNode(c))
+	}
+
+	return dn
+}
@@ -0,0 +1,54 @@
+package vulcain
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDirectives(t *testing.T) {
+	v := New(WithMaxPushDepth(1))
+
+	req := httptest.NewRequest("GET", `/books/1?fields="/author"`, nil)
+	req.Header.Set("Preload", `"/author", "/related/author"`)
+
+	dt, err := v.ParseDirectives(req)
+	assert.NoError(t, err)
+	assert.Equal(t, &DirectiveTree{
+		PreloadSource: DirectiveSourceHeader,
+		FieldsSource:  DirectiveSourceQuery,
+		Truncated:     true,
+		Root: &DirectiveNode{
+			Pointer: "/",
+			Children: []*DirectiveNode{
+				{Pointer: "/author", Preload: true, Fields: true},
+				{Pointer: "/related", Preload: true},
+			},
+		},
+	}, dt)
+
+	b, err := json.Marshal(dt)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"preloadSource": "header", "fieldsSource": "query", "truncated": true, "root": {"pointer": "/", "children": [{"pointer": "/author", "preload": true, "fields": true}, {"pointer": "/related", "preload": true}]}}`, string(b))
+
+	req = httptest.NewRequest("GET", "/books/1", nil)
+	req.Header = http.Header{"Fields": []string{`"/author", "!/title"`}}
+	_, err = v.ParseDirectives(req)
+	assert.ErrorIs(t, err, ErrMixedFieldsSelectors)
+}
+
+func TestParseDirectivesPreferMinimal(t *testing.T) {
+	v := New(WithPreferMinimal(), WithDefaultFields(`"/title"`))
+
+	req := httptest.NewRequest("GET", "/books/1", nil)
+	req.Header.Set("Prefer", "return=minimal")
+	req.Header.Set("Preload", `"/author"`)
+
+	dt, err := v.ParseDirectives(req)
+	assert.NoError(t, err)
+	assert.Equal(t, DirectiveSourceHeader, dt.PreloadSource)
+	assert.Equal(t, DirectiveSourcePrefer, dt.FieldsSource)
+}
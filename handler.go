@@ -0,0 +1,156 @@
+package vulcain
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// responseBuffer buffers the response of the wrapped handler when it can be transformed by Apply
+type responseBuffer struct {
+	http.ResponseWriter
+	v           *Vulcain
+	req         *http.Request
+	status      int
+	wroteHeader bool
+	buffered    bool
+	buf         *bytes.Buffer
+}
+
+func (b *responseBuffer) WriteHeader(status int) {
+	// Informational responses (e.g. 103 Early Hints) are forwarded as is
+	if status >= 100 && status < 200 {
+		b.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	if b.wroteHeader {
+		return
+	}
+
+	b.status = status
+	b.wroteHeader = true
+	b.buffered = b.v.IsValidResponse(b.req, status, b.Header())
+	if !b.buffered {
+		b.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (b *responseBuffer) Write(p []byte) (int, error) {
+	if !b.wroteHeader {
+		b.WriteHeader(http.StatusOK)
+	}
+
+	if !b.buffered {
+		return b.ResponseWriter.Write(p)
+	}
+
+	if b.v.maxBodySize < 0 || int64(b.buf.Len()+len(p)) <= b.v.maxBodySize {
+		return b.buf.Write(p)
+	}
+
+	// The body is too large to be transformed, stop buffering and send it as is
+	b.buffered = false
+	b.ResponseWriter.WriteHeader(b.status)
+	if _, err := b.ResponseWriter.Write(b.buf.Bytes()); err != nil {
+		return 0, err
+	}
+	b.buf.Reset()
+
+	return b.ResponseWriter.Write(p)
+}
+
+// Unwrap returns the underlying http.ResponseWriter, it's used by http.ResponseController
+func (b *responseBuffer) Unwrap() http.ResponseWriter {
+	return b.ResponseWriter
+}
+
+// takeTrailers removes the values of the trailers announced using the Trailer header from h, and returns them
+func takeTrailers(h http.Header) http.Header {
+	var trailers http.Header
+	for _, v := range h["Trailer"] {
+		for _, k := range strings.Split(v, ",") {
+			k = http.CanonicalHeaderKey(strings.TrimSpace(k))
+			vv, ok := h[k]
+			if !ok {
+				continue
+			}
+
+			if trailers == nil {
+				trailers = make(http.Header)
+			}
+			trailers[k] = vv
+			delete(h, k)
+		}
+	}
+
+	return trailers
+}
+
+// Handler wraps an HTTP handler and applies the Vulcain directives to its responses.
+// It orchestrates the full lifecycle: CreateRequestContext, IsValidRequest, IsValidResponse, Apply and Finish.
+// Responses that can be transformed are buffered, when the size set using WithMaxBodySize is exceeded they are sent as is.
+func (v *Vulcain) Handler(upstream http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		req = req.WithContext(v.CreateRequestContext(rw, req))
+
+		var wait bool
+		defer func() { v.Finish(req, wait) }()
+
+		if !v.IsValidRequest(req) {
+			upstream.ServeHTTP(rw, req)
+			return
+		}
+
+		if v.strictDirectives {
+			if err := validateDirectives(req); err != nil {
+				http.Error(rw, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		buf := v.getBuffer(req)
+		if buf == nil {
+			buf = new(bytes.Buffer)
+		}
+
+		b := &responseBuffer{ResponseWriter: rw, v: v, req: req, buf: buf}
+		upstream.ServeHTTP(b, req)
+		if !b.wroteHeader {
+			b.WriteHeader(http.StatusOK)
+		}
+		if !b.buffered {
+			return
+		}
+
+		// The values of the announced trailers have been set after writing the body, they must not be sent as headers
+		trailers := takeTrailers(rw.Header())
+		defer func() {
+			for k, vv := range trailers {
+				rw.Header()[k] = vv
+			}
+		}()
+
+		newBody, err := v.ApplyBytes(req, rw, b.buf.Bytes(), rw.Header())
+		if newBody == nil {
+			v.requestLogger(req).Debug("cannot apply Vulcain directives", zap.Error(err))
+			rw.WriteHeader(b.status)
+			_, _ = rw.Write(b.buf.Bytes())
+
+			return
+		}
+		if err != nil {
+			v.requestLogger(req).Debug("some relations cannot be handled", zap.Error(err))
+		}
+
+		rw.WriteHeader(b.status)
+		if _, err := rw.Write(newBody); err != nil {
+			v.requestLogger(req).Debug("cannot write the response", zap.Error(err))
+			return
+		}
+
+		wait = true
+	})
+}
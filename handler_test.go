@@ -0,0 +1,129 @@
+package vulcain
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dunglas/vulcain/fixtures/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandler(t *testing.T) {
+	server := httptest.NewServer(New().Handler(&api.JSONLDHandler{}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/books.jsonld")
+	if assert.NoError(t, err) {
+		b, _ := io.ReadAll(resp.Body)
+		assert.Equal(t, api.BooksContent, string(b))
+	}
+
+	resp, err = http.Get(server.URL + `/books.jsonld?fields="/hydra:member/*"&preload="/hydra:member/*/author"`)
+	if assert.NoError(t, err) {
+		b, _ := io.ReadAll(resp.Body)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, []string{"</books/1.jsonld?preload=%22%2Fauthor%22>; rel=preload; as=fetch", "</books/2.jsonld?preload=%22%2Fauthor%22>; rel=preload; as=fetch"}, resp.Header["Link"])
+		assert.Equal(t, `{"hydra:member":["/books/1.jsonld?preload=%22%2Fauthor%22","/books/2.jsonld?preload=%22%2Fauthor%22"]}`, string(b))
+	}
+}
+
+func TestHandlerBufferPool(t *testing.T) {
+	server := httptest.NewServer(New(WithBufferPool()).Handler(&api.JSONLDHandler{}))
+	defer server.Close()
+
+	// Buffers are reused by subsequent requests
+	for i := 0; i < 2; i++ {
+		resp, err := http.Get(server.URL + `/books.jsonld?fields="/hydra:member/*"`)
+		if assert.NoError(t, err) {
+			b, _ := io.ReadAll(resp.Body)
+			assert.Equal(t, `{"hydra:member":["/books/1.jsonld","/books/2.jsonld"]}`, string(b))
+		}
+	}
+}
+
+func TestHandlerNotTransformable(t *testing.T) {
+	server := httptest.NewServer(New().Handler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "text/plain")
+		rw.WriteHeader(http.StatusCreated)
+		_, _ = rw.Write([]byte(`{"foo": "bar"}`))
+	})))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + `/?fields="/foo"`)
+	if assert.NoError(t, err) {
+		b, _ := io.ReadAll(resp.Body)
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+		assert.Equal(t, `{"foo": "bar"}`, string(b))
+	}
+}
+
+func TestHandlerMaxBodySize(t *testing.T) {
+	server := httptest.NewServer(New(WithMaxBodySize(10)).Handler(&api.JSONLDHandler{}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + `/books.jsonld?fields="/@id"`)
+	if assert.NoError(t, err) {
+		b, _ := io.ReadAll(resp.Body)
+		assert.Equal(t, api.BooksContent, string(b))
+	}
+}
+
+func TestHandlerMaxBodySizePassthrough(t *testing.T) {
+	rec := httptest.NewRecorder()
+
+	var sentBeforeEnd string
+	h := New(WithMaxBodySize(10)).Handler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		_, _ = rw.Write([]byte(`{"foo": `))
+		_, _ = rw.Write([]byte(`"bar", `))
+
+		// The body exceeds the limit, it isn't buffered anymore
+		sentBeforeEnd = rec.Body.String()
+		_, _ = rw.Write([]byte(`"baz": "qux"}`))
+	}))
+
+	req := httptest.NewRequest("GET", `/?fields="/foo"`, nil)
+	h.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, `{"foo": "bar", `, sentBeforeEnd)
+	assert.Equal(t, `{"foo": "bar", "baz": "qux"}`, rec.Body.String())
+}
+
+func TestHandlerStrictDirectives(t *testing.T) {
+	server := httptest.NewServer(New(WithStrictDirectives()).Handler(&api.JSONLDHandler{}))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL+"/books.jsonld", nil)
+	req.Header.Set("Preload", `"/hydra:member/*`)
+	resp, err := http.DefaultClient.Do(req)
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	}
+
+	resp, err = http.Get(server.URL + `/books.jsonld?fields="/hydra:member/*"`)
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+}
+
+func TestHandlerTrailers(t *testing.T) {
+	server := httptest.NewServer(New().Handler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Header().Set("Trailer", "X-Checksum")
+		_, _ = rw.Write([]byte(`{"foo": "bar", "baz": "qux"}`))
+		rw.Header().Set("X-Checksum", "abc")
+	})))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + `/?fields="/foo"`)
+	if assert.NoError(t, err) {
+		b, _ := io.ReadAll(resp.Body)
+		assert.Equal(t, `{"foo":"bar"}`, string(b))
+		assert.Empty(t, resp.Header.Get("X-Checksum"))
+		assert.Equal(t, int64(-1), resp.ContentLength)
+		assert.Equal(t, "abc", resp.Trailer.Get("X-Checksum"))
+	}
+}
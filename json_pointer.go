@@ -1,20 +1,49 @@
 package vulcain
 
 import (
+	"errors"
 	"strings"
 
 	"github.com/dunglas/httpsfv"
 )
 
+// Node is a read-only view of a node of the tree built from the "preload" and "fields" directives
+// It cannot be implemented outside of this package, the nodes are always the ones of the tree passed to JSONProcessor
+type Node interface {
+	// Path returns the segment of the JSON pointer matched by this node ("*" matches all elements of an array or all values of an object)
+	Path() string
+	// Preload tells if the node is targeted by a "preload" directive
+	Preload() bool
+	// Fields tells if the node is targeted by a "fields" directive
+	Fields() bool
+	// Negated tells if the node is excluded by a negated "fields" selector
+	Negated() bool
+	// Children returns the child nodes
+	Children() []Node
+	// String returns the JSON pointer of the node
+	String() string
+	// treeNode returns the underlying node
+	treeNode() *node
+}
+
 // node represents a node of a JSON document
 type node struct {
 	preload       bool
 	preloadParams []*httpsfv.Params
-	fields        bool
-	fieldsParams  []*httpsfv.Params
-	path          string
-	parent        *node
-	children      []*node
+	// targetParams are the parameters of the "preload" selectors ending at this node
+	targetParams []*httpsfv.Params
+	fields       bool
+	fieldsParams []*httpsfv.Params
+	negated      bool
+	// transformers are the functions set using WithFieldTransformer for the values matched by this node
+	transformers []func(value string) string
+	// embeddedJSON is true if the string values matched by this node are JSON documents, see WithEmbeddedJSON
+	embeddedJSON bool
+	// value is the JSON value matched by this node in the document being traversed, it's used to resolve OpenAPI discriminators
+	value    []byte
+	path     string
+	parent   *node
+	children []*node
 }
 
 // _type is the type of operation to apply, can be Preload or Fields
@@ -25,8 +54,20 @@ const (
 	fields
 )
 
+// ErrMixedFieldsSelectors occurs when regular and negated ("!/foo") selectors are mixed in the same "fields" directive
+var ErrMixedFieldsSelectors = errors.New(`"fields" directive: regular and negated selectors cannot be mixed`)
+
+// ErrTooManySelectors occurs when the directives contain more selectors than the limit set using WithMaxSelectors
+var ErrTooManySelectors = errors.New("too many selectors")
+
 // importPointers imports JSON pointers in the tree
-func (n *node) importPointers(t _type, pointers httpsfv.List) {
+// It returns ErrTooManySelectors as soon as the tree contains more than maxNodes nodes, the root excluded (-1 for unlimited)
+func (n *node) importPointers(t _type, pointers httpsfv.List, maxNodes int) error {
+	var count int
+	if maxNodes >= 0 {
+		count = n.count()
+	}
+
 	for _, member := range pointers {
 		// Ignore invalid value
 		member, ok := member.(httpsfv.Item)
@@ -39,11 +80,191 @@ func (n *node) importPointers(t _type, pointers httpsfv.List) {
 			continue
 		}
 
+		var negated bool
+		if t == fields && strings.HasPrefix(pointer, "!") {
+			negated = true
+			pointer = pointer[1:]
+		}
+
 		pointer = strings.Trim(pointer, "/")
-		if pointer != "" {
-			partsToTree(t, strings.Split(pointer, "/"), n, member.Params)
+		if pointer == "" {
+			continue
+		}
+
+		count += partsToTree(t, strings.Split(pointer, "/"), n, member.Params, negated)
+		if maxNodes >= 0 && count > maxNodes {
+			return ErrTooManySelectors
+		}
+	}
+
+	return nil
+}
+
+// rebasePointers prefixes the JSON pointers by the root pointer (see WithRootPointer), invalid and empty pointers are kept as is
+func rebasePointers(t _type, pointers httpsfv.List, root string) httpsfv.List {
+	root = strings.Trim(root, "/")
+	if root == "" {
+		return pointers
+	}
+
+	rebased := make(httpsfv.List, len(pointers))
+	for i, member := range pointers {
+		rebased[i] = member
+
+		item, ok := member.(httpsfv.Item)
+		if !ok {
+			continue
+		}
+
+		pointer, ok := item.Value.(string)
+		if !ok {
+			continue
+		}
+
+		var prefix string
+		if t == fields && strings.HasPrefix(pointer, "!") {
+			prefix, pointer = "!", pointer[1:]
 		}
+
+		if pointer = strings.Trim(pointer, "/"); pointer == "" {
+			continue
+		}
+
+		item.Value = prefix + "/" + root + "/" + pointer
+		rebased[i] = item
 	}
+
+	return rebased
+}
+
+// importTransformer adds a transformer to the node matched by the JSON pointer, the missing nodes are created
+func (n *node) importTransformer(pointer string, transformer func(value string) string) {
+	pointer = strings.Trim(pointer, "/")
+	if pointer == "" {
+		return
+	}
+
+	current := n
+	for _, part := range strings.Split(pointer, "/") {
+		var child *node
+		for _, c := range current.children {
+			if c.path == part {
+				child = c
+				break
+			}
+		}
+
+		if child == nil {
+			child = &node{path: part, parent: current}
+			current.children = append(current.children, child)
+		}
+
+		current = child
+	}
+
+	current.transformers = append(current.transformers, transformer)
+}
+
+// markEmbeddedJSON marks the node matched by the JSON pointer as containing embedded JSON documents, if it exists
+// Missing nodes aren't created: the embedded documents are traversed only if they are targeted by a directive
+func (n *node) markEmbeddedJSON(pointer string) {
+	pointer = strings.Trim(pointer, "/")
+	if pointer == "" {
+		return
+	}
+
+	current := n
+	for _, part := range strings.Split(pointer, "/") {
+		var child *node
+		for _, c := range current.children {
+			if c.path == part {
+				child = c
+				break
+			}
+		}
+
+		if child == nil {
+			return
+		}
+
+		current = child
+	}
+
+	current.embeddedJSON = true
+}
+
+// count returns the number of descendants of the node
+func (n *node) count() int {
+	c := len(n.children)
+	for _, child := range n.children {
+		c += child.count()
+	}
+
+	return c
+}
+
+// fieldsNegation tells if the selectors of a "fields" directive are negated (e.g. "!/password")
+// It returns ErrMixedFieldsSelectors if regular and negated selectors are mixed
+func fieldsNegation(pointers httpsfv.List) (bool, error) {
+	var regular, negated bool
+	for _, member := range pointers {
+		member, ok := member.(httpsfv.Item)
+		if !ok {
+			continue
+		}
+
+		pointer, ok := member.Value.(string)
+		if !ok {
+			continue
+		}
+
+		if strings.HasPrefix(pointer, "!") {
+			negated = true
+		} else {
+			regular = true
+		}
+	}
+
+	if regular && negated {
+		return false, ErrMixedFieldsSelectors
+	}
+
+	return negated, nil
+}
+
+// Path implements Node
+func (n *node) Path() string {
+	return n.path
+}
+
+// Preload implements Node
+func (n *node) Preload() bool {
+	return n.preload
+}
+
+// Fields implements Node
+func (n *node) Fields() bool {
+	return n.fields
+}
+
+// Negated implements Node
+func (n *node) Negated() bool {
+	return n.negated
+}
+
+// treeNode implements Node
+func (n *node) treeNode() *node {
+	return n
+}
+
+// Children implements Node
+func (n *node) Children() []Node {
+	children := make([]Node, len(n.children))
+	for i, c := range n.children {
+		children[i] = c
+	}
+
+	return children
 }
 
 // String returns a JSON pointer
@@ -62,10 +283,26 @@ func (n *node) String() string {
 	return s
 }
 
+// relationFieldsToken is the segment of a "preload" selector matching the fields whose names match the pattern set using WithRelationFieldPattern
+const relationFieldsToken = "~r"
+
+// hasWildcard checks if the node or one of its ancestors matches all elements of an array, all values of an object,
+// or the fields matching the pattern set using WithRelationFieldPattern
+func (n *node) hasWildcard() bool {
+	for c := n; c != nil; c = c.parent {
+		if c.path == "*" || c.path == relationFieldsToken {
+			return true
+		}
+	}
+
+	return false
+}
+
 // partsToTree transforms a splitted JSON pointer to a tree
-func partsToTree(t _type, parts []string, root *node, params *httpsfv.Params) {
+// It returns the number of created nodes
+func partsToTree(t _type, parts []string, root *node, params *httpsfv.Params, negated bool) (created int) {
 	if len(parts) == 0 {
-		return
+		return 0
 	}
 
 	var child *node
@@ -81,18 +318,48 @@ func partsToTree(t _type, parts []string, root *node, params *httpsfv.Params) {
 		child.path = parts[0]
 		child.parent = root
 		root.children = append(root.children, child)
+		created = 1
 	}
 
 	switch t {
 	case preload:
 		child.preload = true
 		child.preloadParams = append(child.preloadParams, params)
+		if len(parts) == 1 {
+			child.targetParams = append(child.targetParams, params)
+		}
 	case fields:
 		child.fields = true
 		child.fieldsParams = append(child.fieldsParams, params)
+		if negated && len(parts) == 1 {
+			child.negated = true
+		}
+	}
+
+	return created + partsToTree(t, parts[1:], child, params, negated)
+}
+
+// match returns the node targeted by a "preload" selector matching the given JSON pointer parts, "*" matches any part
+func (n *node) match(parts []string) *node {
+	if len(parts) == 0 {
+		if n.preload {
+			return n
+		}
+
+		return nil
+	}
+
+	for _, c := range n.children {
+		if c.negated || (c.path != "*" && unescape(c.path) != unescape(parts[0])) {
+			continue
+		}
+
+		if m := c.match(parts[1:]); m != nil {
+			return m
+		}
 	}
 
-	partsToTree(t, parts[1:], child, params)
+	return nil
 }
 
 // hasChildren checks if the node has at least a child of the given type
@@ -111,7 +378,8 @@ func (n *node) hasChildren(t _type) bool {
 
 // httpList transforms the node in an HTTP Structured Field List
 func (n *node) httpList(t _type, prefix string) httpsfv.List {
-	if len(n.children) == 0 {
+	negated := t == fields && n.negated
+	if negated || !n.hasChildren(t) {
 		if prefix == "" {
 			return httpsfv.List{}
 		}
@@ -123,6 +391,10 @@ func (n *node) httpList(t _type, prefix string) httpsfv.List {
 				list = append(list, httpsfv.Item{Value: prefix, Params: params})
 			}
 		case fields:
+			if negated {
+				prefix = "!" + prefix
+			}
+
 			for _, params := range n.fieldsParams {
 				list = append(list, httpsfv.Item{Value: prefix, Params: params})
 			}
@@ -142,3 +414,53 @@ func (n *node) httpList(t _type, prefix string) httpsfv.List {
 
 	return list
 }
+
+// hasPreloadParam tells if a "preload" selector ending at this node has the given parameter set to true (e.g. "/author";nopush)
+func (n *node) hasPreloadParam(name string) bool {
+	for _, params := range n.targetParams {
+		if params == nil {
+			continue
+		}
+
+		if v, ok := params.Get(name); ok {
+			if b, ok := v.(bool); ok && b {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// truncate removes the selectors of the given type deeper than maxDepth, it returns true if at least one has been removed
+func (n *node) truncate(t _type, maxDepth int) bool {
+	var truncated bool
+
+	children := make([]*node, 0, len(n.children))
+	for _, c := range n.children {
+		if maxDepth <= 0 {
+			switch {
+			case t == preload && c.preload:
+				c.preload = false
+				c.preloadParams = nil
+				c.targetParams = nil
+				truncated = true
+			case t == fields && c.fields:
+				c.fields = false
+				c.fieldsParams = nil
+				truncated = true
+			}
+		}
+
+		if c.truncate(t, maxDepth-1) {
+			truncated = true
+		}
+
+		if c.preload || c.fields {
+			children = append(children, c)
+		}
+	}
+	n.children = children
+
+	return truncated
+}
@@ -14,16 +14,33 @@ func TestRootNode(t *testing.T) {
 
 func TestImportPointers(t *testing.T) {
 	n := &node{}
-	n.importPointers(preload, httpsfv.List{httpsfv.NewItem("/foo"), httpsfv.NewItem("/bar/foo"), httpsfv.NewItem("/foo/*"), httpsfv.NewItem("/bar/foo/*/baz")})
-	n.importPointers(fields, httpsfv.List{httpsfv.NewItem("/foo/bat"), httpsfv.NewItem("/baz"), httpsfv.NewItem("/baz/*"), httpsfv.NewItem("/baz")})
+	n.importPointers(preload, httpsfv.List{httpsfv.NewItem("/foo"), httpsfv.NewItem("/bar/foo"), httpsfv.NewItem("/foo/*"), httpsfv.NewItem("/bar/foo/*/baz")}, -1)
+	n.importPointers(fields, httpsfv.List{httpsfv.NewItem("/foo/bat"), httpsfv.NewItem("/baz"), httpsfv.NewItem("/baz/*"), httpsfv.NewItem("/baz")}, -1)
 
 	assert.Equal(t, httpsfv.List{httpsfv.NewItem("/foo/*"), httpsfv.NewItem("/bar/foo/*/baz")}, n.httpList(preload, ""))
 	assert.Equal(t, httpsfv.List{httpsfv.NewItem("/foo/bat"), httpsfv.NewItem("/baz/*")}, n.httpList(fields, ""))
 }
 
+func TestRebasePointers(t *testing.T) {
+	n := &node{}
+	n.importPointers(preload, rebasePointers(preload, httpsfv.List{httpsfv.NewItem("/user/avatarUrl"), httpsfv.NewItem("/")}, "/data/"), -1)
+	n.importPointers(fields, rebasePointers(fields, httpsfv.List{httpsfv.NewItem("!/user/email")}, "/data"), -1)
+
+	assert.Equal(t, httpsfv.List{httpsfv.NewItem("/data/user/avatarUrl")}, n.httpList(preload, ""))
+	assert.Equal(t, httpsfv.List{httpsfv.NewItem("!/data/user/email")}, n.httpList(fields, ""))
+}
+
+func TestImportPointersMaxNodes(t *testing.T) {
+	n := &node{}
+	assert.NoError(t, n.importPointers(preload, httpsfv.List{httpsfv.NewItem("/author/name"), httpsfv.NewItem("/author/email")}, 3))
+	// Existing nodes aren't counted twice
+	assert.NoError(t, n.importPointers(fields, httpsfv.List{httpsfv.NewItem("/author")}, 3))
+	assert.ErrorIs(t, n.importPointers(fields, httpsfv.List{httpsfv.NewItem("/title")}, 3), ErrTooManySelectors)
+}
+
 func TestString(t *testing.T) {
 	n := &node{}
-	n.importPointers(preload, httpsfv.List{httpsfv.NewItem("/foo"), httpsfv.NewItem("/bar/foo"), httpsfv.NewItem("/foo/*"), httpsfv.NewItem("/bar/foo/*/baz")})
+	n.importPointers(preload, httpsfv.List{httpsfv.NewItem("/foo"), httpsfv.NewItem("/bar/foo"), httpsfv.NewItem("/foo/*"), httpsfv.NewItem("/bar/foo/*/baz")}, -1)
 
 	assert.Equal(t, "/", n.String())
 	assert.Equal(t, "/foo", n.children[0].String())
@@ -31,3 +48,63 @@ func TestString(t *testing.T) {
 	assert.Equal(t, "/foo/*", n.children[0].children[0].String())
 	assert.Equal(t, "/bar/foo/*/baz", n.children[1].children[0].children[0].children[0].String())
 }
+
+func TestHasPreloadParam(t *testing.T) {
+	l, err := httpsfv.UnmarshalList([]string{`"/author";nopush, "/related/author";nopush, "/editor";nopush=?0`})
+	assert.NoError(t, err)
+
+	n := &node{}
+	n.importPointers(preload, l, -1)
+
+	assert.True(t, n.children[0].hasPreloadParam("nopush"))
+	assert.False(t, n.children[0].hasPreloadParam("wait"))
+	// The parameter applies to the relation targeted by the selector only
+	assert.False(t, n.children[1].hasPreloadParam("nopush"))
+	assert.True(t, n.children[1].children[0].hasPreloadParam("nopush"))
+	assert.False(t, n.children[2].hasPreloadParam("nopush"))
+}
+
+func TestTruncate(t *testing.T) {
+	n := &node{}
+	n.importPointers(preload, httpsfv.List{httpsfv.NewItem("/friends/*/friends/*/friends"), httpsfv.NewItem("/author")}, -1)
+	n.importPointers(fields, httpsfv.List{httpsfv.NewItem("/friends/*/friends/*/name")}, -1)
+
+	assert.False(t, n.truncate(preload, 5))
+	assert.True(t, n.truncate(preload, 2))
+	assert.Equal(t, httpsfv.List{httpsfv.NewItem("/friends/*"), httpsfv.NewItem("/author")}, n.httpList(preload, ""))
+	assert.Equal(t, httpsfv.List{httpsfv.NewItem("/friends/*/friends/*/name")}, n.httpList(fields, ""))
+}
+
+func TestImportNegatedPointers(t *testing.T) {
+	n := &node{}
+	n.importPointers(fields, httpsfv.List{httpsfv.NewItem("!/password"), httpsfv.NewItem("!/author/email")}, -1)
+
+	assert.True(t, n.children[0].negated)
+	assert.False(t, n.children[1].negated)
+	assert.True(t, n.children[1].children[0].negated)
+	assert.Equal(t, httpsfv.List{httpsfv.NewItem("!/password"), httpsfv.NewItem("!/author/email")}, n.httpList(fields, ""))
+	assert.Equal(t, httpsfv.List{httpsfv.NewItem("!/email")}, n.children[1].httpList(fields, ""))
+}
+
+func TestFieldsNegation(t *testing.T) {
+	negated, err := fieldsNegation(httpsfv.List{httpsfv.NewItem("/foo"), httpsfv.NewItem("/bar")})
+	assert.False(t, negated)
+	assert.NoError(t, err)
+
+	negated, err = fieldsNegation(httpsfv.List{httpsfv.NewItem("!/foo"), httpsfv.NewItem("!/bar")})
+	assert.True(t, negated)
+	assert.NoError(t, err)
+
+	_, err = fieldsNegation(httpsfv.List{httpsfv.NewItem("/foo"), httpsfv.NewItem("!/bar")})
+	assert.ErrorIs(t, err, ErrMixedFieldsSelectors)
+}
+
+func TestHasWildcard(t *testing.T) {
+	n := &node{}
+	n.importPointers(preload, httpsfv.List{httpsfv.NewItem("/foo/*/bar"), httpsfv.NewItem("/baz")}, -1)
+
+	assert.False(t, n.children[0].hasWildcard())
+	assert.True(t, n.children[0].children[0].hasWildcard())
+	assert.True(t, n.children[0].children[0].children[0].hasWildcard())
+	assert.False(t, n.children[1].hasWildcard())
+}
@@ -0,0 +1,117 @@
+package vulcain
+
+import (
+	"strconv"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+	"go.uber.org/zap"
+)
+
+// jsonAPIProcessor is the JSONProcessor used when the JSON:API support is enabled (see WithJSONAPISupport)
+// Selectors target the relationships and the attributes of the primary resources: "/author" matches the related link of the "author" relationship,
+// and "/title" the "title" attribute.
+type jsonAPIProcessor struct {
+	v *Vulcain
+}
+
+// Process implements JSONProcessor
+func (p jsonAPIProcessor) Process(body []byte, tree Node, filter bool, relationHandler RelationHandler) []byte {
+	t := tree.treeNode()
+
+	data := gjson.GetBytes(body, "data")
+	switch {
+	case data.IsArray():
+		for i := range data.Array() {
+			body = p.processResource(body, "data."+strconv.Itoa(i), t, filter, relationHandler)
+		}
+	case data.IsObject():
+		body = p.processResource(body, "data", t, filter, relationHandler)
+	}
+
+	return body
+}
+
+// processResource handles the resource object stored at the given path
+func (p jsonAPIProcessor) processResource(body []byte, path string, tree *node, filter bool, relationHandler RelationHandler) []byte {
+	var err error
+	filter = filter && tree.hasChildren(fields)
+
+	var attributes, relationships []byte
+	if filter {
+		attributes, relationships = []byte("{}"), []byte("{}")
+	}
+
+	for _, n := range tree.children {
+		if n.path == "*" {
+			continue
+		}
+
+		key := jsonAPIKey(n.path)
+		relationshipPath := path + ".relationships." + key
+
+		if n.negated {
+			if body, err = sjson.DeleteBytes(body, path+".attributes."+key); err != nil {
+				p.v.logger.Debug("cannot remove attribute", zap.Stringer("node", n), zap.Error(err))
+			}
+			if body, err = sjson.DeleteBytes(body, relationshipPath); err != nil {
+				p.v.logger.Debug("cannot remove relationship", zap.Stringer("node", n), zap.Error(err))
+			}
+
+			continue
+		}
+
+		if n.preload {
+			// The related link can be a string or a link object
+			hrefPath := relationshipPath + ".links.related"
+			if gjson.GetBytes(body, hrefPath).IsObject() {
+				hrefPath += ".href"
+			}
+
+			if related := gjson.GetBytes(body, hrefPath); related.Type == gjson.String {
+				if newValue := relationHandler(n, related.String()); newValue != "" {
+					if body, err = sjson.SetBytes(body, hrefPath, newValue); err != nil {
+						p.v.logger.Debug("cannot update related link", zap.Stringer("node", n), zap.Error(err))
+					}
+				}
+			}
+		}
+
+		if !filter || !(n.fields || n.preload) {
+			continue
+		}
+
+		if attribute := gjson.GetBytes(body, path+".attributes."+key); attribute.Exists() {
+			if attributes, err = sjson.SetRawBytes(attributes, key, []byte(attribute.Raw)); err != nil {
+				p.v.logger.Debug("cannot filter attributes", zap.Stringer("node", n), zap.Error(err))
+			}
+		}
+		if relationship := gjson.GetBytes(body, relationshipPath); relationship.Exists() {
+			if relationships, err = sjson.SetRawBytes(relationships, key, []byte(relationship.Raw)); err != nil {
+				p.v.logger.Debug("cannot filter relationships", zap.Stringer("node", n), zap.Error(err))
+			}
+		}
+	}
+
+	if !filter {
+		return body
+	}
+
+	// Sparse fieldsets: only the selected attributes and relationships are kept, identification members are always kept
+	for member, value := range map[string][]byte{"attributes": attributes, "relationships": relationships} {
+		if !gjson.GetBytes(body, path+"."+member).Exists() {
+			continue
+		}
+
+		if body, err = sjson.SetRawBytes(body, path+"."+member, value); err != nil {
+			p.v.logger.Debug("cannot filter resource", zap.String("member", member), zap.Error(err))
+		}
+	}
+
+	return body
+}
+
+// jsonAPIKey converts the path of a node to a gjson key
+func jsonAPIKey(path string) string {
+	return escapeSJSONKey(unescape(path))
+}
@@ -0,0 +1,41 @@
+package vulcain
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJSONAPI(t *testing.T) {
+	v := New(WithJSONAPISupport())
+
+	doc := `{"data": [{"type": "books", "id": "1", "attributes": {"title": "1984", "isbn": "9780451524935"}, "relationships": {"author": {"links": {"related": "/books/1/author"}}, "publisher": {"links": {"related": {"href": "/books/1/publisher"}}}}}], "included": []}`
+
+	rw := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	req := newTestRequest(v, rw, "/books", http.Header{"Preload": []string{`"/author/address", "/publisher"`}, "Fields": []string{`"/title", "/author/name"`}})
+	defer v.Finish(req, false)
+
+	b, err := v.Apply(req, rw, strings.NewReader(doc), rw.Header())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/books/1/author", "/books/1/publisher"}, rw.pushed)
+	assert.Equal(t, `"/address"`, rw.options[0].Header.Get("Preload"))
+	assert.Equal(t, `"/name"`, rw.options[0].Header.Get("Fields"))
+	assert.Equal(t, `{"data": [{"type": "books", "id": "1", "attributes": {"title":"1984"}, "relationships": {"author":{"links": {"related": "/books/1/author"}},"publisher":{"links": {"related": {"href": "/books/1/publisher"}}}}}], "included": []}`, string(b))
+}
+
+func TestJSONAPIQuery(t *testing.T) {
+	v := New(WithJSONAPISupport())
+
+	doc := `{"data": {"type": "books", "id": "1", "attributes": {"title": "1984", "isbn": "9780451524935"}, "relationships": {"author": {"links": {"related": "/books/1/author"}}}}}`
+
+	rw := httptest.NewRecorder()
+	req := newTestRequest(v, rw, `/books/1?preload="/author/address"&fields="!/isbn"`, nil)
+	defer v.Finish(req, false)
+
+	b, err := v.Apply(req, rw, strings.NewReader(doc), rw.Header())
+	assert.NoError(t, err)
+	assert.Equal(t, `{"data": {"type": "books", "id": "1", "attributes": {"title": "1984"}, "relationships": {"author": {"links": {"related": "/books/1/author?preload=%22%2Faddress%22"}}}}}`, string(b))
+}
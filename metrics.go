@@ -0,0 +1,22 @@
+package vulcain
+
+// Metrics allows to collect statistics about pushes and Link rel=preload headers
+// Use WithMetrics() to register an implementation, for instance one backed by Prometheus counters
+type Metrics interface {
+	// PushAttempted is called before trying to push a relation
+	PushAttempted(relation string)
+	// PushSucceeded is called when a relation has been pushed
+	PushSucceeded(relation string)
+	// PushFailed is called when a relation cannot be pushed, relations already pushed aren't reported as failures
+	PushFailed(relation string, err error)
+	// PreloadHeaderAdded is called when a Link rel=preload header is added
+	PreloadHeaderAdded(relation string)
+}
+
+// nopMetrics is the default Metrics implementation, it does nothing
+type nopMetrics struct{}
+
+func (nopMetrics) PushAttempted(string)      {}
+func (nopMetrics) PushSucceeded(string)      {}
+func (nopMetrics) PushFailed(string, error)  {}
+func (nopMetrics) PreloadHeaderAdded(string) {}
@@ -0,0 +1,24 @@
+package vulcain
+
+import (
+	"bytes"
+	"regexp"
+)
+
+// ndjsonRe matches the newline-delimited JSON content types (e.g. application/x-ndjson or application/jsonl)
+var ndjsonRe = regexp.MustCompile(`(?i)\b(ndjson|jsonl|jsonlines)\b`)
+
+// processLines calls process for every line of a newline-delimited JSON document and reassembles the results
+// Blank lines are kept as is
+func processLines(body []byte, process func(line []byte) []byte) []byte {
+	lines := bytes.Split(body, []byte("\n"))
+	for i, line := range lines {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		lines[i] = process(line)
+	}
+
+	return bytes.Join(lines, []byte("\n"))
+}
@@ -0,0 +1,47 @@
+package vulcain
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProcessLines(t *testing.T) {
+	b := processLines([]byte("a\n\nb\n"), func(line []byte) []byte {
+		return []byte(strings.ToUpper(string(line)))
+	})
+	assert.Equal(t, "A\n\nB\n", string(b))
+}
+
+func TestApplyNDJSON(t *testing.T) {
+	responseHeader := http.Header{"Content-Type": []string{"application/x-ndjson"}}
+
+	req := httptest.NewRequest("GET", "/books", nil)
+	assert.False(t, New().IsValidResponse(req, http.StatusOK, responseHeader))
+	assert.True(t, New(WithNDJSONSupport()).IsValidResponse(req, http.StatusOK, responseHeader))
+
+	v := New(WithNDJSONSupport(), WithMaxPushes(2))
+
+	rw := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	rw.Header().Set("Content-Type", "application/x-ndjson")
+	req = newTestRequest(v, rw, "/books", http.Header{"Preload": []string{`"/author"`}, "Fields": []string{`"/author"`}})
+	defer v.Finish(req, false)
+
+	body := `{"title": "1984", "author": "/authors/1"}
+{"title": "Animal Farm", "author": "/authors/1"}
+{"title": "Brave New World", "author": "/authors/2"}
+{"title": "Dune", "author": "/authors/3"}
+`
+	b, err := v.Apply(req, rw, strings.NewReader(body), rw.Header())
+	assert.NoError(t, err)
+	assert.Equal(t, `{"author":"/authors/1"}
+{"author":"/authors/1"}
+{"author":"/authors/2"}
+{"author":"/authors/3"}
+`, string(b))
+	assert.Equal(t, []string{"/authors/1", "/authors/2"}, rw.pushed)
+	assert.Equal(t, []string{"</authors/3>; rel=preload; as=fetch"}, rw.Header()["Link"])
+}
@@ -1,84 +1,442 @@
 package vulcain
 
 import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/andybalholm/brotli"
+	"github.com/dunglas/httpsfv"
 	"github.com/getkin/kin-openapi/openapi3"
 	"github.com/getkin/kin-openapi/routers"
 	"github.com/getkin/kin-openapi/routers/legacy"
+	"github.com/tidwall/gjson"
 	"go.uber.org/zap"
 )
 
-// openAPI is used to find the URL of a relation using an OpenAPI description
+// maxPushesExtension is the OpenAPI extension allowing to set the maximum number of resources to push for an operation
+const maxPushesExtension = "x-vulcain-max-pushes"
+
+// schemaExtension is the OpenAPI extension restricting a link to the documents matching a variant of a discriminated schema (e.g. #/components/schemas/Article)
+const schemaExtension = "x-vulcain-schema"
+
+// minimalFieldsExtension is the OpenAPI extension allowing to set the fields kept for an operation when the client prefers a minimal representation
+const minimalFieldsExtension = "x-vulcain-minimal-fields"
+
+// openAPIFetchTimeout is the maximum duration allowed to fetch a remote OpenAPI definition
+const openAPIFetchTimeout = 10 * time.Second
+
+// openAPI is used to find the URL of a relation using one or several OpenAPI descriptions
+// The descriptions can be reloaded at any time, the specs and routers fields are swapped atomically
 type openAPI struct {
-	swagger *openapi3.T
-	router  routers.Router
+	sync.RWMutex
+	specs   []*openapi3.T
+	routers []routers.Router
 	logger  *zap.Logger
+	load    func() ([]*openapi3.T, error)
+	// newRouter creates the router of a definition, see WithOpenAPIRouter
+	newRouter func(spec *openapi3.T) (routers.Router, error)
+}
+
+// errDecompression occurs when a compressed OpenAPI definition cannot be decompressed
+var errDecompression = errors.New("cannot decompress the OpenAPI definition")
+
+// newOpenAPI creates a new openAPI instance
+// The file can be compressed using gzip or brotli (.br extension), if it cannot be decompressed errDecompression is returned
+func newOpenAPI(file string, logger *zap.Logger) (*openAPI, error) {
+	return newOpenAPIFiles([]string{file}, nil, logger)
 }
 
-// newOpenAPI creates a ne openAPI instance
-func newOpenAPI(file string, logger *zap.Logger) *openAPI {
-	swagger, err := openapi3.NewLoader().LoadFromFile(file)
+// newOpenAPIFiles creates a new openAPI instance merging the definitions stored in several files
+// When a path is documented in several files, the first file wins
+// If newRouter is nil, the router of kin-openapi is used
+func newOpenAPIFiles(files []string, newRouter func(spec *openapi3.T) (routers.Router, error), logger *zap.Logger) (*openAPI, error) {
+	o := &openAPI{logger: logger, newRouter: newRouter, load: func() ([]*openapi3.T, error) {
+		specs := make([]*openapi3.T, 0, len(files))
+		for _, file := range files {
+			spec, err := loadOpenAPIFile(file)
+			if err != nil {
+				return nil, err
+			}
+
+			specs = append(specs, spec)
+		}
+
+		return specs, nil
+	}}
+	if err := o.reload(); err != nil {
+		return nil, err
+	}
+
+	return o, nil
+}
+
+// loadOpenAPIFile parses a definition in YAML or JSON stored in a file
+func loadOpenAPIFile(file string) (*openapi3.T, error) {
+	data, err := os.ReadFile(file)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+
+	if data, err = decompressOpenAPI(file, data); err != nil {
+		return nil, err
 	}
 
-	router, err := legacy.NewRouter(swagger)
+	return openapi3.NewLoader().LoadFromDataWithPath(data, &url.URL{Path: filepath.ToSlash(file)})
+}
+
+// decompressOpenAPI decompresses gzip (detected using magic bytes) and brotli (detected using the .br extension) definitions
+func decompressOpenAPI(name string, data []byte) ([]byte, error) {
+	var (
+		r   io.Reader
+		err error
+	)
+	switch {
+	case bytes.HasPrefix(data, []byte{0x1f, 0x8b}):
+		if r, err = gzip.NewReader(bytes.NewReader(data)); err != nil {
+			return nil, fmt.Errorf("%w: %w", errDecompression, err)
+		}
+	case strings.HasSuffix(name, ".br"):
+		r = brotli.NewReader(bytes.NewReader(data))
+	default:
+		return data, nil
+	}
+
+	if data, err = io.ReadAll(r); err != nil {
+		return nil, fmt.Errorf("%w: %w", errDecompression, err)
+	}
+
+	return data, nil
+}
+
+// newOpenAPIFromURL creates a new openAPI instance from a definition fetched over HTTP
+// The instance is returned even if the definition cannot be loaded, to allow reloading it later
+// If newRouter is nil, the router of kin-openapi is used
+func newOpenAPIFromURL(rawURL string, newRouter func(spec *openapi3.T) (routers.Router, error), logger *zap.Logger) (*openAPI, error) {
+	o := &openAPI{logger: logger, newRouter: newRouter, load: func() ([]*openapi3.T, error) {
+		spec, err := fetchOpenAPI(rawURL)
+		if err != nil {
+			return nil, err
+		}
+
+		return []*openapi3.T{spec}, nil
+	}}
+
+	return o, o.reload()
+}
+
+// fetchOpenAPI fetches and parses a definition in YAML or JSON over HTTP
+func fetchOpenAPI(rawURL string) (*openapi3.T, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{Timeout: openAPIFetchTimeout}
+	resp, err := client.Get(u.String())
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+	defer resp.Body.Close()
 
-	return &openAPI{
-		swagger,
-		router,
-		logger,
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d when fetching the OpenAPI definition", resp.StatusCode)
 	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if data, err = decompressOpenAPI(u.Path, data); err != nil {
+		return nil, err
+	}
+
+	return openapi3.NewLoader().LoadFromDataWithPath(data, u)
+}
+
+// reload loads the definitions again, the current ones are kept if a new one is invalid
+func (o *openAPI) reload() error {
+	specs, err := o.load()
+	if err != nil {
+		return err
+	}
+
+	newRouter := o.newRouter
+	if newRouter == nil {
+		newRouter = func(spec *openapi3.T) (routers.Router, error) {
+			return legacy.NewRouter(spec)
+		}
+	}
+
+	rs := make([]routers.Router, 0, len(specs))
+	for i, spec := range specs {
+		// The servers are matched by getRoute, which also takes the host of the request into account
+		routed := *spec
+		routed.Servers = nil
+
+		router, err := newRouter(&routed)
+		if err != nil {
+			return err
+		}
+
+		rs = append(rs, router)
+
+		for path := range spec.Paths {
+			for _, previous := range specs[:i] {
+				if previous.Paths.Find(path) != nil {
+					o.logger.Warn("path documented in several OpenAPI definitions, the first one is used", zap.String("path", path))
+
+					break
+				}
+			}
+		}
+	}
+
+	o.Lock()
+	o.specs, o.routers = specs, rs
+	o.Unlock()
+
+	return nil
 }
 
 // getRoute gets the routers.Route instance related to the given URL
+// When several definitions are loaded, the route of the first one matching the servers and the path is returned
+// The Server field of the returned route is set to the server matching the URL, if any
 func (o *openAPI) getRoute(url *url.URL) *routers.Route {
-	route, _, err := o.router.FindRoute(&http.Request{Method: "GET", URL: url})
+	o.RLock()
+	specs, rs := o.specs, o.routers
+	o.RUnlock()
+
+	if len(rs) == 0 {
+		return nil
+	}
+
+	err := routers.ErrPathNotFound
+	for i, router := range rs {
+		server, path, ok := matchServer(specs[i].Servers, url)
+		if !ok {
+			continue
+		}
+
+		u := *url
+		u.Path, u.RawPath = path, ""
+
+		var route *routers.Route
+		if route, _, err = router.FindRoute(&http.Request{Method: "GET", URL: &u}); err == nil {
+			r := *route
+			r.Spec, r.Server = specs[i], server
+
+			return &r
+		}
+	}
+
+	o.logger.Debug("route not found in the OpenAPI specification", zap.Stringer("url", url), zap.Error(err))
+
+	return nil
+}
+
+// matchServer returns the server matching the host (if known) and the path of the URL, and the path relative to this server
+// All URLs match if no servers are documented
+func matchServer(servers openapi3.Servers, url *url.URL) (*openapi3.Server, string, bool) {
+	if len(servers) == 0 {
+		return nil, url.Path, true
+	}
+
+	for _, server := range servers {
+		su, err := parseServerURL(server)
+		if err != nil {
+			continue
+		}
+
+		if su.Host != "" && url.Host != "" && !strings.EqualFold(su.Hostname(), url.Hostname()) {
+			continue
+		}
+
+		base := strings.TrimSuffix(su.Path, "/")
+		if base == "" {
+			return server, url.Path, true
+		}
+
+		if url.Path == base {
+			return server, "/", true
+		}
+
+		if strings.HasPrefix(url.Path, base+"/") {
+			return server, url.Path[len(base):], true
+		}
+	}
+
+	return nil, "", false
+}
+
+// parseServerURL parses the URL of the server, variables are replaced by their default values
+func parseServerURL(server *openapi3.Server) (*url.URL, error) {
+	u := server.URL
+	for name, variable := range server.Variables {
+		if variable != nil {
+			u = strings.ReplaceAll(u, "{"+name+"}", variable.Default)
+		}
+	}
+
+	return url.Parse(u)
+}
+
+// serverBasePath returns the base path of the server, without trailing slash
+func serverBasePath(server *openapi3.Server) string {
+	if server == nil {
+		return ""
+	}
+
+	u, err := parseServerURL(server)
 	if err != nil {
-		o.logger.Debug("route not found in the OpenAPI specification", zap.Stringer("url", url), zap.Error(err))
+		return ""
 	}
 
-	return route
+	return strings.TrimSuffix(u.Path, "/")
+}
+
+// getMaxPushes returns the maximum number of resources to push set for the given route using the x-vulcain-max-pushes extension, if any
+func (o *openAPI) getMaxPushes(r *routers.Route) (int, bool) {
+	if r == nil || r.Operation == nil {
+		return 0, false
+	}
+
+	switch v := r.Operation.Extensions[maxPushesExtension].(type) {
+	case float64:
+		return int(v), true
+	case int:
+		return v, true
+	case nil:
+		return 0, false
+	}
+
+	o.logger.Debug("invalid "+maxPushesExtension+" value", zap.String("path", r.Path), zap.Any("value", r.Operation.Extensions[maxPushesExtension]))
+
+	return 0, false
+}
+
+// getMinimalFields returns the "fields" directive set for the given route using the x-vulcain-minimal-fields extension, if any
+// The extension contains a list of JSON pointers, or a string using the syntax of the Fields HTTP header
+func (o *openAPI) getMinimalFields(r *routers.Route) (httpsfv.List, bool) {
+	if r == nil || r.Operation == nil {
+		return nil, false
+	}
+
+	switch v := r.Operation.Extensions[minimalFieldsExtension].(type) {
+	case nil:
+		return nil, false
+	case string:
+		if l, err := httpsfv.UnmarshalList([]string{v}); err == nil {
+			return l, true
+		}
+	case []interface{}:
+		l := make(httpsfv.List, 0, len(v))
+		for _, pointer := range v {
+			p, ok := pointer.(string)
+			if !ok {
+				l = nil
+				break
+			}
+
+			l = append(l, httpsfv.NewItem(p))
+		}
+
+		if l != nil {
+			return l, true
+		}
+	}
+
+	o.logger.Debug("invalid "+minimalFieldsExtension+" value", zap.String("path", r.Path), zap.Any("value", r.Operation.Extensions[minimalFieldsExtension]))
+
+	return nil, false
+}
+
+// getContentTypes returns the media types of the successful responses documented for the route, sorted alphabetically
+func (o *openAPI) getContentTypes(r *routers.Route) []string {
+	if r == nil || r.Operation == nil {
+		return nil
+	}
+
+	seen := make(map[string]struct{})
+	for code, responseRef := range r.Operation.Responses {
+		if !strings.HasPrefix(code, "2") || responseRef.Value == nil {
+			continue
+		}
+
+		for t := range responseRef.Value.Content {
+			seen[t] = struct{}{}
+		}
+	}
+
+	types := make([]string, 0, len(seen))
+	for t := range seen {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+
+	return types
 }
 
 // getRelation generated the link for the given parameters
-// TODO: support operationRef in addition to operationId
-func (o *openAPI) getRelation(r *routers.Route, selector, value string) string {
+// The base path of the server matching the request is prepended to the path of the link
+// n is the node matching the relation, it's used to resolve the discriminators of the document (it can be nil)
+func (o *openAPI) getRelation(r *routers.Route, selector, value string, n *node) string {
+	rel, _ := o.getRelationOperation(r, selector, value, n)
+
+	return rel
+}
+
+// getRelationOperation is the same as getRelation, but also returns the HTTP method of the operation targeted by the link
+func (o *openAPI) getRelationOperation(r *routers.Route, selector, value string, n *node) (rel, method string) {
 	for code, responseRef := range r.Operation.Responses {
 		if (!strings.HasPrefix(code, "2")) || responseRef.Value == nil {
 			continue
 		}
 
-		if rel := o.generateLinkForResponse(responseRef.Value, selector, value); rel != "" {
-			return rel
+		if rel, method = o.generateLinkForResponse(r.Spec, responseRef.Value, selector, value, excludedSchemas(responseRef.Value, n)); rel != "" {
+			return serverBasePath(r.Server) + rel, method
 		}
 	}
 
 	// Fallback on the default response
 	if d := r.Operation.Responses.Default(); d != nil && d.Value != nil {
-		if rel := o.generateLinkForResponse(d.Value, selector, value); rel != "" {
-			return rel
+		if rel, method = o.generateLinkForResponse(r.Spec, d.Value, selector, value, excludedSchemas(d.Value, n)); rel != "" {
+			return serverBasePath(r.Server) + rel, method
 		}
 	}
 
-	o.logger.Error("openAPI Link not found (using operationRef isn't supported yet)")
+	o.logger.Error("openAPI Link not found")
 
-	return ""
+	return "", ""
 }
 
 // generateLinkForResponse uses the openapi3.Response extracted from the OpenAPI description to generate a URL
-func (o *openAPI) generateLinkForResponse(response *openapi3.Response, selector, value string) string {
+// The links restricted to an excluded schema using the x-vulcain-schema extension are ignored
+// The HTTP method of the operation targeted by the link is also returned
+func (o *openAPI) generateLinkForResponse(spec *openapi3.T, response *openapi3.Response, selector, value string, excluded map[string]struct{}) (string, string) {
 	for _, linkRef := range response.Links {
 		if linkRef == nil || linkRef.Value == nil {
 			continue
 		}
 
+		if ref, _ := linkRef.Value.Extensions[schemaExtension].(string); ref != "" {
+			if _, ok := excluded[ref]; ok {
+				continue
+			}
+		}
+
 		var parameter string
 		for p, s := range linkRef.Value.Parameters {
 			if s == "$response.body#"+selector {
@@ -87,23 +445,190 @@ func (o *openAPI) generateLinkForResponse(response *openapi3.Response, selector,
 			}
 		}
 
-		if parameter != "" && linkRef.Value.OperationID != "" {
-			return o.generateLink(linkRef.Value.OperationID, parameter, value)
+		if parameter == "" {
+			continue
+		}
+
+		if linkRef.Value.OperationID != "" {
+			return o.generateLinkWithMethod(spec, linkRef.Value.OperationID, parameter, value)
+		}
+
+		if linkRef.Value.OperationRef != "" {
+			if rel, method := o.generateLinkFromRef(spec, linkRef.Value.OperationRef, parameter, value); rel != "" {
+				return rel, method
+			}
+		}
+	}
+
+	return "", ""
+}
+
+// excludedSchemas walks the schemas of the response along the path of the node, and returns the references of the variants of the discriminated schemas not matching the document
+// The discriminator values are read from the values traversed by the ancestors of the node, the variants are never excluded if the value is unknown
+func excludedSchemas(response *openapi3.Response, n *node) map[string]struct{} {
+	if n == nil {
+		return nil
+	}
+
+	var nodes []*node
+	for c := n; c != nil; c = c.parent {
+		nodes = append([]*node{c}, nodes...)
+	}
+
+	excluded := make(map[string]struct{})
+	for _, mediaType := range response.Content {
+		if mediaType == nil {
+			continue
+		}
+
+		schema := mediaType.Schema
+		for i, c := range nodes {
+			if schema == nil || schema.Value == nil {
+				break
+			}
+
+			schema = selectVariant(schema, c.value, excluded)
+			if i == len(nodes)-1 || schema.Value == nil {
+				break
+			}
+
+			schema = childSchema(schema.Value, nodes[i+1].path)
+		}
+	}
+
+	return excluded
+}
+
+// selectVariant returns the variant of a schema having a discriminator matching the value, and adds the other variants to excluded
+// The schema itself is returned if it has no discriminator or if no variant matches
+func selectVariant(schema *openapi3.SchemaRef, value []byte, excluded map[string]struct{}) *openapi3.SchemaRef {
+	discriminator := schema.Value.Discriminator
+	if discriminator == nil {
+		return schema
+	}
+
+	variants := schema.Value.OneOf
+	if len(variants) == 0 {
+		variants = schema.Value.AnyOf
+	}
+
+	d := gjson.GetBytes(value, espaceSJSONPath(discriminator.PropertyName))
+	if len(variants) == 0 || d.Type != gjson.String {
+		return schema
+	}
+
+	// Without explicit mapping, the value is the name of the schema
+	ref := d.String()
+	if mapped, ok := discriminator.Mapping[ref]; ok {
+		ref = mapped
+	}
+	if !strings.Contains(ref, "/") {
+		ref = "#/components/schemas/" + ref
+	}
+
+	var selected *openapi3.SchemaRef
+	for _, variant := range variants {
+		if variant.Ref == ref {
+			selected = variant
+			break
+		}
+	}
+	if selected == nil {
+		return schema
+	}
+
+	for _, variant := range variants {
+		if variant != selected && variant.Ref != "" {
+			excluded[variant.Ref] = struct{}{}
+		}
+	}
+
+	return selected
+}
+
+// childSchema returns the schema of the value matched by the path segment of a JSON pointer ("*" matches all elements of an array or all values of an object)
+func childSchema(schema *openapi3.Schema, path string) *openapi3.SchemaRef {
+	if schema.Items != nil {
+		if _, err := strconv.Atoi(path); err == nil || path == "*" {
+			return schema.Items
+		}
+	}
+
+	if property, ok := schema.Properties[unescape(path)]; ok {
+		return property
+	}
+
+	for _, s := range schema.AllOf {
+		if s == nil || s.Value == nil {
+			continue
+		}
+
+		if property := childSchema(s.Value, path); property != nil {
+			return property
 		}
 	}
 
-	return ""
+	return schema.AdditionalProperties.Schema
 }
 
 // generateLink uses the template IRI extracted from the OpenAPI description to generate a URL
-func (o *openAPI) generateLink(operationID, parameter, value string) string {
-	for path, i := range o.swagger.Paths {
-		if op := i.GetOperation("GET"); op != nil && op.OperationID == operationID {
-			return strings.ReplaceAll(path, "{"+parameter+"}", value)
+// The operation is searched in the given definition first, then in the other loaded ones
+func (o *openAPI) generateLink(spec *openapi3.T, operationID, parameter, value string) string {
+	rel, _ := o.generateLinkWithMethod(spec, operationID, parameter, value)
+
+	return rel
+}
+
+// generateLinkWithMethod is the same as generateLink, but also returns the HTTP method of the operation
+func (o *openAPI) generateLinkWithMethod(spec *openapi3.T, operationID, parameter, value string) (string, string) {
+	o.RLock()
+	specs := o.specs
+	o.RUnlock()
+
+	if spec != nil {
+		specs = append([]*openapi3.T{spec}, specs...)
+	}
+
+	for _, s := range specs {
+		for path, i := range s.Paths {
+			for method, op := range i.Operations() {
+				if op.OperationID == operationID {
+					return expandPathTemplate(path, parameter, value), method
+				}
+			}
 		}
 	}
 
 	o.logger.Debug("operation not found in the OpenAPI specification", zap.String("operationID", operationID))
 
-	return ""
+	return "", ""
+}
+
+// generateLinkFromRef uses the path referenced by an operationRef to generate a URL, the HTTP method of the operation is also returned
+// Only local references (e.g. #/paths/~1books~1{id}/get) of the given definition are supported
+func (o *openAPI) generateLinkFromRef(spec *openapi3.T, operationRef, parameter, value string) (string, string) {
+	ref := strings.TrimPrefix(operationRef, "#/paths/")
+	i := strings.LastIndex(ref, "/")
+	if ref == operationRef || i == -1 {
+		o.logger.Debug("unsupported operationRef", zap.String("operationRef", operationRef))
+
+		return "", ""
+	}
+
+	path := strings.NewReplacer("~1", "/", "~0", "~").Replace(ref[:i])
+	method := strings.ToUpper(ref[i+1:])
+
+	item := spec.Paths.Find(path)
+	if item == nil || item.GetOperation(method) == nil {
+		o.logger.Debug("operation not found in the OpenAPI specification", zap.String("operationRef", operationRef))
+
+		return "", ""
+	}
+
+	return expandPathTemplate(path, parameter, value), method
+}
+
+// expandPathTemplate replaces the parameter of the path template by the escaped value
+func expandPathTemplate(path, parameter, value string) string {
+	return strings.ReplaceAll(path, "{"+parameter+"}", url.PathEscape(value))
 }
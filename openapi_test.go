@@ -1,24 +1,227 @@
 package vulcain
 
 import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
 
+	"github.com/andybalholm/brotli"
+	"github.com/dunglas/httpsfv"
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/legacy"
 	"github.com/stretchr/testify/assert"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
 )
 
 const openapiFixture = "./fixtures/openapi.yaml"
 
 func TestNewOpenAPI(t *testing.T) {
-	assert.NotNil(t, newOpenAPI(openapiFixture, zap.NewNop()))
+	oa, err := newOpenAPI(openapiFixture, zap.NewNop())
+	assert.NoError(t, err)
+	assert.NotNil(t, oa)
+
+	oa, err = newOpenAPI("notexists", zap.NewNop())
+	assert.Error(t, err)
+	assert.Nil(t, oa)
+
+	// Invalid local definitions are configuration errors
 	assert.Panics(t, func() {
-		newOpenAPI("notexists", zap.NewNop())
+		New(WithOpenAPIFile("notexists"))
 	})
 }
 
+func TestNewOpenAPICompressed(t *testing.T) {
+	data, err := os.ReadFile(openapiFixture)
+	assert.NoError(t, err)
+
+	dir := t.TempDir()
+	u, _ := url.Parse("/oa/books/123")
+
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	_, _ = gw.Write(data)
+	assert.NoError(t, gw.Close())
+	gzFile := filepath.Join(dir, "openapi.yaml.gz")
+	assert.NoError(t, os.WriteFile(gzFile, gz.Bytes(), 0o644))
+
+	oa, err := newOpenAPI(gzFile, zap.NewNop())
+	assert.NoError(t, err)
+	assert.Equal(t, "/oa/authors/456", oa.getRelation(oa.getRoute(u), "/author", "456", nil))
+
+	var br bytes.Buffer
+	bw := brotli.NewWriter(&br)
+	_, _ = bw.Write(data)
+	assert.NoError(t, bw.Close())
+	brFile := filepath.Join(dir, "openapi.yaml.br")
+	assert.NoError(t, os.WriteFile(brFile, br.Bytes(), 0o644))
+
+	oa, err = newOpenAPI(brFile, zap.NewNop())
+	assert.NoError(t, err)
+	assert.Equal(t, "/oa/authors/456", oa.getRelation(oa.getRoute(u), "/author", "456", nil))
+
+	invalidFile := filepath.Join(dir, "invalid.yaml.gz")
+	assert.NoError(t, os.WriteFile(invalidFile, []byte{0x1f, 0x8b, 0x00}, 0o644))
+	_, err = newOpenAPI(invalidFile, zap.NewNop())
+	assert.ErrorIs(t, err, errDecompression)
+
+	// A definition that cannot be decompressed disables the OpenAPI support instead of crashing
+	core, logs := observer.New(zap.ErrorLevel)
+	assert.Nil(t, New(WithOpenAPIFile(invalidFile), WithLogger(zap.New(core))).openAPI)
+	assert.Equal(t, 1, logs.FilterMessage("OpenAPI support disabled").Len())
+}
+
+func TestNewOpenAPIFiles(t *testing.T) {
+	reviews := filepath.Join(t.TempDir(), "reviews.yaml")
+	assert.NoError(t, os.WriteFile(reviews, []byte(`openapi: 3.0.0
+info:
+  title: Reviews
+  version: 1.0.0
+paths:
+  '/oa/reviews/{id}':
+    parameters:
+      - name: id
+        in: path
+        required: true
+        schema:
+          type: integer
+    get:
+      responses:
+        '200':
+          description: OK
+          links:
+            book:
+              operationId: getBook
+              parameters:
+                id: '$response.body#/book'
+  '/oa/authors/{id}':
+    parameters:
+      - name: id
+        in: path
+        required: true
+        schema:
+          type: integer
+    get:
+      operationId: getWriter
+      responses:
+        '200':
+          description: OK
+`), 0o644))
+
+	core, logs := observer.New(zap.WarnLevel)
+	oa, err := newOpenAPIFiles([]string{openapiFixture, reviews}, nil, zap.New(core))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, logs.FilterMessage("path documented in several OpenAPI definitions, the first one is used").Len())
+
+	u, _ := url.Parse("/oa/reviews/1")
+	assert.Equal(t, "/oa/books/42", oa.getRelation(oa.getRoute(u), "/book", "42", nil))
+
+	u, _ = url.Parse("/oa/books/123")
+	assert.Equal(t, "/oa/authors/456", oa.getRelation(oa.getRoute(u), "/author", "456", nil))
+
+	u, _ = url.Parse("/oa/authors/1")
+	assert.Equal(t, "getAuthor", oa.getRoute(u).Operation.OperationID)
+
+	v := New(WithOpenAPIFile(openapiFixture), WithOpenAPIFiles(reviews))
+	assert.Len(t, v.openAPI.specs, 2)
+}
+
+// countingRouter counts the routes searched by the wrapped router
+type countingRouter struct {
+	routers.Router
+	calls int
+}
+
+func (r *countingRouter) FindRoute(req *http.Request) (*routers.Route, map[string]string, error) {
+	r.calls++
+
+	return r.Router.FindRoute(req)
+}
+
+func TestOpenAPIRouter(t *testing.T) {
+	var router *countingRouter
+	v := New(WithOpenAPIFile(openapiFixture), WithOpenAPIRouter(func(spec *openapi3.T) (routers.Router, error) {
+		r, err := legacy.NewRouter(spec)
+		router = &countingRouter{Router: r}
+
+		return router, err
+	}))
+
+	u, _ := url.Parse("/oa/books/123")
+	assert.Equal(t, "/oa/authors/456", v.openAPI.getRelation(v.openAPI.getRoute(u), "/author", "456", nil))
+	assert.Equal(t, 1, router.calls)
+
+	// Errors are handled like invalid definitions
+	assert.Panics(t, func() {
+		New(WithOpenAPIFile(openapiFixture), WithOpenAPIRouter(func(spec *openapi3.T) (routers.Router, error) {
+			return nil, errors.New("invalid definition")
+		}))
+	})
+}
+
+func TestNewOpenAPIFromURL(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/openapi.yaml" {
+			http.NotFound(w, r)
+			return
+		}
+
+		http.ServeFile(w, r, openapiFixture)
+	}))
+	defer ts.Close()
+
+	oa, err := newOpenAPIFromURL(ts.URL+"/openapi.yaml", nil, zap.NewNop())
+	assert.NoError(t, err)
+
+	u, _ := url.Parse("/oa/books/123")
+	assert.Equal(t, "/oa/authors/456", oa.getRelation(oa.getRoute(u), "/author", "456", nil))
+
+	_, err = newOpenAPIFromURL(ts.URL+"/notexists", nil, zap.NewNop())
+	assert.Error(t, err)
+
+	v := New(WithOpenAPIURL(ts.URL + "/notexists"))
+	assert.Nil(t, v.openAPI.getRoute(u))
+}
+
+func TestReload(t *testing.T) {
+	var available atomic.Bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !available.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+
+		http.ServeFile(w, r, openapiFixture)
+	}))
+	defer ts.Close()
+
+	v := New(WithOpenAPIURL(ts.URL + "/openapi.yaml"))
+	u, _ := url.Parse("/oa/books/123")
+	assert.Nil(t, v.getOpenAPIRoute(u, nil, false))
+
+	available.Store(true)
+	assert.NoError(t, v.Reload())
+	assert.NotNil(t, v.getOpenAPIRoute(u, nil, false))
+
+	// The previous definition is kept if the new one cannot be loaded
+	available.Store(false)
+	assert.Error(t, v.Reload())
+	assert.NotNil(t, v.getOpenAPIRoute(u, nil, false))
+
+	assert.NoError(t, New().Reload())
+}
+
 func TestGetRoute(t *testing.T) {
-	oa := newOpenAPI(openapiFixture, zap.NewNop())
+	oa, err := newOpenAPI(openapiFixture, zap.NewNop())
+	assert.NoError(t, err)
 
 	u, _ := url.Parse("/oa/books/123")
 	assert.NotNil(t, oa.getRoute(u))
@@ -28,23 +231,109 @@ func TestGetRoute(t *testing.T) {
 }
 
 func TestGetRelation(t *testing.T) {
-	oa := newOpenAPI(openapiFixture, zap.NewNop())
+	oa, err := newOpenAPI(openapiFixture, zap.NewNop())
+	assert.NoError(t, err)
 
 	u, _ := url.Parse("/oa/books/123")
-	r := oa.getRelation(oa.getRoute(u), "/author", "456")
+	r := oa.getRelation(oa.getRoute(u), "/author", "456", nil)
 	assert.Equal(t, "/oa/authors/456", r)
 
 	u, _ = url.Parse("/oa/books.json")
-	r = oa.getRelation(oa.getRoute(u), "/member/*", "1936")
+	r = oa.getRelation(oa.getRoute(u), "/member/*", "1936", nil)
 	assert.Equal(t, "/oa/books/1936", r)
 
 	u, _ = url.Parse("/oa/books.json")
-	r = oa.getRelation(oa.getRoute(u), "/notexists", "1891")
+	r = oa.getRelation(oa.getRoute(u), "/notexists", "1891", nil)
 	assert.Equal(t, "", r)
 }
 
+func TestGetRelationDiscriminator(t *testing.T) {
+	oa, err := newOpenAPI("./fixtures/openapi-discriminator.yaml", zap.NewNop())
+	assert.NoError(t, err)
+
+	n := &node{}
+	n.importPointers(preload, httpsfv.List{httpsfv.NewItem("/content/target")}, -1)
+	content := n.children[0]
+	target := content.children[0]
+
+	u, _ := url.Parse("/items/1")
+	route := oa.getRoute(u)
+
+	// Explicit mapping
+	content.value = []byte(`{"type": "article", "target": 1}`)
+	assert.Equal(t, "/authors/1", oa.getRelation(route, "/content/target", "1", target))
+
+	// Implicit mapping, the value is the name of the schema
+	content.value = []byte(`{"type": "Video", "target": 1}`)
+	assert.Equal(t, "/channels/1", oa.getRelation(route, "/content/target", "1", target))
+}
+
+func TestGetRelationServers(t *testing.T) {
+	oa, err := newOpenAPI("./fixtures/openapi-servers.yaml", zap.NewNop())
+	assert.NoError(t, err)
+
+	u, _ := url.Parse("https://api.example.com/v1/books/123")
+	assert.Equal(t, "/v1/authors/456", oa.getRelation(oa.getRoute(u), "/author", "456", nil))
+
+	u, _ = url.Parse("https://eu.example.net/api/v2/books/123")
+	assert.Equal(t, "/api/v2/authors/456", oa.getRelation(oa.getRoute(u), "/author", "456", nil))
+
+	// Relative server URLs match all hosts
+	u, _ = url.Parse("https://api.example.com/v3/books/123")
+	assert.Equal(t, "/v3/authors/456", oa.getRelation(oa.getRoute(u), "/author", "456", nil))
+
+	u, _ = url.Parse("https://api.example.com/v2/books/123")
+	assert.Nil(t, oa.getRoute(u))
+
+	u, _ = url.Parse("https://eu.example.net/v1/books/123")
+	assert.Nil(t, oa.getRoute(u))
+
+	v := New(WithOpenAPIFile("./fixtures/openapi-servers.yaml"))
+
+	req := httptest.NewRequest("GET", "/v1/books/123", nil)
+	req.Host = "api.example.com"
+	rel, useOA, err := v.ResolveRelation(req, "/author", "456")
+	assert.NoError(t, err)
+	assert.True(t, useOA)
+	assert.Equal(t, "/v1/authors/456", rel.String())
+}
+
 func TestGenerateLink(t *testing.T) {
-	oa := newOpenAPI(openapiFixture, zap.NewNop())
-	l := oa.generateLink("notexists", "nestor", "makhno")
+	oa, err := newOpenAPI(openapiFixture, zap.NewNop())
+	assert.NoError(t, err)
+	l := oa.generateLink(nil, "notexists", "nestor", "makhno")
 	assert.Equal(t, "", l)
 }
+
+func TestGenerateLinkFromRef(t *testing.T) {
+	oa, err := newOpenAPI(openapiFixture, zap.NewNop())
+	assert.NoError(t, err)
+
+	for _, tc := range []struct {
+		operationRef, expected, method string
+	}{
+		{"#/paths/~1oa~1authors~1{id}/get", "/oa/authors/42", "GET"},
+		{"#/paths/~1oa~1authors~1{id}~1reviews/post", "/oa/authors/42/reviews", "POST"},
+		{"#/paths/~1notexists/get", "", ""},
+		{"#/paths/~1oa~1authors~1{id}/post", "", ""},
+		{"https://example.com/openapi.yaml#/paths/~1oa~1authors~1{id}/get", "", ""},
+	} {
+		rel, method := oa.generateLinkFromRef(oa.specs[0], tc.operationRef, "id", "42")
+		assert.Equal(t, tc.expected, rel, tc.operationRef)
+		assert.Equal(t, tc.method, method, tc.operationRef)
+	}
+}
+
+func TestGetMaxPushes(t *testing.T) {
+	oa, err := newOpenAPI(openapiFixture, zap.NewNop())
+	assert.NoError(t, err)
+
+	u, _ := url.Parse("/oa/books/123")
+	m, ok := oa.getMaxPushes(oa.getRoute(u))
+	assert.True(t, ok)
+	assert.Equal(t, 0, m)
+
+	u, _ = url.Parse("/oa/books.json")
+	_, ok = oa.getMaxPushes(oa.getRoute(u))
+	assert.False(t, ok)
+}
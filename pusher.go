@@ -5,71 +5,228 @@ package vulcain
 // MIT License
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
+	"runtime/debug"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gofrs/uuid"
 	"go.uber.org/zap"
 )
 
-const internalRequestHeader = "Vulcain-Explicit-Request"
+// defaultInternalRequestHeader is the default name of the header used to tag pushed requests
+const defaultInternalRequestHeader = "Vulcain-Explicit-Request"
 
 type ctxKey struct{}
 
+// loggerCtxKey is the context key of the request logger
+type loggerCtxKey struct{}
+
 // waitPusher pushes relations and allow to wait for all PUSH_PROMISE to be sent
 // From the RFC:
 //   The server SHOULD send PUSH_PROMISE (Section 6.6) frames prior to sending any frames that reference the promised responses.
 //   This avoids a race where clients issue requests prior to receiving any PUSH_PROMISE frames.
 //
+// The same waitPusher is shared by the explicit request and the pushed ones, which are sent on the same connection:
+// concurrent pushes of the same relation are coalesced, only the first one sends a PUSH_PROMISE.
+// net/http doesn't expose the connection, relations pushed for other explicit requests sent on the same connection cannot be deduplicated.
+//
 // Use newWaitPusher() to create a wait pusher
 type waitPusher struct {
 	id         string
+	requestID  string
 	nbPushes   int
-	pushedURLs map[string]struct{}
+	pushedURLs map[string]*promise
 	maxPushes  int
+	timeout    time.Duration
+	// ignoredDones is the number of pushes that timed out and already released the WaitGroup, the Done calls of their pushed requests are ignored
+	ignoredDones int
 	sync.WaitGroup
 	sync.RWMutex
 	internalPusher http.Pusher
 }
 
+// promise is the result of the push of a relation, done is closed when the result is known
+type promise struct {
+	done chan struct{}
+	err  error
+}
+
 // errRelationAlreadyPushed occurs when the relation has already been pushed
 var errRelationAlreadyPushed = errors.New("relation already pushed")
 
-func (p *waitPusher) Push(url string, opts *http.PushOptions) error {
-	if p.maxPushes != -1 && p.nbPushes >= p.maxPushes {
-		return fmt.Errorf("Maximum allowed pushes (%d) reached", p.maxPushes)
-	}
+// errMaxPushesReached occurs when the maximum number of pushes allowed for the request has been reached
+var errMaxPushesReached = errors.New("maximum allowed pushes reached")
+
+// errPushPanicked occurs when the underlying pusher panicked while pushing the same relation
+var errPushPanicked = errors.New("push panicked")
 
+// errPushTimeout occurs when the underlying pusher didn't return before the timeout
+var errPushTimeout = errors.New("push timeout")
+
+// Push pushes the relation, maxPushes overrides the maximum number of pushes set for this waitPusher (-1 for unlimited)
+// If the same relation is being pushed concurrently, Push waits for the result of this push:
+// errRelationAlreadyPushed is returned if it succeeded, the error of the push otherwise.
+func (p *waitPusher) Push(url string, opts *http.PushOptions, maxPushes int) error {
 	cacheKey := fmt.Sprintf(":p:%v:f:%v:u:%s", opts.Header["Preload"], opts.Header["Fields"], url)
 
 	p.Lock()
-	if _, ok := p.pushedURLs[cacheKey]; ok {
+	// Check if the relation has already been pushed first, to not preload it if the limit is reached
+	if pr, ok := p.pushedURLs[cacheKey]; ok {
 		p.Unlock()
+
+		<-pr.done
+		if pr.err != nil {
+			return pr.err
+		}
+
 		return errRelationAlreadyPushed
 	}
 
+	if maxPushes != -1 && p.nbPushes >= maxPushes {
+		p.Unlock()
+		return fmt.Errorf("%w (%d)", errMaxPushesReached, maxPushes)
+	}
+
+	pr := &promise{done: make(chan struct{})}
 	p.nbPushes++
-	p.pushedURLs[cacheKey] = struct{}{}
+	p.pushedURLs[cacheKey] = pr
+	p.Add(1)
 	p.Unlock()
 
-	p.Add(1)
-	if err := p.internalPusher.Push(url, opts); err != nil {
-		p.Done()
+	pushed := false
+	defer func() {
+		if !pushed {
+			// The underlying pusher panicked, don't block the concurrent pushes of this relation and Finish
+			pr.err = errPushPanicked
+			p.release(cacheKey, pr)
+			close(pr.done)
+		}
+	}()
+
+	err := p.push(cacheKey, pr, url, opts)
+	pushed = true
+	pr.err = err
+	close(pr.done)
+
+	return err
+}
+
+// push sends the PUSH_PROMISE, the relation can be pushed again if it fails, even after the timeout
+func (p *waitPusher) push(cacheKey string, pr *promise, url string, opts *http.PushOptions) error {
+	if p.timeout <= 0 {
+		if err := p.internalPusher.Push(url, opts); err != nil {
+			p.release(cacheKey, pr)
+			return err
+		}
+
+		return nil
+	}
+
+	// settled and timedOut are protected by the lock of p
+	var settled, timedOut bool
+	errc := make(chan error, 1)
+
+	// The goroutine owns the promise: it forgets it if the push eventually fails, even after the timeout
+	settle := func(err error) {
+		p.Lock()
+		settled = true
+		release := err != nil
+		if release && timedOut && p.ignoredDones > 0 {
+			// The WaitGroup has already been released by the timeout, and no pushed request will call Done
+			p.ignoredDones--
+			release = false
+		}
+		p.Unlock()
+
+		if err != nil {
+			p.forget(cacheKey, pr)
+		}
+		if release {
+			p.Done()
+		}
+		errc <- err
+	}
+
+	go func() {
+		defer func() {
+			// The panic is returned as an error, pushJob.run propagates it to the goroutine of Apply
+			if r := recover(); r != nil {
+				settle(&PanicError{Value: r, Stack: debug.Stack()})
+			}
+		}()
+
+		settle(p.internalPusher.Push(url, opts))
+	}()
+
+	timer := time.NewTimer(p.timeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-errc:
 		return err
+	case <-timer.C:
+		p.Lock()
+		if settled {
+			p.Unlock()
+
+			return <-errc
+		}
+		// Don't make Finish wait for a push that may never return, the Done call of the pushed request is ignored if it eventually succeeds
+		timedOut = true
+		p.ignoredDones++
+		p.Unlock()
+
+		// The slot stays reserved until the result is known, to not send a duplicate PUSH_PROMISE or exceed the maximum number of pushes
+		p.Done()
+
+		return errPushTimeout
 	}
+}
 
-	return nil
+// done is called when a pushed request is finished, the WaitGroup isn't released twice for pushes that timed out
+func (p *waitPusher) done() {
+	p.Lock()
+	if p.ignoredDones > 0 {
+		p.ignoredDones--
+		p.Unlock()
+
+		return
+	}
+	p.Unlock()
+
+	p.Done()
+}
+
+// release forgets a relation that failed to be pushed
+func (p *waitPusher) release(cacheKey string, pr *promise) {
+	p.forget(cacheKey, pr)
+	p.Done()
+}
+
+// forget removes the promise from the pushed relations, unless it has already been replaced by a new push of the same relation
+func (p *waitPusher) forget(cacheKey string, pr *promise) {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.pushedURLs[cacheKey] == pr {
+		delete(p.pushedURLs, cacheKey)
+		p.nbPushes--
+	}
 }
 
 // newWaitPusher creates a new waitPusher
-func newWaitPusher(p http.Pusher, id string, maxPushes int) *waitPusher {
+func newWaitPusher(p http.Pusher, id string, maxPushes int, timeout time.Duration) *waitPusher {
 	return &waitPusher{
 		internalPusher: p,
 		id:             id,
 		maxPushes:      maxPushes,
-		pushedURLs:     make(map[string]struct{}),
+		timeout:        timeout,
+		pushedURLs:     make(map[string]*promise),
 	}
 }
 
@@ -77,9 +234,41 @@ func newWaitPusher(p http.Pusher, id string, maxPushes int) *waitPusher {
 // The same pusher is shared for the explicit response and all pushed responses
 type pushers struct {
 	sync.RWMutex
-	maxPushes int
-	pusherMap map[string]*waitPusher
-	logger    *zap.Logger
+	maxPushes             int
+	internalRequestHeader string
+	pushTimeout           time.Duration
+	breaker               *circuitBreaker
+	pusherMap             map[string]*waitPusher
+	logger                *zap.Logger
+	promisesSent          atomic.Uint64
+	alreadyPushed         atomic.Uint64
+	failures              atomic.Uint64
+}
+
+// PusherStats is a snapshot of the process-wide push statistics
+type PusherStats struct {
+	// ActivePushers is the number of explicit requests currently able to push relations
+	ActivePushers int
+	// PromisesSent is the total number of relations pushed
+	PromisesSent uint64
+	// AlreadyPushed is the total number of relations not pushed again because they were already pushed for the same explicit request
+	AlreadyPushed uint64
+	// Failures is the total number of pushes that failed, including the ones exceeding the limits and the timed out ones
+	Failures uint64
+}
+
+// stats returns a snapshot of the statistics
+func (p *pushers) stats() PusherStats {
+	p.RLock()
+	active := len(p.pusherMap)
+	p.RUnlock()
+
+	return PusherStats{
+		ActivePushers: active,
+		PromisesSent:  p.promisesSent.Load(),
+		AlreadyPushed: p.alreadyPushed.Load(),
+		Failures:      p.failures.Load(),
+	}
 }
 
 // add adds a new waitPusher to the list
@@ -96,6 +285,13 @@ func (p *pushers) get(id string) *waitPusher {
 	return p.pusherMap[id]
 }
 
+// isPushRequest tells if the request is a pushed request of an explicit request still being handled
+func (p *pushers) isPushRequest(req *http.Request) bool {
+	id := req.Header.Get(p.internalRequestHeader)
+
+	return id != "" && p.get(id) != nil
+}
+
 // remove removes the waitPusher from the list
 func (p *pushers) remove(id string) {
 	p.Lock()
@@ -103,24 +299,56 @@ func (p *pushers) remove(id string) {
 	delete(p.pusherMap, id)
 }
 
+// wait waits for all PUSH_PROMISEs of the active waitPushers to be sent, or for the context to be done
+func (p *pushers) wait(ctx context.Context) error {
+	p.RLock()
+	waitPushers := make([]*waitPusher, 0, len(p.pusherMap))
+	for _, w := range p.pusherMap {
+		waitPushers = append(waitPushers, w)
+	}
+	p.RUnlock()
+
+	done := make(chan struct{})
+	go func() {
+		for _, w := range waitPushers {
+			w.Wait()
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // End of the code adapted from the Hades project
 
 // Copyright (c) 2020 Kévin Dunglas
 // APGLv3 License
 
 // getPusherForRequest retrieves the pusher associated with the explicit request
-func (p *pushers) getPusherForRequest(rw http.ResponseWriter, req *http.Request) (w *waitPusher) {
+// requestID is the ID used to correlate the logs of the explicit request, it is shared with the pushed requests
+func (p *pushers) getPusherForRequest(rw http.ResponseWriter, req *http.Request, requestID string) (w *waitPusher) {
 	internalPusher, ok := rw.(http.Pusher)
 	if !ok {
 		// Not an HTTP/2 connection
 		return nil
 	}
 
+	if req.ProtoMajor >= 3 {
+		// Server push doesn't exist in HTTP/3 (and WebTransport), preload links are always used
+		return nil
+	}
+
 	// Need https://github.com/golang/go/issues/20566 to get rid of this hack
-	explicitRequestID := req.Header.Get(internalRequestHeader)
+	explicitRequestID := req.Header.Get(p.internalRequestHeader)
 	if explicitRequestID == "" {
 		// This is the explicit request, let's create a wait pusher
-		w = newWaitPusher(internalPusher, uuid.Must(uuid.NewV4()).String(), p.maxPushes)
+		w = newWaitPusher(internalPusher, uuid.Must(uuid.NewV4()).String(), p.maxPushes, p.pushTimeout)
+		w.requestID = requestID
 		p.add(w)
 
 		return w
@@ -132,27 +360,90 @@ func (p *pushers) getPusherForRequest(rw http.ResponseWriter, req *http.Request)
 
 	// Should not happen, is an attacker forging an evil request?
 	p.logger.Debug("pusher not found", zap.String("url", req.RequestURI), zap.String("explicitRequestID", explicitRequestID))
-	req.Header.Del(internalRequestHeader)
+	req.Header.Del(p.internalRequestHeader)
 
 	return nil
 }
 
 // finish waits for all PUSH_PROMISEs to be sent before returning for the explicit request.
-func (p *pushers) finish(req *http.Request, wait bool) {
+// It returns the time spent waiting.
+func (p *pushers) finish(req *http.Request, wait bool) (waited time.Duration) {
 	pusher := req.Context().Value(ctxKey{}).(*waitPusher)
 	if pusher == nil {
-		return
+		return 0
 	}
 
-	if req.Header.Get(internalRequestHeader) != "" {
-		pusher.Done()
-		return
+	if req.Header.Get(p.internalRequestHeader) != "" {
+		pusher.done()
+		return 0
 	}
 
 	// Wait for subrequests to finish, except if it's an error to release resources as soon as possible
 	if wait {
+		start := time.Now()
 		pusher.Wait()
+		waited = time.Since(start)
 	}
 
 	p.remove(pusher.id)
+
+	return waited
+}
+
+// allowPush tells if pushes can be attempted according to the circuit breaker, if any
+func (p *pushers) allowPush() bool {
+	return p.breaker == nil || p.breaker.allow()
+}
+
+// circuitBreaker stops pushing for a cooldown period after too many consecutive push failures
+// Use newCircuitBreaker() to create a circuit breaker
+type circuitBreaker struct {
+	sync.Mutex
+	maxFailures int
+	cooldown    time.Duration
+	failures    int
+	lastFailure time.Time
+	openUntil   time.Time
+	now         func() time.Time
+}
+
+// newCircuitBreaker creates a new circuitBreaker
+func newCircuitBreaker(maxFailures int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{maxFailures: maxFailures, cooldown: cooldown, now: time.Now}
+}
+
+// allow tells if pushes can be attempted
+func (b *circuitBreaker) allow() bool {
+	b.Lock()
+	defer b.Unlock()
+
+	return !b.now().Before(b.openUntil)
+}
+
+// success resets the count of consecutive failures
+func (b *circuitBreaker) success() {
+	b.Lock()
+	defer b.Unlock()
+
+	b.failures = 0
+}
+
+// failure records a failed push, and opens the circuit if the limit of consecutive failures is reached
+// Failures older than the cooldown period aren't taken into account
+func (b *circuitBreaker) failure() {
+	b.Lock()
+	defer b.Unlock()
+
+	now := b.now()
+	if now.Sub(b.lastFailure) > b.cooldown {
+		b.failures = 0
+	}
+
+	b.failures++
+	b.lastFailure = now
+
+	if b.failures >= b.maxFailures {
+		b.openUntil = now.Add(b.cooldown)
+		b.failures = 0
+	}
 }
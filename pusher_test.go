@@ -0,0 +1,174 @@
+package vulcain
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// countingPusher is an http.Pusher counting the PUSH_PROMISEs, it fails if err is set
+type countingPusher struct {
+	count atomic.Int32
+	err   error
+}
+
+func (p *countingPusher) Push(target string, opts *http.PushOptions) error {
+	p.count.Add(1)
+	// Give time to concurrent pushes to be coalesced
+	time.Sleep(time.Millisecond)
+
+	return p.err
+}
+
+// pushConcurrently pushes the same relation from several goroutines and returns the errors
+func pushConcurrently(w *waitPusher, n int) []error {
+	errs := make([]error, n)
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = w.Push("/authors/1", &http.PushOptions{Header: http.Header{}}, -1)
+		}(i)
+	}
+	wg.Wait()
+
+	return errs
+}
+
+func TestWaitPusherCoalescing(t *testing.T) {
+	p := &countingPusher{}
+	w := newWaitPusher(p, "test", -1, 0)
+
+	var pushed, alreadyPushed int
+	for _, err := range pushConcurrently(w, 100) {
+		switch {
+		case err == nil:
+			pushed++
+		case errors.Is(err, errRelationAlreadyPushed):
+			alreadyPushed++
+		default:
+			t.Errorf("unexpected error: %s", err)
+		}
+	}
+
+	assert.Equal(t, int32(1), p.count.Load())
+	assert.Equal(t, 1, pushed)
+	assert.Equal(t, 99, alreadyPushed)
+	assert.Equal(t, 1, w.nbPushes)
+}
+
+func TestWaitPusherCoalescingFailure(t *testing.T) {
+	p := &countingPusher{err: http.ErrNotSupported}
+	w := newWaitPusher(p, "test", -1, 0)
+
+	// All concurrent pushes fail, none is reported as already pushed
+	for _, err := range pushConcurrently(w, 100) {
+		assert.ErrorIs(t, err, http.ErrNotSupported)
+	}
+	assert.Equal(t, 0, w.nbPushes)
+
+	// A failed relation can be pushed again
+	count := p.count.Load()
+	p.err = nil
+	assert.NoError(t, w.Push("/authors/1", &http.PushOptions{Header: http.Header{}}, -1))
+	assert.Equal(t, count+1, p.count.Load())
+}
+
+func TestWaitPusherAlreadyPushedBeforeLimit(t *testing.T) {
+	w := newWaitPusher(&countingPusher{}, "test", -1, 0)
+
+	opts := &http.PushOptions{Header: http.Header{}}
+	assert.NoError(t, w.Push("/authors/1", opts, 1))
+	assert.ErrorIs(t, w.Push("/authors/1", opts, 1), errRelationAlreadyPushed)
+	assert.ErrorIs(t, w.Push("/authors/2", opts, 1), errMaxPushesReached)
+}
+
+// blockingPusher is an http.Pusher blocking until release is closed, it fails if err is set
+type blockingPusher struct {
+	release chan struct{}
+	err     error
+}
+
+func (p *blockingPusher) Push(target string, opts *http.PushOptions) error {
+	<-p.release
+
+	return p.err
+}
+
+func TestWaitPusherTimeout(t *testing.T) {
+	p := &blockingPusher{release: make(chan struct{}), err: http.ErrNotSupported}
+	w := newWaitPusher(p, "test", 1, 10*time.Millisecond)
+
+	opts := &http.PushOptions{Header: http.Header{}}
+	assert.ErrorIs(t, w.Push("/authors/1", opts, -1), errPushTimeout)
+
+	// The slot is kept while the push is stalled: the relation isn't pushed again and the limit is enforced
+	w.RLock()
+	assert.Len(t, w.pushedURLs, 1)
+	assert.Equal(t, 1, w.nbPushes)
+	w.RUnlock()
+	assert.ErrorIs(t, w.Push("/authors/1", opts, 1), errPushTimeout)
+	assert.ErrorIs(t, w.Push("/authors/2", opts, 1), errMaxPushesReached)
+
+	// The stalled push eventually fails, the relation can be pushed again
+	close(p.release)
+	assert.Eventually(t, func() bool {
+		w.RLock()
+		defer w.RUnlock()
+
+		return len(w.pushedURLs) == 0 && w.nbPushes == 0
+	}, time.Second, time.Millisecond)
+	w.Wait()
+}
+
+// waitReturns tells if w.Wait() returns before the timeout
+func waitReturns(w *waitPusher) bool {
+	done := make(chan struct{})
+	go func() {
+		w.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(time.Second):
+		return false
+	}
+}
+
+func TestWaitPusherTimeoutReleasesWaitGroup(t *testing.T) {
+	opts := &http.PushOptions{Header: http.Header{}}
+
+	// The underlying pusher never returns
+	p := &blockingPusher{release: make(chan struct{})}
+	defer close(p.release)
+
+	w := newWaitPusher(p, "test", -1, 10*time.Millisecond)
+	assert.ErrorIs(t, w.Push("/authors/1", opts, -1), errPushTimeout)
+	assert.True(t, waitReturns(w))
+
+	// The stalled push eventually succeeds, the Done call of the pushed request is ignored
+	p = &blockingPusher{release: make(chan struct{})}
+	w = newWaitPusher(p, "test", -1, 10*time.Millisecond)
+	assert.ErrorIs(t, w.Push("/authors/1", opts, -1), errPushTimeout)
+	close(p.release)
+	assert.NotPanics(t, w.done)
+	assert.True(t, waitReturns(w))
+
+	// The stalled push eventually fails after the Done call of another pushed request has been ignored
+	p = &blockingPusher{release: make(chan struct{}), err: http.ErrNotSupported}
+	w = newWaitPusher(p, "test", -1, 10*time.Millisecond)
+	w.Add(1) // Another relation pushed successfully
+	assert.ErrorIs(t, w.Push("/authors/1", opts, -1), errPushTimeout)
+	w.done()
+	close(p.release)
+	assert.True(t, waitReturns(w))
+}
@@ -3,12 +3,17 @@ package vulcain
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"os"
 	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/handlers"
 	"go.uber.org/zap"
@@ -71,25 +76,74 @@ func (s *server) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	defer func() { s.vulcain.Finish(r, wait) }()
 
 	rp := httputil.NewSingleHostReverseProxy(s.options.Upstream)
+	rp.Transport = s.options.Transport
+	if s.options.Director != nil {
+		director := rp.Director
+		rp.Director = func(req *http.Request) {
+			director(req)
+			s.options.Director(req)
+		}
+	}
 	rp.ModifyResponse = func(resp *http.Response) error {
 		if !s.vulcain.IsValidRequest(r) || !s.vulcain.IsValidResponse(r, resp.StatusCode, resp.Header) {
 			return nil
 		}
 
-		newBody, err := s.vulcain.Apply(r, rw, resp.Body, resp.Header)
+		// Keep a copy of the body read by Apply to be able to send it untransformed
+		var buf bytes.Buffer
+		newBody, err := s.vulcain.Apply(r, rw, io.TeeReader(resp.Body, &buf), resp.Header)
+		if errors.Is(err, ErrBodyTooLarge) {
+			resp.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(&buf, resp.Body), resp.Body}
+
+			return nil
+		}
 		if newBody == nil {
-			return err
+			if err != nil {
+				return applyFailure{err}
+			}
+
+			return nil
+		}
+		if err != nil {
+			s.vulcain.logger.Debug("some relations cannot be handled", zap.Error(err))
 		}
 
 		newBodyBuffer := bytes.NewBuffer(newBody)
 		resp.Body = io.NopCloser(newBodyBuffer)
 
+		// The trailers aren't in resp.Header, they are copied by the reverse proxy after the body: don't prevent them to be sent
+		if len(resp.Trailer) > 0 {
+			resp.Header.Del("Content-Length")
+			resp.ContentLength = -1
+		} else {
+			// The body is entirely buffered, it isn't chunked anymore
+			resp.ContentLength = int64(len(newBody))
+			resp.TransferEncoding = nil
+		}
+
 		wait = true
 
 		return nil
 	}
 	rp.ErrorHandler = func(rw http.ResponseWriter, req *http.Request, err error) {
 		wait = false
+
+		var af applyFailure
+		if errors.As(err, &af) && s.options.ApplyErrorHandler != nil {
+			s.options.ApplyErrorHandler(rw, req, af.err)
+
+			return
+		}
+
+		if s.options.ErrorHandler != nil {
+			s.options.ErrorHandler(rw, req, err)
+
+			return
+		}
+
 		// Adapted from the default ErrorHandler
 		s.vulcain.logger.Error("http: proxy error", zap.Error(err))
 		rw.WriteHeader(http.StatusBadGateway)
@@ -107,6 +161,19 @@ func (s *server) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	rp.ServeHTTP(rw, req)
 }
 
+// applyFailure wraps the errors returned by Apply, to route them to ServerOptions.ApplyErrorHandler
+type applyFailure struct {
+	err error
+}
+
+func (a applyFailure) Error() string {
+	return a.err.Error()
+}
+
+func (a applyFailure) Unwrap() error {
+	return a.err
+}
+
 // Serve starts the HTTP server
 //
 // Deprecated: use the Caddy server module or the standalone library instead
@@ -121,10 +188,10 @@ func (s *server) Serve() {
 	idleConnsClosed := make(chan struct{})
 	go func() {
 		sigint := make(chan os.Signal, 1)
-		signal.Notify(sigint, os.Interrupt)
+		signal.Notify(sigint, os.Interrupt, syscall.SIGTERM)
 		<-sigint
 
-		if err := s.server.Shutdown(context.Background()); err != nil {
+		if err := s.Shutdown(context.Background()); err != nil {
 			s.vulcain.logger.Error(err.Error())
 		}
 		s.vulcain.logger.Info("my baby shot me down")
@@ -132,11 +199,16 @@ func (s *server) Serve() {
 	}()
 
 	acme := len(s.options.AcmeHosts) > 0
-	var err error
+	useTLS := acme || s.options.CertFile != "" || s.options.KeyFile != ""
 
-	if !acme && s.options.CertFile == "" && s.options.KeyFile == "" {
+	ln, err := s.listen(useTLS)
+	if err != nil {
+		s.vulcain.logger.Fatal(err.Error())
+	}
+
+	if !useTLS {
 		s.vulcain.logger.Info("vulcain started", zap.String("protocol", "http"), zap.String("addr", s.options.Addr))
-		err = s.server.ListenAndServe()
+		err = s.server.Serve(ln)
 	} else {
 		// TLS
 		if acme {
@@ -158,16 +230,64 @@ func (s *server) Serve() {
 		}
 
 		s.vulcain.logger.Info("vulcain started", zap.String("protocol", "https"), zap.String("addr", s.options.Addr))
-		err = s.server.ListenAndServeTLS(s.options.CertFile, s.options.KeyFile)
+		err = s.server.ServeTLS(ln, s.options.CertFile, s.options.KeyFile)
 	}
 
 	if err != http.ErrServerClosed {
 		s.vulcain.logger.Fatal(err.Error())
 	}
 
+	// The socket file is usually removed when the listener is closed, make sure it doesn't remain
+	if path, ok := strings.CutPrefix(s.options.Addr, unixAddrPrefix); ok {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			s.vulcain.logger.Error("cannot remove the socket file", zap.String("path", path), zap.Error(err))
+		}
+	}
+
 	<-idleConnsClosed
 }
 
+// unixAddrPrefix is the prefix of the addresses of Unix domain sockets (e.g. unix:/run/vulcain.sock)
+const unixAddrPrefix = "unix:"
+
+// listen creates the listener: a Unix domain socket if the address starts with "unix:", a TCP socket otherwise
+// A stale socket file left by a previous run is removed
+func (s *server) listen(useTLS bool) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(s.options.Addr, unixAddrPrefix); ok {
+		if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			if err := os.Remove(path); err != nil {
+				return nil, err
+			}
+		}
+
+		return net.Listen("unix", path)
+	}
+
+	addr := s.options.Addr
+	if addr == "" {
+		addr = ":http"
+		if useTLS {
+			addr = ":https"
+		}
+	}
+
+	return net.Listen("tcp", addr)
+}
+
+// Shutdown gracefully shuts down the server: it drains in-flight requests and waits for outstanding PUSH_PROMISEs to be sent.
+// It returns when done or when the context expires.
+//
+// Deprecated: use the Caddy server module or the standalone library instead
+func (s *server) Shutdown(ctx context.Context) error {
+	if s.server != nil {
+		if err := s.server.Shutdown(ctx); err != nil {
+			return err
+		}
+	}
+
+	return s.vulcain.pushers.wait(ctx)
+}
+
 // chainHandlers configures and chains handlers
 func (s *server) chainHandlers() http.Handler {
 	var compressHandler http.Handler
@@ -177,7 +297,17 @@ func (s *server) chainHandlers() http.Handler {
 		compressHandler = s
 	}
 
-	loggingHandler := handlers.CombinedLoggingHandler(os.Stderr, compressHandler)
+	var limitHandler http.Handler
+	if s.options.MaxConcurrentRequests > 0 {
+		limitHandler = s.limitConcurrentRequests(compressHandler)
+	} else {
+		limitHandler = compressHandler
+	}
+
+	// Probes aren't limited
+	healthHandler := s.healthHandler(limitHandler)
+
+	loggingHandler := handlers.CombinedLoggingHandler(os.Stderr, healthHandler)
 	recoveryHandler := handlers.RecoveryHandler(
 		handlers.RecoveryLogger(zapRecoveryHandlerLogger{s.vulcain.logger}),
 		handlers.PrintRecoveryStack(s.options.Debug),
@@ -186,6 +316,96 @@ func (s *server) chainHandlers() http.Handler {
 	return recoveryHandler
 }
 
+// healthCheckTimeout is the maximum duration allowed to reach the upstream when checking the readiness
+const healthCheckTimeout = 5 * time.Second
+
+// healthHandler serves the liveness and readiness endpoints, other requests are passed to h
+func (s *server) healthHandler(h http.Handler) http.Handler {
+	if s.options.HealthPath == "" && s.options.ReadyPath == "" {
+		return h
+	}
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch p := req.URL.Path; {
+		case s.options.HealthPath != "" && p == s.options.HealthPath:
+			_, _ = io.WriteString(rw, "ok\n")
+		case s.options.ReadyPath != "" && p == s.options.ReadyPath:
+			if err := s.ready(req.Context()); err != nil {
+				s.vulcain.logger.Debug("not ready", zap.Error(err))
+				http.Error(rw, err.Error(), http.StatusServiceUnavailable)
+
+				return
+			}
+
+			_, _ = io.WriteString(rw, "ok\n")
+		default:
+			h.ServeHTTP(rw, req)
+		}
+	})
+}
+
+// ready checks that the OpenAPI definition, if any, is loaded and that the upstream is reachable
+func (s *server) ready(ctx context.Context) error {
+	if s.options.OpenAPIFile != "" {
+		if s.vulcain.openAPI == nil {
+			return errors.New("the OpenAPI definition cannot be loaded")
+		}
+
+		s.vulcain.openAPI.RLock()
+		loaded := len(s.vulcain.openAPI.specs) > 0
+		s.vulcain.openAPI.RUnlock()
+		if !loaded {
+			return errors.New("the OpenAPI definition isn't loaded")
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, s.options.Upstream.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	transport := s.options.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	// Any response, even an error one, means that the upstream is reachable
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return fmt.Errorf("the upstream is unreachable: %w", err)
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// limitConcurrentRequests replies with a 503 status code when MaxConcurrentRequests requests are already being handled
+// Apply buffers the full responses, limiting the number of concurrent requests protects the memory during spikes
+// Pushed requests aren't limited: the explicit request they belong to already holds a slot and waits for them
+func (s *server) limitConcurrentRequests(h http.Handler) http.Handler {
+	sem := make(chan struct{}, s.options.MaxConcurrentRequests)
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if s.vulcain.pushers.isPushRequest(req) {
+			h.ServeHTTP(rw, req)
+			return
+		}
+
+		select {
+		case sem <- struct{}{}:
+			defer func() { <-sem }()
+			h.ServeHTTP(rw, req)
+		default:
+			s.vulcain.logger.Debug("too many concurrent requests", zap.Int("max", s.options.MaxConcurrentRequests))
+			rw.Header().Set("Retry-After", "1")
+			http.Error(rw, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		}
+	})
+}
+
 type zapRecoveryHandlerLogger struct {
 	logger *zap.Logger
 }
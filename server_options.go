@@ -2,6 +2,7 @@ package vulcain
 
 import (
 	"fmt"
+	"net/http"
 	"net/url"
 	"os"
 	"strconv"
@@ -26,6 +27,21 @@ type ServerOptions struct {
 	WriteTimeout time.Duration
 	Compress     bool
 	OpenAPIFile  string
+	// MaxConcurrentRequests is the maximum number of requests handled concurrently, 503 responses are sent when it's reached (0 or less for unlimited)
+	MaxConcurrentRequests int
+	// HealthPath is the path of the liveness endpoint (e.g. /healthz), disabled if empty
+	HealthPath string
+	// ReadyPath is the path of the readiness endpoint (e.g. /readyz), disabled if empty
+	// The server is ready when the OpenAPI definition (if any) is loaded and the upstream is reachable
+	ReadyPath string
+	// Transport is used by the reverse proxy to reach the upstream (e.g. to tune keep-alives, connection pooling or TLS), default to http.DefaultTransport
+	Transport http.RoundTripper
+	// Director is called after the default director of the reverse proxy to modify the request sent to the upstream
+	Director func(*http.Request)
+	// ErrorHandler is called when the upstream cannot be reached, default to logging the error and replying with a 502 status code
+	ErrorHandler func(http.ResponseWriter, *http.Request, error)
+	// ApplyErrorHandler is called when the directives cannot be applied to the response (e.g. to send a JSON problem document), default to ErrorHandler
+	ApplyErrorHandler func(http.ResponseWriter, *http.Request, error)
 }
 
 // NewOptionsFromEnv creates a new option instance from environment
@@ -61,6 +77,14 @@ func NewOptionsFromEnv() (*ServerOptions, error) {
 		}
 	}
 
+	var maxConcurrentRequests int
+	if maxConcurrentRequestsStr := os.Getenv("MAX_CONCURRENT_REQUESTS"); maxConcurrentRequestsStr != "" {
+		maxConcurrentRequests, err = strconv.Atoi(maxConcurrentRequestsStr)
+		if err != nil {
+			return nil, fmt.Errorf(`MAX_CONCURRENT_REQUESTS: invalid value "%s" (%s)`, maxConcurrentRequestsStr, err)
+		}
+	}
+
 	earlyHints := os.Getenv("EARLY_HINTS")
 
 	o := &ServerOptions{
@@ -77,6 +101,13 @@ func NewOptionsFromEnv() (*ServerOptions, error) {
 		writeTimeout,
 		os.Getenv("COMPRESS") != "0",
 		os.Getenv("OPENAPI_FILE"),
+		maxConcurrentRequests,
+		os.Getenv("HEALTH_PATH"),
+		os.Getenv("READY_PATH"),
+		nil,
+		nil,
+		nil,
+		nil,
 	}
 
 	missingEnv := make([]string, 0, 2)
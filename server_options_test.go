@@ -11,19 +11,22 @@ import (
 
 func TestNewOptionsFromEnv(t *testing.T) {
 	testEnv := map[string]string{
-		"UPSTREAM":      "http://example.com",
-		"EARLY_HINTS":   "1",
-		"MAX_PUSHES":    "-1",
-		"ACME_CERT_DIR": "/tmp",
-		"ACME_HOSTS":    "example.com,example.org",
-		"ADDR":          "127.0.0.1:8080",
-		"CERT_FILE":     "foo",
-		"COMPRESS":      "0",
-		"DEBUG":         "1",
-		"KEY_FILE":      "bar",
-		"READ_TIMEOUT":  "1m",
-		"WRITE_TIMEOUT": "40s",
-		"OPENAPI_FILE":  "openapi.yaml",
+		"UPSTREAM":                "http://example.com",
+		"EARLY_HINTS":             "1",
+		"MAX_PUSHES":              "-1",
+		"ACME_CERT_DIR":           "/tmp",
+		"ACME_HOSTS":              "example.com,example.org",
+		"ADDR":                    "127.0.0.1:8080",
+		"CERT_FILE":               "foo",
+		"COMPRESS":                "0",
+		"DEBUG":                   "1",
+		"KEY_FILE":                "bar",
+		"READ_TIMEOUT":            "1m",
+		"WRITE_TIMEOUT":           "40s",
+		"OPENAPI_FILE":            "openapi.yaml",
+		"MAX_CONCURRENT_REQUESTS": "100",
+		"HEALTH_PATH":             "/healthz",
+		"READY_PATH":              "/readyz",
 	}
 	for k, v := range testEnv {
 		os.Setenv(k, v)
@@ -46,6 +49,13 @@ func TestNewOptionsFromEnv(t *testing.T) {
 		40 * time.Second,
 		false,
 		"openapi.yaml",
+		100,
+		"/healthz",
+		"/readyz",
+		nil,
+		nil,
+		nil,
+		nil,
 	}, opts)
 	assert.Nil(t, err)
 }
@@ -91,3 +101,10 @@ func TestInvalidMaxPushes(t *testing.T) {
 	_, err := NewOptionsFromEnv()
 	assert.EqualError(t, err, `MAX_PUSHES: invalid value "invalid" (strconv.Atoi: parsing "invalid": invalid syntax)`)
 }
+
+func TestInvalidMaxConcurrentRequests(t *testing.T) {
+	os.Setenv("MAX_CONCURRENT_REQUESTS", "invalid")
+	defer os.Unsetenv("MAX_CONCURRENT_REQUESTS")
+	_, err := NewOptionsFromEnv()
+	assert.EqualError(t, err, `MAX_CONCURRENT_REQUESTS: invalid value "invalid" (strconv.Atoi: parsing "invalid": invalid syntax)`)
+}
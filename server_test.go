@@ -3,7 +3,9 @@ package vulcain
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/http/httptrace"
@@ -11,6 +13,7 @@ import (
 	"net/url"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -318,3 +321,279 @@ func TestUpstreamError(t *testing.T) {
 
 	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
 }
+
+func TestShutdown(t *testing.T) {
+	upstream, s, client := createTestingUtils("", -1)
+	defer upstream.Close()
+
+	// loop until the server is ready
+	var resp *http.Response
+	for resp == nil {
+		resp, _ = client.Get(gatewayURL + "/books.jsonld")
+	}
+	resp.Body.Close()
+	client.CloseIdleConnections()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	assert.NoError(t, s.Shutdown(ctx))
+
+	_, err := client.Get(gatewayURL + "/books.jsonld")
+	assert.Error(t, err)
+}
+
+func TestUnixSocket(t *testing.T) {
+	upstream := httptest.NewServer(&api.JSONLDHandler{})
+	defer upstream.Close()
+
+	socket := filepath.Join(t.TempDir(), "vulcain.sock")
+	upstreamURL, _ := url.Parse(upstream.URL)
+	s := NewServer(&ServerOptions{Addr: "unix:" + socket, Upstream: upstreamURL})
+	go s.Serve()
+
+	client := http.Client{Timeout: 100 * time.Millisecond, Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+
+	// loop until the server is ready
+	var resp *http.Response
+	for resp == nil {
+		resp, _ = client.Get(`http://vulcain/books.jsonld?fields="/@id"`)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	client.CloseIdleConnections()
+	assert.Equal(t, `{"@id":"/books.jsonld"}`, string(b))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, s.Shutdown(ctx))
+
+	// The socket file is removed
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(socket)
+		return errors.Is(err, os.ErrNotExist)
+	}, time.Second, 10*time.Millisecond)
+}
+
+type countingTransport struct {
+	count int
+}
+
+func (c *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c.count++
+
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestReverseProxyOptions(t *testing.T) {
+	upstream := httptest.NewServer(&api.JSONLDHandler{})
+	defer upstream.Close()
+
+	upstreamURL, _ := url.Parse(upstream.URL)
+	transport := &countingTransport{}
+	g := NewServer(&ServerOptions{
+		Upstream:  upstreamURL,
+		Transport: transport,
+		Director: func(req *http.Request) {
+			req.Header.Set("X-Forwarded-Host", "example.com")
+		},
+	})
+
+	rec := httptest.NewRecorder()
+	g.ServeHTTP(rec, httptest.NewRequest("GET", "/forwarded", nil))
+
+	b, _ := io.ReadAll(rec.Result().Body)
+	assert.Contains(t, string(b), "X-Forwarded-Host: example.com")
+	assert.Equal(t, 1, transport.count)
+}
+
+func TestUpstreamErrorHandler(t *testing.T) {
+	upstreamURL, _ := url.Parse("https://test.invalid")
+	var handledErr error
+	g := NewServer(&ServerOptions{
+		Upstream: upstreamURL,
+		ErrorHandler: func(rw http.ResponseWriter, _ *http.Request, err error) {
+			handledErr = err
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		},
+	})
+
+	rec := httptest.NewRecorder()
+	g.ServeHTTP(rec, httptest.NewRequest("GET", "/error", nil))
+
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Error(t, handledErr)
+}
+
+func TestTrailers(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Header().Set("Trailer", "X-Checksum")
+		_, _ = rw.Write([]byte(`{"foo": "bar", "baz": "qux"}`))
+		rw.Header().Set("X-Checksum", "abc")
+	}))
+	defer upstream.Close()
+
+	upstreamURL, _ := url.Parse(upstream.URL)
+	gateway := httptest.NewServer(NewServer(&ServerOptions{Upstream: upstreamURL}))
+	defer gateway.Close()
+
+	resp, err := http.Get(gateway.URL + `/?fields="/foo"`)
+	if assert.NoError(t, err) {
+		b, _ := io.ReadAll(resp.Body)
+		assert.Equal(t, `{"foo":"bar"}`, string(b))
+		assert.Equal(t, "abc", resp.Trailer.Get("X-Checksum"))
+	}
+}
+
+func TestChunkedUpstream(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		_, _ = rw.Write([]byte(`{"foo": "bar", `))
+		rw.(http.Flusher).Flush()
+		_, _ = rw.Write([]byte(`"baz": "qux"}`))
+	}))
+	defer upstream.Close()
+
+	upstreamURL, _ := url.Parse(upstream.URL)
+	gateway := httptest.NewServer(NewServer(&ServerOptions{Upstream: upstreamURL}))
+	defer gateway.Close()
+
+	resp, err := http.Get(gateway.URL + `/?fields="/foo"`)
+	if assert.NoError(t, err) {
+		b, _ := io.ReadAll(resp.Body)
+		assert.Equal(t, `{"foo":"bar"}`, string(b))
+		assert.Equal(t, int64(13), resp.ContentLength)
+		assert.Empty(t, resp.TransferEncoding)
+	}
+}
+
+func TestMaxConcurrentRequests(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get(defaultInternalRequestHeader) == "" {
+			close(started)
+			<-release
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		_, _ = rw.Write([]byte(`{"foo": "bar"}`))
+	}))
+	defer upstream.Close()
+
+	upstreamURL, _ := url.Parse(upstream.URL)
+	g := NewServer(&ServerOptions{Upstream: upstreamURL, MaxConcurrentRequests: 1})
+	gateway := httptest.NewServer(g.chainHandlers())
+	defer gateway.Close()
+
+	done := make(chan int)
+	go func() {
+		resp, err := http.Get(gateway.URL + "/")
+		if err != nil {
+			done <- 0
+			return
+		}
+		resp.Body.Close()
+		done <- resp.StatusCode
+	}()
+	<-started
+
+	resp, err := http.Get(gateway.URL + "/")
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+		assert.Equal(t, "1", resp.Header.Get("Retry-After"))
+	}
+
+	// Pushed requests of an explicit request being handled aren't limited
+	g.vulcain.pushers.add(newWaitPusher(nil, "explicit", 0, 0))
+	defer g.vulcain.pushers.remove("explicit")
+
+	req, _ := http.NewRequest("GET", gateway.URL+"/", nil)
+	req.Header.Set(defaultInternalRequestHeader, "explicit")
+	resp, err = http.DefaultClient.Do(req)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	// Forged internal request headers are limited
+	req.Header.Set(defaultInternalRequestHeader, "forged")
+	resp, err = http.DefaultClient.Do(req)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	}
+
+	close(release)
+	assert.Equal(t, http.StatusOK, <-done)
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	upstream := httptest.NewServer(&api.JSONLDHandler{})
+
+	upstreamURL, _ := url.Parse(upstream.URL)
+	g := NewServer(&ServerOptions{Upstream: upstreamURL, HealthPath: "/healthz", ReadyPath: "/readyz", OpenAPIFile: openapiFixture})
+	gateway := httptest.NewServer(g.chainHandlers())
+	defer gateway.Close()
+
+	for path, status := range map[string]int{"/healthz": http.StatusOK, "/readyz": http.StatusOK, "/books.jsonld": http.StatusOK, "/notexists": http.StatusNotFound} {
+		resp, err := http.Get(gateway.URL + path)
+		if assert.NoError(t, err) {
+			resp.Body.Close()
+			assert.Equal(t, status, resp.StatusCode, path)
+		}
+	}
+
+	// The upstream is unreachable
+	upstream.Close()
+
+	resp, err := http.Get(gateway.URL + "/readyz")
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	}
+
+	resp, err = http.Get(gateway.URL + "/healthz")
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+}
+
+func TestApplyErrorHandler(t *testing.T) {
+	upstream := httptest.NewServer(&api.JSONLDHandler{})
+	defer upstream.Close()
+
+	upstreamURL, _ := url.Parse(upstream.URL)
+	g := NewServer(&ServerOptions{
+		Upstream: upstreamURL,
+		ApplyErrorHandler: func(rw http.ResponseWriter, _ *http.Request, err error) {
+			assert.ErrorIs(t, err, ErrMixedFieldsSelectors)
+
+			rw.Header().Set("Content-Type", "application/problem+json")
+			rw.WriteHeader(http.StatusBadRequest)
+			_, _ = io.WriteString(rw, `{"title": "Invalid directives"}`)
+		},
+	})
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/books.jsonld", nil)
+	req.Header.Set("Fields", `"/hydra:member", "!/@id"`)
+	g.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Equal(t, "application/problem+json", rec.Header().Get("Content-Type"))
+	assert.Equal(t, `{"title": "Invalid directives"}`, rec.Body.String())
+
+	// Without handler, the default error handler is used
+	g = NewServer(&ServerOptions{Upstream: upstreamURL})
+
+	rec = httptest.NewRecorder()
+	g.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusBadGateway, rec.Code)
+}
@@ -0,0 +1,180 @@
+package vulcain
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+)
+
+// streamRelations reads a JSON document using a streaming tokenizer and calls relationHandler as soon as a relation matched by a "preload" selector is encountered.
+// The nodes are selected using the same rules as traverse: if filter is true, only the values matched by a "fields" selector are considered.
+// It returns the full document, even if it isn't valid JSON.
+// The document is stored in buf, a new buffer is allocated if it is nil.
+func (v *Vulcain) streamRelations(r io.Reader, buf *bytes.Buffer, tree *node, filter bool, relationHandler func(n *node, v string)) ([]byte, error) {
+	if buf == nil {
+		buf = new(bytes.Buffer)
+	}
+	tee := io.TeeReader(r, buf)
+
+	d := json.NewDecoder(tee)
+	d.UseNumber()
+
+	s := &streamer{d: d, halSupport: v.halSupport, relationFieldPattern: v.relationFieldPattern, relationHandler: relationHandler}
+	if err := s.value([]streamMatch{{n: tree, filter: filter}}); err != nil {
+		var syntaxErr *json.SyntaxError
+		if !errors.As(err, &syntaxErr) && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+	}
+
+	// The decoder stops at the end of the first JSON value, read the rest of the document
+	if _, err := io.Copy(io.Discard, tee); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// streamMatch is a node of the tree matching the value being read
+type streamMatch struct {
+	n *node
+	// filter is true if only the values matched by a "fields" selector are kept
+	filter bool
+	// stringOnly is true if the value is a relation only if it is a string (HAL links, WithRelationFieldPattern)
+	stringOnly bool
+}
+
+// streamer reads a JSON document and calls relationHandler for the relations it contains
+type streamer struct {
+	d                    *json.Decoder
+	halSupport           bool
+	relationFieldPattern *regexp.Regexp
+	relationHandler      func(n *node, v string)
+}
+
+// value reads the next JSON value, matches are the nodes of the tree matching this value
+func (s *streamer) value(matches []streamMatch) error {
+	if len(matches) == 0 {
+		var raw json.RawMessage
+
+		return s.d.Decode(&raw)
+	}
+
+	t, err := s.d.Token()
+	if err != nil {
+		return err
+	}
+
+	switch t := t.(type) {
+	case json.Delim:
+		switch t {
+		case '{':
+			for s.d.More() {
+				key, err := s.d.Token()
+				if err != nil {
+					return err
+				}
+
+				k, _ := key.(string)
+				if err := s.value(s.matchingChildren(matches, k, true)); err != nil {
+					return err
+				}
+			}
+		case '[':
+			leaves := relationLeaves(matches)
+			for i := 0; s.d.More(); i++ {
+				if err := s.value(append(s.matchingChildren(matches, strconv.Itoa(i), false), leaves...)); err != nil {
+					return err
+				}
+			}
+		}
+
+		// Closing delimiter
+		_, err = s.d.Token()
+
+		return err
+
+	case string:
+		s.handleRelation(matches, t, true)
+
+	case json.Number:
+		s.handleRelation(matches, formatNumber(t), false)
+	}
+
+	return nil
+}
+
+// matchingChildren returns the children of the given nodes matching the key of an object or the index of an array
+// "*" matches all elements of arrays and all values of objects, children skipped by traverse are skipped too
+func (s *streamer) matchingChildren(matches []streamMatch, key string, isObject bool) []streamMatch {
+	var children []streamMatch
+	for _, m := range matches {
+		if m.stringOnly {
+			continue
+		}
+
+		// HAL link object, the relation is the value of the "href" property
+		halLink := s.halSupport && isObject && m.n.preload && !m.n.hasChildren(preload)
+		if halLink && key == "href" {
+			children = append(children, streamMatch{n: m.n, stringOnly: true})
+		}
+
+		filter := m.filter && m.n.hasChildren(fields)
+		for _, c := range m.n.children {
+			if c.negated || (halLink && c.path == "href") || (filter && !c.fields) {
+				continue
+			}
+
+			switch {
+			case c.path == relationFieldsToken && s.relationFieldPattern != nil:
+				if isObject && c.preload && s.relationFieldPattern.MatchString(key) {
+					children = append(children, streamMatch{n: c, filter: filter, stringOnly: true})
+				}
+			case c.path == "*" || unescape(c.path) == key:
+				children = append(children, streamMatch{n: c, filter: filter})
+			}
+		}
+	}
+
+	return children
+}
+
+// relationLeaves returns the nodes targeted by a "preload" directive without children, matching every element of an array of relations
+func relationLeaves(matches []streamMatch) []streamMatch {
+	var leaves []streamMatch
+	for _, m := range matches {
+		if !m.stringOnly && m.n.preload && len(m.n.children) == 0 {
+			leaves = append(leaves, m)
+		}
+	}
+
+	return leaves
+}
+
+// formatNumber converts a number used as a relation (e.g. an ID used with OpenAPI) to a string
+// Integral numbers are formatted as integers (e.g. 1e3 becomes 1000), other ones are kept as is
+func formatNumber(n json.Number) string {
+	if i, err := n.Int64(); err == nil {
+		return strconv.FormatInt(i, 10)
+	}
+
+	if f, err := n.Float64(); err == nil && f == math.Trunc(f) && math.Abs(f) < math.MaxInt64 {
+		return strconv.FormatInt(int64(f), 10)
+	}
+
+	return n.String()
+}
+
+// handleRelation calls relationHandler for the nodes targeted by a "preload" directive
+// Embedded JSON documents are traversed later, they aren't relations
+func (s *streamer) handleRelation(matches []streamMatch, rel string, isString bool) {
+	for _, m := range matches {
+		if m.n.preload && !m.n.embeddedJSON && (isString || !m.stringOnly) {
+			s.relationHandler(m.n, rel)
+		}
+	}
+}
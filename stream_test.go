@@ -0,0 +1,203 @@
+package vulcain
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dunglas/httpsfv"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamRelations(t *testing.T) {
+	n := &node{}
+	n.importPointers(preload, httpsfv.List{httpsfv.NewItem("/author"), httpsfv.NewItem("/members/*/rel"), httpsfv.NewItem("/id")}, -1)
+	n.importPointers(fields, httpsfv.List{httpsfv.NewItem("!/members/1")}, -1)
+
+	doc := `{"title": "1984", "author": "/authors/1", "members": [{"rel": "/a"}, {"rel": "/b"}, {"rel": "/c"}], "id": 42}  `
+
+	var relations []string
+	b, err := New().streamRelations(strings.NewReader(doc), nil, n, false, func(n *node, v string) {
+		relations = append(relations, n.String()+"="+v)
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, doc, string(b))
+	assert.Equal(t, []string{"/author=/authors/1", "/members/*/rel=/a", "/members/*/rel=/b", "/members/*/rel=/c", "/id=42"}, relations)
+}
+
+func TestStreamRelationsArray(t *testing.T) {
+	n := &node{}
+	n.importPointers(preload, httpsfv.List{httpsfv.NewItem("/images")}, -1)
+
+	var relations []string
+	_, err := New().streamRelations(strings.NewReader(`{"images": ["/img/1", {"title": "cover"}, 2, "/img/3"]}`), nil, n, false, func(n *node, v string) {
+		relations = append(relations, n.String()+"="+v)
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/images=/img/1", "/images=2", "/images=/img/3"}, relations)
+}
+
+func TestStreamRelationsObjectWildcard(t *testing.T) {
+	n := &node{}
+	n.importPointers(preload, httpsfv.List{httpsfv.NewItem("/translations/*/author")}, -1)
+
+	var relations []string
+	_, err := New().streamRelations(strings.NewReader(`{"translations": {"en": {"author": "/authors/1"}, "fr": {"author": "/authors/2"}}}`), nil, n, false, func(n *node, v string) {
+		relations = append(relations, n.String()+"="+v)
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/translations/*/author=/authors/1", "/translations/*/author=/authors/2"}, relations)
+}
+
+func TestStreamRelationsInvalidJSON(t *testing.T) {
+	n := &node{}
+	n.importPointers(preload, httpsfv.List{httpsfv.NewItem("/author")}, -1)
+
+	doc := `{"author": "/authors/1", invalid`
+
+	var relations []string
+	b, err := New().streamRelations(strings.NewReader(doc), nil, n, false, func(n *node, v string) {
+		relations = append(relations, v)
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, doc, string(b))
+	assert.Equal(t, []string{"/authors/1"}, relations)
+}
+
+// chunkReader returns its content chunk by chunk, read is the number of chunks fully read
+type chunkReader struct {
+	chunks []string
+	read   int
+	offset int
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if r.read == len(r.chunks) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, r.chunks[r.read][r.offset:])
+	if r.offset += n; r.offset == len(r.chunks[r.read]) {
+		r.read++
+		r.offset = 0
+	}
+
+	return n, nil
+}
+
+// earlyHintsRecorder records the number of chunks read when Early Hints are sent
+type earlyHintsRecorder struct {
+	*httptest.ResponseRecorder
+	reader     *chunkReader
+	earlyHints [][]string
+	chunksRead []int
+}
+
+func (r *earlyHintsRecorder) WriteHeader(code int) {
+	if code == http.StatusEarlyHints {
+		r.earlyHints = append(r.earlyHints, r.Header()["Link"])
+		r.chunksRead = append(r.chunksRead, r.reader.read)
+
+		return
+	}
+
+	r.ResponseRecorder.WriteHeader(code)
+}
+
+func TestApplyJSONStreaming(t *testing.T) {
+	v := New(WithJSONStreaming(), WithEarlyHints())
+
+	body := &chunkReader{chunks: []string{`{"author": "/authors/1", `, `"related": "/books/2", `, `"author2": "/authors/1", `, `"title": "1984"}`}}
+	rw := &earlyHintsRecorder{ResponseRecorder: httptest.NewRecorder(), reader: body}
+	req := newTestRequest(v, rw, "/books/1", http.Header{"Preload": []string{`"/author", "/related", "/author2"`}})
+	defer v.Finish(req, false)
+
+	b, err := v.Apply(req, rw, body, rw.Header())
+	assert.NoError(t, err)
+	assert.Equal(t, `{"author": "/authors/1", "related": "/books/2", "author2": "/authors/1", "title": "1984"}`, string(b))
+
+	assert.Equal(t, [][]string{
+		{"</authors/1>; rel=preload; as=fetch"},
+		{"</books/2>; rel=preload; as=fetch"},
+	}, rw.earlyHints)
+	assert.Equal(t, []int{1, 2}, rw.chunksRead)
+	assert.Equal(t, []string{"</authors/1>; rel=preload; as=fetch", "</books/2>; rel=preload; as=fetch"}, rw.Header()["Link"])
+}
+
+func TestApplyJSONStreamingParity(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []Option
+		body    string
+		header  http.Header
+	}{
+		{
+			name:   "fields filter",
+			body:   `{"author": "/authors/1", "related": "/books/2", "title": "1984"}`,
+			header: http.Header{"Preload": []string{`"/author", "/related"`}, "Fields": []string{`"/author", "/title"`}},
+		},
+		{
+			name:   "negated fields",
+			body:   `{"author": "/authors/1", "related": "/books/2"}`,
+			header: http.Header{"Preload": []string{`"/author", "/related"`}, "Fields": []string{`"!/related"`}},
+		},
+		{
+			name:    "HAL links",
+			options: []Option{WithHALSupport()},
+			body:    `{"_links": {"author": {"href": "/authors/1"}, "related": [{"href": "/books/2"}, {"href": 3}]}}`,
+			header:  http.Header{"Preload": []string{`"/_links/author", "/_links/related"`}},
+		},
+		{
+			name:    "relation field pattern",
+			options: []Option{WithRelationFieldPattern("Href$")},
+			body:    `{"coverHref": "/covers/1", "otherHref": {"href": "/covers/2"}, "title": "1984"}`,
+			header:  http.Header{"Preload": []string{`"/~r"`}},
+		},
+		{
+			name:    "embedded JSON",
+			options: []Option{WithEmbeddedJSON("/data")},
+			body:    `{"data": "{\"author\": \"/authors/1\"}"}`,
+			header:  http.Header{"Preload": []string{`"/data/author"`}},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			apply := func(options ...Option) ([]string, []string, string) {
+				v := New(append(options, tc.options...)...)
+
+				rw := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+				req := newTestRequest(v, rw, "/books/1", tc.header)
+				defer v.Finish(req, false)
+
+				b, err := v.Apply(req, rw, strings.NewReader(tc.body), rw.Header())
+				assert.NoError(t, err)
+
+				return rw.pushed, rw.Header()["Link"], string(b)
+			}
+
+			pushed, links, body := apply()
+			assert.NotEmpty(t, pushed)
+
+			streamedPushed, streamedLinks, streamedBody := apply(WithJSONStreaming())
+
+			assert.Equal(t, pushed, streamedPushed)
+			assert.Equal(t, links, streamedLinks)
+			assert.Equal(t, body, streamedBody)
+		})
+	}
+}
+
+func TestFormatNumber(t *testing.T) {
+	assert.Equal(t, "42", formatNumber("42"))
+	assert.Equal(t, "-42", formatNumber("-42"))
+	assert.Equal(t, "1000", formatNumber("1e3"))
+	assert.Equal(t, "4.5", formatNumber("4.5"))
+	assert.Equal(t, "1e400", formatNumber("1e400"))
+}
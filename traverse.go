@@ -30,10 +30,24 @@ func espaceSJSONPath(s string) string {
 	return strings.ReplaceAll(s, "?", "\\?")
 }
 
+// escapeSJSONKey escapes an object key to be used as a single segment of a sjson or gjson path
+// Unlike espaceSJSONPath, the dots and the escape character are escaped too
+func escapeSJSONKey(key string) string {
+	key = strings.ReplaceAll(key, `\`, `\\`)
+
+	return strings.ReplaceAll(espaceSJSONPath(key), ".", `\.`)
+}
+
 // urlRewriter rewrites an URL to propagate the "preload" and "fields" selectors to relations
-func urlRewriter(u *url.URL, n *node) {
-	p := n.httpList(preload, "")
-	f := n.httpList(fields, "")
+// Only the selectors passed using query parameters are propagated, the other ones are propagated using headers
+func urlRewriter(u *url.URL, n *node, preloadQuery, fieldsQuery bool) {
+	var p, f httpsfv.List
+	if preloadQuery {
+		p = n.httpList(preload, "")
+	}
+	if fieldsQuery {
+		f = n.httpList(fields, "")
+	}
 
 	q := u.Query()
 
@@ -52,6 +66,18 @@ func urlRewriter(u *url.URL, n *node) {
 	u.RawQuery = q.Encode()
 }
 
+// refPath converts an in-document reference (e.g. #/definitions/x) to a gjson path
+func refPath(ref string) string {
+	parts := strings.Split(strings.TrimPrefix(ref, "#/"), "/")
+	for i, p := range parts {
+		p = strings.ReplaceAll(p, "~1", "/")
+		p = strings.ReplaceAll(p, "~0", "~")
+		parts[i] = escapeSJSONKey(p)
+	}
+
+	return strings.Join(parts, ".")
+}
+
 // getBytes retrieves a slice of bytes
 func getBytes(r gjson.Result, body []byte) []byte {
 	if r.Index > 0 {
@@ -61,21 +87,114 @@ func getBytes(r gjson.Result, body []byte) []byte {
 	return []byte(r.Raw)
 }
 
+// RelationHandler is called for every relation matched by a selector
+// It returns the new value of the relation, or an empty string to keep the current one
+type RelationHandler func(n Node, value string) string
+
+// JSONProcessor walks and modifies a JSON document according to the tree built from the "preload" and "fields" directives
+// Use WithJSONProcessor() to replace the default implementation
+type JSONProcessor interface {
+	// Process calls relationHandler for every relation matched by a node of tree and returns the modified document.
+	// If filter is true, only the fields matched by a "fields" selector must be kept.
+	// The nodes passed to relationHandler must be the ones of tree.
+	Process(body []byte, tree Node, filter bool, relationHandler RelationHandler) []byte
+}
+
+// defaultJSONProcessor is the JSONProcessor used by default, it relies on traverseJSON
+type defaultJSONProcessor struct {
+	v *Vulcain
+}
+
+// Process implements JSONProcessor
+func (p defaultJSONProcessor) Process(body []byte, tree Node, filter bool, relationHandler RelationHandler) []byte {
+	return p.v.traverseJSON(body, tree.treeNode(), filter, relationHandler)
+}
+
 // traverseJSON traverses and modify if needed the JSON document
 // it pushes the relations specified by a "preload" directive
-func (v *Vulcain) traverseJSON(currentBody []byte, tree *node, filter bool, relationHandler func(n *node, v string) string) []byte {
+func (v *Vulcain) traverseJSON(currentBody []byte, tree *node, filter bool, relationHandler RelationHandler) []byte {
+	return v.traverse(currentBody, currentBody, tree, filter, relationHandler)
+}
+
+// traverse traverses currentBody, a part of the root document
+// root is used to resolve in-document references, it is nil when traversing an inlined reference to prevent cycles
+func (v *Vulcain) traverse(root, currentBody []byte, tree *node, filter bool, relationHandler RelationHandler) []byte {
 	var (
 		newBody []byte
 		err     error
 	)
 
+	tree.value = currentBody
+
 	result := gjson.ParseBytes(currentBody)
 	switch result.Type {
 	// Maybe a relation
 	case gjson.String:
-		return handleRelation(currentBody, result.String(), tree, relationHandler)
+		// Invalid embedded documents are left untouched
+		if tree.embeddedJSON {
+			if embedded := []byte(result.String()); gjson.ValidBytes(embedded) {
+				newBody, _ = json.Marshal(string(v.traverse(embedded, embedded, tree, filter, relationHandler)))
+
+				return newBody
+			}
+
+			return currentBody
+		}
+
+		if v.inlineRefs && root != nil && strings.HasPrefix(result.String(), "#/") {
+			if ref := gjson.GetBytes(root, refPath(result.String())); ref.Exists() {
+				return v.traverse(nil, getBytes(ref, root), tree, filter, relationHandler)
+			}
+
+			v.logger.Debug("in-document reference not found", zap.Stringer("node", tree), zap.String("ref", result.String()))
+		}
+
+		newBody = currentBody
+		// Nodes only created by WithFieldTransformer don't match relations
+		if tree.preload || tree.fields {
+			newBody = handleRelation(currentBody, result.String(), tree, relationHandler)
+		}
+
+		return transformValue(newBody, tree.transformers)
 	case gjson.Number:
-		return handleRelation(currentBody, strconv.FormatInt(result.Int(), 10), tree, relationHandler)
+		if !tree.preload && !tree.fields {
+			return currentBody
+		}
+
+		return handleRelation(currentBody, formatNumber(json.Number(result.Raw)), tree, relationHandler)
+	}
+
+	// Array of relations, the relation is each element of the array
+	if tree.preload && len(tree.children) == 0 && result.IsArray() {
+		newBody = currentBody
+
+		var i int
+		result.ForEach(func(_, value gjson.Result) bool {
+			rawBytes := v.traverse(root, getBytes(value, currentBody), tree, filter, relationHandler)
+			newBody, err = sjson.SetRawBytes(newBody, strconv.Itoa(i), rawBytes)
+			if err != nil {
+				v.logger.Debug("cannot update array", zap.Stringer("node", tree), zap.Int("index", i), zap.Error(err))
+			}
+
+			i++
+			return true
+		})
+
+		return newBody
+	}
+
+	// HAL link object, the relation is the value of the "href" property
+	var halLink bool
+	if v.halSupport && tree.preload && !tree.hasChildren(preload) && result.IsObject() {
+		if href := result.Get("href"); href.Type == gjson.String {
+			halLink = true
+			if newValue := relationHandler(tree, href.String()); newValue != "" {
+				if currentBody, err = sjson.SetBytes(currentBody, "href", newValue); err != nil {
+					v.logger.Debug("cannot update HAL link", zap.Stringer("node", tree), zap.Error(err))
+				}
+				result = gjson.ParseBytes(currentBody)
+			}
+		}
 	}
 
 	filter = filter && tree.hasChildren(fields)
@@ -90,6 +209,18 @@ func (v *Vulcain) traverseJSON(currentBody []byte, tree *node, filter bool, rela
 	}
 
 	for _, n := range tree.children {
+		if halLink && n.path == "href" {
+			// Already handled
+			if filter {
+				newBody, err = sjson.SetRawBytes(newBody, "href", getBytes(result.Get("href"), currentBody))
+				if err != nil {
+					v.logger.Debug("cannot update new document", zap.Stringer("node", n), zap.Error(err))
+				}
+			}
+
+			continue
+		}
+
 		if filter {
 			if !n.fields {
 				// Don't push for nothing
@@ -97,27 +228,48 @@ func (v *Vulcain) traverseJSON(currentBody []byte, tree *node, filter bool, rela
 			}
 		}
 
-		if n.path == "*" {
-			var i int
-			result.ForEach(func(_, value gjson.Result) bool {
-				// TODO: support iterating over objects
-				rawBytes := v.traverseJSON(getBytes(value, currentBody), n, filter, relationHandler)
-				newBody, err = sjson.SetRawBytes(newBody, strconv.Itoa(i), rawBytes)
-				if err != nil {
-					v.logger.Debug("cannot update array", zap.Stringer("node", n), zap.Int("index", i), zap.Error(err))
+		if n.negated {
+			// Negated "fields" selector, remove the matching value
+			if n.path == "*" {
+				if result.IsArray() {
+					newBody = []byte("[]")
+				} else {
+					newBody = []byte("{}")
 				}
 
-				i++
-				return true
+				continue
+			}
+
+			if newBody, err = sjson.DeleteBytes(newBody, espaceSJSONPath(unescape(n.path))); err != nil {
+				v.logger.Debug("cannot remove value", zap.Stringer("node", n), zap.Error(err))
+			}
+
+			continue
+		}
+
+		if n.path == relationFieldsToken && v.relationFieldPattern != nil {
+			// Matches the fields of an object whose names match the pattern set using WithRelationFieldPattern
+			if !n.preload || !result.IsObject() {
+				continue
+			}
+
+			newBody = v.traverseMembers(root, currentBody, newBody, result, n, filter, relationHandler, func(key, value gjson.Result) bool {
+				return value.Type == gjson.String && v.relationFieldPattern.MatchString(key.String())
 			})
 			continue
 		}
 
+		if n.path == "*" {
+			// Matches all elements of an array, or all values of an object
+			newBody = v.traverseMembers(root, currentBody, newBody, result, n, filter, relationHandler, nil)
+			continue
+		}
+
 		path := espaceSJSONPath(unescape(n.path))
 
 		result := gjson.GetBytes(currentBody, path)
 		if result.Exists() {
-			rawBytes := v.traverseJSON(getBytes(result, currentBody), n, filter, relationHandler)
+			rawBytes := v.traverse(root, getBytes(result, currentBody), n, filter, relationHandler)
 
 			newBody, err = sjson.SetRawBytes(newBody, path, rawBytes)
 			if err != nil {
@@ -129,7 +281,97 @@ func (v *Vulcain) traverseJSON(currentBody []byte, tree *node, filter bool, rela
 	return newBody
 }
 
-func handleRelation(currentBody []byte, rel string, tree *node, relationHandler func(n *node, v string) string) []byte {
+// traverseMembers traverses the elements of the array or the values of the object result using the node n, and sets the new values in newBody
+// If match isn't nil, only the members for which it returns true are traversed
+func (v *Vulcain) traverseMembers(root, currentBody, newBody []byte, result gjson.Result, n *node, filter bool, relationHandler RelationHandler, match func(key, value gjson.Result) bool) []byte {
+	isObject := result.IsObject()
+
+	var i int
+	result.ForEach(func(key, value gjson.Result) bool {
+		defer func() { i++ }()
+		if match != nil && !match(key, value) {
+			return true
+		}
+
+		path := strconv.Itoa(i)
+		if isObject {
+			path = escapeSJSONKey(key.String())
+		}
+
+		rawBytes := v.traverse(root, getBytes(value, currentBody), n, filter, relationHandler)
+
+		var err error
+		if newBody, err = sjson.SetRawBytes(newBody, path, rawBytes); err != nil {
+			v.logger.Debug("cannot update value", zap.Stringer("node", n), zap.String("path", path), zap.Error(err))
+		}
+
+		return true
+	})
+
+	return newBody
+}
+
+// missingFields returns the "fields" selectors of tree targeting values missing from the document
+func missingFields(body []byte, tree *node) []string {
+	var missing []string
+	seen := make(map[string]struct{})
+
+	var walk func(result gjson.Result, tree *node)
+	walk = func(result gjson.Result, tree *node) {
+		if tree.embeddedJSON && result.Type == gjson.String {
+			result = gjson.Parse(result.String())
+		}
+
+		for _, n := range tree.children {
+			if !n.fields || n.negated {
+				continue
+			}
+
+			if n.path == "*" {
+				result.ForEach(func(_, value gjson.Result) bool {
+					walk(value, n)
+
+					return true
+				})
+
+				continue
+			}
+
+			value := result.Get(escapeSJSONKey(unescape(n.path)))
+			if value.Exists() {
+				walk(value, n)
+
+				continue
+			}
+
+			if _, ok := seen[n.String()]; !ok {
+				seen[n.String()] = struct{}{}
+				missing = append(missing, n.String())
+			}
+		}
+	}
+	walk(gjson.ParseBytes(body), tree)
+
+	return missing
+}
+
+// transformValue passes the JSON string through the transformers set using WithFieldTransformer
+func transformValue(currentBody []byte, transformers []func(value string) string) []byte {
+	if len(transformers) == 0 {
+		return currentBody
+	}
+
+	value := gjson.ParseBytes(currentBody).String()
+	for _, transform := range transformers {
+		value = transform(value)
+	}
+
+	newBody, _ := json.Marshal(value)
+
+	return newBody
+}
+
+func handleRelation(currentBody []byte, rel string, tree *node, relationHandler RelationHandler) []byte {
 	if newValue := relationHandler(tree, rel); newValue != "" {
 		newBody, _ := json.Marshal(newValue)
 		return newBody
@@ -14,33 +14,51 @@ func TestUnescape(t *testing.T) {
 
 func TestUrlRewriter(t *testing.T) {
 	n := &node{}
-	n.importPointers(preload, httpsfv.List{httpsfv.NewItem("/foo/*"), httpsfv.NewItem("/bar/baz")})
-	n.importPointers(fields, httpsfv.List{httpsfv.NewItem("/foo/*"), httpsfv.NewItem("/baz/bar")})
+	n.importPointers(preload, httpsfv.List{httpsfv.NewItem("/foo/*"), httpsfv.NewItem("/bar/baz")}, -1)
+	n.importPointers(fields, httpsfv.List{httpsfv.NewItem("/foo/*"), httpsfv.NewItem("/baz/bar")}, -1)
 
 	u, _ := url.Parse("/test")
-	urlRewriter(u, n)
+	urlRewriter(u, n, true, true)
 
 	assert.Equal(t, "/test?fields=%22%2Ffoo%2F%2A%22%2C+%22%2Fbaz%2Fbar%22&preload=%22%2Ffoo%2F%2A%22%2C+%22%2Fbar%2Fbaz%22", u.String())
 }
 
-func urlRewriteRelationHandler(n *node, v string) string {
+func urlRewriteRelationHandler(n Node, v string) string {
 	u, _ := url.Parse(v)
-	urlRewriter(u, n)
+	urlRewriter(u, n.treeNode(), true, true)
 
 	return u.String()
 }
 
 func TestTraverseJSONFields(t *testing.T) {
 	n := &node{}
-	n.importPointers(fields, httpsfv.List{httpsfv.NewItem("/notexist"), httpsfv.NewItem("/bar")})
+	n.importPointers(fields, httpsfv.List{httpsfv.NewItem("/notexist"), httpsfv.NewItem("/bar")}, -1)
 
 	result := New().traverseJSON([]byte(`{"foo": "f", "bar": "b"}`), n, true, urlRewriteRelationHandler)
 	assert.Equal(t, `{"bar":"b"}`, string(result))
 }
 
+func TestTraverseJSONMissingFields(t *testing.T) {
+	n := &node{}
+	n.importPointers(fields, httpsfv.List{httpsfv.NewItem("/notexist/foo"), httpsfv.NewItem("/members/*/name"), httpsfv.NewItem("/bar")}, -1)
+
+	doc := []byte(`{"bar": "b", "members": [{"name": "a"}, {"id": 2}, {"id": 3}]}`)
+
+	// Missing values are silently ignored
+	result := New().traverseJSON(doc, n, true, urlRewriteRelationHandler)
+	assert.Equal(t, `{"members":[{"name":"a"},{},{}],"bar":"b"}`, string(result))
+
+	assert.Equal(t, []string{"/notexist", "/members/*/name"}, missingFields(doc, n))
+
+	// Keys containing dots aren't handled as paths
+	n = &node{}
+	n.importPointers(fields, httpsfv.List{httpsfv.NewItem("/a.b"), httpsfv.NewItem("/c.d")}, -1)
+	assert.Equal(t, []string{"/c.d"}, missingFields([]byte(`{"a.b": 1, "c": {"d": 2}}`), n))
+}
+
 func TestTraverseJSONFieldsRewriteURL(t *testing.T) {
 	n := &node{}
-	n.importPointers(fields, httpsfv.List{httpsfv.NewItem("/foo/*/bar")})
+	n.importPointers(fields, httpsfv.List{httpsfv.NewItem("/foo/*/bar")}, -1)
 
 	result := New().traverseJSON([]byte(`{"foo": ["/a", "/b"]}`), n, true, urlRewriteRelationHandler)
 	assert.Equal(t, `{"foo":["/a?fields=%22%2Fbar%22","/b?fields=%22%2Fbar%22"]}`, string(result))
@@ -48,7 +66,7 @@ func TestTraverseJSONFieldsRewriteURL(t *testing.T) {
 
 func TestTraverseJSONPreload(t *testing.T) {
 	n := &node{}
-	n.importPointers(preload, httpsfv.List{httpsfv.NewItem("/notexist"), httpsfv.NewItem("/bar")})
+	n.importPointers(preload, httpsfv.List{httpsfv.NewItem("/notexist"), httpsfv.NewItem("/bar")}, -1)
 
 	result := New().traverseJSON([]byte(`{"foo": "/foo", "bar": "/bar"}`), n, false, urlRewriteRelationHandler)
 	assert.Equal(t, `{"foo": "/foo", "bar": "/bar"}`, string(result))
@@ -56,7 +74,7 @@ func TestTraverseJSONPreload(t *testing.T) {
 
 func TestTraverseJSONPreloadRewriteURL(t *testing.T) {
 	n := &node{}
-	n.importPointers(preload, httpsfv.List{httpsfv.NewItem("/foo/*/rel"), httpsfv.NewItem("/bar/baz")})
+	n.importPointers(preload, httpsfv.List{httpsfv.NewItem("/foo/*/rel"), httpsfv.NewItem("/bar/baz")}, -1)
 
 	result := New().traverseJSON([]byte(`{"foo": ["/a", "/b"], "bar": "/bar"}`), n, false, urlRewriteRelationHandler)
 	assert.Equal(t, `{"foo": ["/a?preload=%22%2Frel%22", "/b?preload=%22%2Frel%22"], "bar": "/bar?preload=%22%2Fbaz%22"}`, string(result))
@@ -64,9 +82,125 @@ func TestTraverseJSONPreloadRewriteURL(t *testing.T) {
 
 func TestTraverseJSONPreloadAndFieldsRewriteURL(t *testing.T) {
 	n := &node{}
-	n.importPointers(preload, httpsfv.List{httpsfv.NewItem("/notexist"), httpsfv.NewItem("/foo/*/rel"), httpsfv.NewItem("/bar/baz"), httpsfv.NewItem("/baz")})
-	n.importPointers(fields, httpsfv.List{httpsfv.NewItem("/foo/*"), httpsfv.NewItem("/bar/baz"), httpsfv.NewItem("/notexist")})
+	n.importPointers(preload, httpsfv.List{httpsfv.NewItem("/notexist"), httpsfv.NewItem("/foo/*/rel"), httpsfv.NewItem("/bar/baz"), httpsfv.NewItem("/baz")}, -1)
+	n.importPointers(fields, httpsfv.List{httpsfv.NewItem("/foo/*"), httpsfv.NewItem("/bar/baz"), httpsfv.NewItem("/notexist")}, -1)
 
 	result := New().traverseJSON([]byte(`{"foo": ["/a", "/b"], "bar": "/bar", "baz": "/baz"}`), n, true, urlRewriteRelationHandler)
 	assert.Equal(t, `{"foo":["/a?preload=%22%2Frel%22","/b?preload=%22%2Frel%22"],"bar":"/bar?fields=%22%2Fbaz%22\u0026preload=%22%2Fbaz%22"}`, string(result))
 }
+
+func TestTraverseJSONPreloadArray(t *testing.T) {
+	n := &node{}
+	n.importPointers(preload, httpsfv.List{httpsfv.NewItem("/images")}, -1)
+
+	var relations []string
+	result := New().traverseJSON([]byte(`{"images": ["/img/1", {"title": "cover"}, 2, "/img/3"]}`), n, false, func(n Node, v string) string {
+		relations = append(relations, v)
+		if v == "2" {
+			return ""
+		}
+
+		return v + "?rewritten"
+	})
+
+	assert.Equal(t, []string{"/img/1", "2", "/img/3"}, relations)
+	assert.Equal(t, `{"images": ["/img/1?rewritten", {"title": "cover"}, 2, "/img/3?rewritten"]}`, string(result))
+}
+
+func TestTraverseJSONObjectWildcard(t *testing.T) {
+	n := &node{}
+	n.importPointers(preload, httpsfv.List{httpsfv.NewItem("/translations/*/author")}, -1)
+	n.importPointers(fields, httpsfv.List{httpsfv.NewItem("/translations/*/author")}, -1)
+
+	var relations []string
+	result := New().traverseJSON([]byte(`{"title": "1984", "translations": {"en": {"title": "1984", "author": "/authors/1"}, "fr": {"title": "1984", "author": "/authors/2"}}}`), n, true, func(n Node, v string) string {
+		relations = append(relations, v)
+
+		return v + "?lang"
+	})
+
+	assert.Equal(t, `{"translations":{"en":{"author":"/authors/1?lang"},"fr":{"author":"/authors/2?lang"}}}`, string(result))
+	assert.Equal(t, []string{"/authors/1", "/authors/2"}, relations)
+}
+
+func TestTraverseJSONObjectWildcardSpecialKeys(t *testing.T) {
+	doc := `{"translations": {"en.US": {"author": "/authors/1"}, "fr|FR": {"author": "/authors/2"}, "a\\b": {"author": "/authors/3"}}}`
+
+	for _, filter := range []bool{true, false} {
+		n := &node{}
+		n.importPointers(preload, httpsfv.List{httpsfv.NewItem("/translations/*/author")}, -1)
+		if filter {
+			n.importPointers(fields, httpsfv.List{httpsfv.NewItem("/translations/*/author")}, -1)
+		}
+
+		var relations []string
+		result := New().traverseJSON([]byte(doc), n, filter, func(n Node, v string) string {
+			relations = append(relations, v)
+
+			return v + "?lang"
+		})
+
+		assert.JSONEq(t, `{"translations": {"en.US": {"author": "/authors/1?lang"}, "fr|FR": {"author": "/authors/2?lang"}, "a\\b": {"author": "/authors/3?lang"}}}`, string(result))
+		assert.Equal(t, []string{"/authors/1", "/authors/2", "/authors/3"}, relations)
+	}
+}
+
+func TestTraverseJSONInlineRefs(t *testing.T) {
+	n := &node{}
+	n.importPointers(preload, httpsfv.List{httpsfv.NewItem("/author"), httpsfv.NewItem("/related"), httpsfv.NewItem("/missing")}, -1)
+	n.importPointers(fields, httpsfv.List{httpsfv.NewItem("/author/name"), httpsfv.NewItem("/related"), httpsfv.NewItem("/missing")}, -1)
+
+	doc := `{"author": "#/definitions/a~1b", "related": "/books/2", "missing": "#/notexists", "definitions": {"a/b": {"name": "Orwell", "born": 1903}}}`
+
+	var relations []string
+	result := New(WithInlineRefs()).traverseJSON([]byte(doc), n, true, func(n Node, v string) string {
+		relations = append(relations, v)
+
+		return ""
+	})
+
+	assert.Equal(t, []string{"Orwell", "/books/2", "#/notexists"}, relations)
+	assert.Equal(t, `{"author":{"name":"Orwell"},"related":"/books/2","missing":"#/notexists"}`, string(result))
+
+	relations = nil
+	New().traverseJSON([]byte(doc), n, true, func(n Node, v string) string {
+		relations = append(relations, v)
+
+		return ""
+	})
+	assert.Equal(t, []string{"#/definitions/a~1b", "/books/2", "#/notexists"}, relations)
+}
+
+func TestTraverseJSONNegatedFields(t *testing.T) {
+	n := &node{}
+	n.importPointers(fields, httpsfv.List{httpsfv.NewItem("!/password"), httpsfv.NewItem("!/friends/*/email"), httpsfv.NewItem("!/notexist")}, -1)
+
+	result := New().traverseJSON([]byte(`{"name": "Kévin", "password": "secret", "friends": [{"name": "a", "email": "a@example.com"}, {"name": "b"}]}`), n, false, urlRewriteRelationHandler)
+	assert.Equal(t, `{"name": "Kévin", "friends": [{"name": "a"}, {"name": "b"}]}`, string(result))
+}
+
+func TestTraverseJSONHAL(t *testing.T) {
+	n := &node{}
+	n.importPointers(preload, httpsfv.List{httpsfv.NewItem("/_links/author"), httpsfv.NewItem("/_links/item/*")}, -1)
+	n.importPointers(fields, httpsfv.List{httpsfv.NewItem("/_links/author"), httpsfv.NewItem("/_links/item")}, -1)
+
+	doc := `{"title": "1984", "_links": {"self": {"href": "/books/1"}, "author": {"href": "/authors/1", "title": "Orwell"}, "item": [{"href": "/items/1"}, {"href": "/items/2"}]}}`
+
+	var relations []string
+	result := New(WithHALSupport()).traverseJSON([]byte(doc), n, true, func(n Node, v string) string {
+		relations = append(relations, v)
+
+		return v + "?rewritten"
+	})
+
+	assert.Equal(t, []string{"/authors/1", "/items/1", "/items/2"}, relations)
+	assert.Equal(t, `{"_links":{"author":{"href": "/authors/1?rewritten", "title": "Orwell"},"item":[{"href": "/items/1?rewritten"}, {"href": "/items/2?rewritten"}]}}`, string(result))
+
+	relations = nil
+	New().traverseJSON([]byte(doc), n, true, func(n Node, v string) string {
+		relations = append(relations, v)
+
+		return ""
+	})
+	assert.Empty(t, relations)
+}
@@ -7,314 +7,2701 @@
 package vulcain
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"io"
+	"mime"
 	"net/http"
 	"net/url"
+	"path"
 	"regexp"
+	"runtime/debug"
+	"slices"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/dunglas/httpsfv"
+	"github.com/getkin/kin-openapi/openapi3"
 	"github.com/getkin/kin-openapi/routers"
+	"github.com/gofrs/uuid"
+	"golang.org/x/net/http/httpguts"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
 var (
 	jsonRe        = regexp.MustCompile(`(?i)\bjson\b`)
 	preferRe      = regexp.MustCompile(`\s*selector="?json-pointer"?`)
+	minimalRe     = regexp.MustCompile(`(?i)\breturn\s*=\s*"?minimal"?`)
 	notransformRe = regexp.MustCompile(`\bno-transform\b`)
+	privateRe     = regexp.MustCompile(`(?i)\b(private|no-store)\b`)
 )
 
+// ErrBodyTooLarge occurs when the response body is larger than the limit set using WithMaxBodySize
+var ErrBodyTooLarge = errors.New("response body too large")
+
+// ErrFieldNotFound occurs when a value targeted by a "fields" selector is missing from the document, only in strict mode (see WithStrictFields)
+var ErrFieldNotFound = errors.New("field not found")
+
+// FieldError occurs when a value targeted by a "fields" selector is missing from the document
+type FieldError struct {
+	// Selector is the JSON pointer of the missing value
+	Selector string
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("value matched by %q not found", e.Selector)
+}
+
+func (e *FieldError) Unwrap() error {
+	return ErrFieldNotFound
+}
+
+// ErrInvalidDirective occurs when a "preload" or "fields" directive isn't a valid structured field list, only in strict mode (see WithStrictDirectives)
+var ErrInvalidDirective = errors.New("invalid directive")
+
+// DirectiveError occurs when a "preload" or "fields" directive cannot be parsed
+type DirectiveError struct {
+	// Directive is the name of the invalid directive ("preload" or "fields")
+	Directive string
+	// Source is where the directive comes from (DirectiveSourceHeader or DirectiveSourceQuery)
+	Source string
+	// Err is the parsing error
+	Err error
+}
+
+func (e *DirectiveError) Error() string {
+	return fmt.Sprintf("invalid %q directive (%s): %s", e.Directive, e.Source, e.Err)
+}
+
+func (e *DirectiveError) Unwrap() error {
+	return ErrInvalidDirective
+}
+
+// ErrPanicRecovered occurs when a panic has been recovered while applying the directives, only if WithPanicRecovery is used
+var ErrPanicRecovered = errors.New("panic recovered")
+
+// PanicError occurs when a panic has been recovered while applying the directives
+type PanicError struct {
+	// Value is the value passed to panic
+	Value interface{}
+	// Stack is the stack trace of the goroutine that panicked
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic recovered: %v", e.Value)
+}
+
+func (e *PanicError) Unwrap() error {
+	return ErrPanicRecovered
+}
+
+// ApplyError occurs when a relation matched by a directive cannot be handled
+type ApplyError struct {
+	// Selector is the JSON pointer of the node matching the relation
+	Selector string
+	// Relation is the raw value of the relation
+	Relation string
+	// Err is the underlying error
+	Err error
+}
+
+func (e *ApplyError) Error() string {
+	return fmt.Sprintf("cannot handle relation %q matched by %q: %s", e.Relation, e.Selector, e.Err)
+}
+
+func (e *ApplyError) Unwrap() error {
+	return e.Err
+}
+
+// ApplyStats describes the changes made by Apply to a response
+type ApplyStats struct {
+	// RelationCount is the number of relations matched by the Preload directive
+	RelationCount int
+	// PushedCount is the number of relations pushed using HTTP/2 Server Push
+	PushedCount int
+	// PreloadedCount is the number of Link rel=preload headers added to the response
+	PreloadedCount int
+	// BodyModified is true if the returned body differs from the upstream one
+	BodyModified bool
+	// Decisions contains what would have been done for every relation matched by the Preload directive, only in dry-run mode
+	Decisions []PushDecision
+}
+
+// PushAction is what is done for a relation matched by the Preload directive
+type PushAction string
+
+const (
+	// PushActionPush means that the relation is pushed using HTTP/2 Server Push
+	PushActionPush PushAction = "would-push"
+	// PushActionPreload means that a Link rel=preload header is added for the relation
+	PushActionPreload PushAction = "would-preload"
+	// PushActionSkippedAbsolute means that the relation is an absolute URL, a Link rel=preload header with the nopush attribute is added
+	PushActionSkippedAbsolute PushAction = "skipped-absolute"
+	// PushActionSkippedHost means that the host of the relation isn't allowed (see WithAllowedPushHosts)
+	PushActionSkippedHost PushAction = "skipped-host"
+	// PushActionSkippedMethod means that the OpenAPI operation of the relation doesn't use the GET method, a Link rel=preload header with the nopush attribute is added
+	PushActionSkippedMethod PushAction = "skipped-method"
+	// PushActionSkippedPrivate means that the response is private (see WithRespectCacheControl), a Link rel=preload header with the nopush attribute is added
+	PushActionSkippedPrivate PushAction = "skipped-private"
+	// PushActionSkippedNopush means that the client used the nopush parameter, a Link rel=preload header with the nopush attribute is added
+	PushActionSkippedNopush PushAction = "skipped-nopush"
+	// PushActionSkippedPolicy means that the push policy or the push decider chose to preload the relation, a Link rel=preload header with the nopush attribute is added
+	PushActionSkippedPolicy PushAction = "skipped-policy"
+	// PushActionMaxExceeded means that the maximum number of pushes is reached
+	PushActionMaxExceeded PushAction = "max-exceeded"
+	// PushActionMaxBytesExceeded means that the maximum size of the pushed resources is reached (see WithMaxPushedBytes)
+	PushActionMaxBytesExceeded PushAction = "max-bytes-exceeded"
+)
+
+// PushDecision is the action decided for a relation in dry-run mode
+type PushDecision struct {
+	// Selector is the JSON pointer of the node matching the relation
+	Selector string
+	// Relation is the resolved URL of the relation
+	Relation string
+	// Action is what would have been done
+	Action PushAction
+}
+
 // Option instances allow to configure the library
 type Option func(o *opt)
 
-// WithOpenAPIFile sets the path to an OpenAPI definition (in YAML or JSON) documenting the relations between resources
-// This option is only useful for non-hypermedia APIs
-func WithOpenAPIFile(openAPIFile string) Option {
-	return func(o *opt) {
-		o.openAPIFile = openAPIFile
+// WithOpenAPIFile sets the path to an OpenAPI definition (in YAML or JSON) documenting the relations between resources
+// This option is only useful for non-hypermedia APIs
+func WithOpenAPIFile(openAPIFile string) Option {
+	return func(o *opt) {
+		o.openAPIFile = openAPIFile
+	}
+}
+
+// WithOpenAPIRouter sets the function creating the router used to match the operations of an OpenAPI definition (e.g. a faster one for large definitions, such as the gorillamux router of kin-openapi)
+// It's called every time a definition is loaded or reloaded. The servers of the definition are removed before creating the router, they are matched by Vulcain.
+// The router of kin-openapi (legacy.NewRouter) is used by default.
+func WithOpenAPIRouter(newRouter func(spec *openapi3.T) (routers.Router, error)) Option {
+	return func(o *opt) {
+		o.openAPIRouter = newRouter
+	}
+}
+
+// WithOpenAPIFiles sets the paths to several OpenAPI definitions (in YAML or JSON) documenting the relations between resources
+// This is useful for gateways in front of several services, each one having its own definition
+// The definitions are merged, if the same path is documented in several files a warning is logged and the first file wins
+func WithOpenAPIFiles(openAPIFiles ...string) Option {
+	return func(o *opt) {
+		o.openAPIFiles = openAPIFiles
+	}
+}
+
+// WithOpenAPIURL sets the URL of an OpenAPI definition (in YAML or JSON) documenting the relations between resources
+// The definition is fetched when calling New, if it cannot be fetched or parsed an error is logged and the OpenAPI definition isn't used until Reload succeeds
+func WithOpenAPIURL(openAPIURL string) Option {
+	return func(o *opt) {
+		o.openAPIURL = openAPIURL
+	}
+}
+
+// WithEarlyHints instructs the gateway server to send Preload hints in 103 Early Hints response.
+// Enabling this setting is usually useless unless JSON streaming is enabled (see WithJSONStreaming),
+// otherwise the server will have to wait for the full JSON response to be received from upstream before being able
+// to compute the Link headers to send.
+// When the full response is available, we can send the final response directly.
+// Better send Early Hints responses as soon as possible, directly from the upstream application.
+// The proxy will forward them even if this option is not enabled.
+func WithEarlyHints() Option {
+	return func(o *opt) {
+		o.enableEarlyHints = true
+	}
+}
+
+// WithMaxPushes sets the maximum number of resources to push
+// It also caps the number of relations matched by wildcard selectors (e.g. "/members/*") that are pushed per response, the other ones are preloaded with the nopush attribute.
+// There is no limit by default
+func WithMaxPushes(maxPushes int) Option {
+	return func(o *opt) {
+		o.maxPushes = maxPushes
+	}
+}
+
+// WithLogger sets the logger to use
+func WithLogger(logger *zap.Logger) Option {
+	return func(o *opt) {
+		o.logger = logger
+	}
+}
+
+func WithApiUrl(apiUrl string) Option {
+	return func(o *opt) {
+		o.apiUrl = apiUrl
+	}
+}
+
+// WithMaxPushDepth sets the maximum depth (number of JSON pointer segments) of the "preload" directive to honor
+// Deeper selectors are ignored. There is no limit by default
+func WithMaxPushDepth(maxPushDepth int) Option {
+	return func(o *opt) {
+		o.maxPushDepth = maxPushDepth
+	}
+}
+
+// WithTracer sets the OpenTelemetry tracer used to create spans around Apply, the traversal of the document and every push
+// The spans are children of the span stored in the context of the request, if any. Default to a no-op tracer
+func WithTracer(tracer trace.Tracer) Option {
+	return func(o *opt) {
+		o.tracer = tracer
+	}
+}
+
+// WithMetrics sets the Metrics implementation to use to collect statistics about pushes
+func WithMetrics(metrics Metrics) Option {
+	return func(o *opt) {
+		o.metrics = metrics
+	}
+}
+
+// WithJSONProcessor sets the JSONProcessor to use to traverse and modify JSON documents
+func WithJSONProcessor(jsonProcessor JSONProcessor) Option {
+	return func(o *opt) {
+		o.jsonProcessor = jsonProcessor
+	}
+}
+
+// WithHALSupport enables the support for HAL (https://stateless.group/hal_specification.html) links:
+// when a selector matches a link object (e.g. "/_links/author"), the value of its "href" property is used as the relation
+func WithHALSupport() Option {
+	return func(o *opt) {
+		o.halSupport = true
+	}
+}
+
+// WithJSONAPISupport enables the support for JSON:API (https://jsonapi.org) documents:
+// selectors target the members of the primary resources, "/author" matches the related link of the "author" relationship
+// and the "fields" directive filters the attributes and relationships. It has no effect if WithJSONProcessor is used
+func WithJSONAPISupport() Option {
+	return func(o *opt) {
+		o.jsonAPISupport = true
+	}
+}
+
+// WithAllowedPushHosts restricts the hosts of the relations to push or to preload
+// Relative relations are resolved against the API URL if set, or against the host of the request.
+// Relations pointing to other hosts are ignored. All hosts are allowed by default
+func WithAllowedPushHosts(hosts ...string) Option {
+	return func(o *opt) {
+		o.allowedPushHosts = make(map[string]struct{}, len(hosts))
+		for _, h := range hosts {
+			o.allowedPushHosts[strings.ToLower(h)] = struct{}{}
+		}
+	}
+}
+
+// WithTransformableStatuses sets the HTTP status codes of the responses that can be transformed
+// By default, all 2xx responses can be transformed
+func WithTransformableStatuses(codes ...int) Option {
+	return func(o *opt) {
+		o.transformableStatuses = make(map[int]struct{}, len(codes))
+		for _, c := range codes {
+			o.transformableStatuses[c] = struct{}{}
+		}
+	}
+}
+
+// WithCoalescedLinkHeader instructs Apply to emit all the Link rel=preload headers it generates as a single comma-separated header
+func WithCoalescedLinkHeader() Option {
+	return func(o *opt) {
+		o.coalesceLinkHeader = true
+	}
+}
+
+// WithInternalRequestHeader sets the name of the header used to tag pushed requests
+// It defaults to Vulcain-Explicit-Request
+func WithInternalRequestHeader(name string) Option {
+	return func(o *opt) {
+		o.internalRequestHeader = name
+	}
+}
+
+// WithJSONStreaming instructs Apply to push relations, and to send Early Hints if enabled,
+// as soon as they are encountered while reading the response body, instead of waiting for the full document
+func WithJSONStreaming() Option {
+	return func(o *opt) {
+		o.jsonStreaming = true
+	}
+}
+
+// WithMaxLinkHeaderBytes sets the maximum cumulative size, in bytes, of the values of the Link headers of a response.
+// Browsers and proxies may reject responses with oversized headers: once the limit would be exceeded, no more Link rel=preload headers are added
+// and the number of dropped headers is logged. The Link headers sent by the upstream server are included in the size, unless WithCoalescedLinkHeader is set.
+func WithMaxLinkHeaderBytes(n int) Option {
+	return func(o *opt) {
+		o.maxLinkHeaderBytes = n
+	}
+}
+
+// WithPreconnect adds a Link rel=preconnect header for the origin of the cross-origin relations (absolute URLs), in addition to the Link rel=preload header.
+// It allows the browser to establish the connection early. A single header is added per origin.
+func WithPreconnect() Option {
+	return func(o *opt) {
+		o.preconnect = true
+	}
+}
+
+// WithNopushByDefault adds the nopush attribute to all Link rel=preload headers (https://www.w3.org/TR/preload/#server-push-http-2)
+// It's useful when a downstream server or CDN performs its own push decisions
+func WithNopushByDefault() Option {
+	return func(o *opt) {
+		o.nopushByDefault = true
+	}
+}
+
+// RelationResolver turns the value of a field matched by a selector into the URL of the relation
+// It returns false to fall back to the default resolution (using OpenAPI or the literal URL)
+type RelationResolver func(selector, value string) (string, bool)
+
+// WithRelationResolver sets a function to resolve relations before using OpenAPI or the literal URL
+func WithRelationResolver(relationResolver RelationResolver) Option {
+	return func(o *opt) {
+		o.relationResolver = relationResolver
+	}
+}
+
+// WithMaxBodySize sets the maximum size (in bytes) of the response bodies to transform
+// Apply returns ErrBodyTooLarge when the limit is exceeded. There is no limit by default
+func WithMaxBodySize(maxBodySize int64) Option {
+	return func(o *opt) {
+		o.maxBodySize = maxBodySize
+	}
+}
+
+// WithRequestIDHeader sets the name of the request header containing an ID used to correlate the logs of a request
+// If the header is missing, or if this option isn't set, an ID is generated
+// Pushed requests always use the ID of their explicit request
+func WithRequestIDHeader(name string) Option {
+	return func(o *opt) {
+		o.requestIDHeader = name
+	}
+}
+
+// WithPushTimeout sets the maximum duration to wait for a server push to be initiated
+// When the timeout expires, a Link rel=preload header is added instead, and Finish stops waiting for this push
+func WithPushTimeout(d time.Duration) Option {
+	return func(o *opt) {
+		o.pushTimeout = d
+	}
+}
+
+// WithDryRun traverses the responses and resolves the relations without pushing them or modifying the response headers
+// The decisions taken for every relation are reported in ApplyStats.Decisions, the returned body is still transformed
+func WithDryRun() Option {
+	return func(o *opt) {
+		o.dryRun = true
+	}
+}
+
+// VaryPolicy controls the Vary headers added by Apply
+type VaryPolicy int
+
+const (
+	// VaryPreload adds Preload to the Vary header when preload links are used
+	VaryPreload VaryPolicy = 1 << iota
+	// VaryFields adds Fields to the Vary header when the Fields header is used
+	VaryFields
+	// VaryMerged adds all values in a single Vary header instead of one header per value
+	VaryMerged
+)
+
+// WithVaryPolicy sets the Vary headers to add to the transformed responses
+// Some CDNs disable caching when they encounter unknown Vary values.
+// Default to VaryPreload | VaryFields
+func WithVaryPolicy(policy VaryPolicy) Option {
+	return func(o *opt) {
+		o.varyPolicy = policy
+	}
+}
+
+// LinkRelFunc returns the link relation type and the "as" attribute to use in the Link header for the given relation
+// If as is empty, the attribute is omitted
+type LinkRelFunc func(relation string) (rel, as string)
+
+// WithPreloadLinkRel sets the function computing the link relation type and the "as" attribute of the Link headers
+// Default to rel=preload and as=fetch for all relations
+func WithPreloadLinkRel(f LinkRelFunc) Option {
+	return func(o *opt) {
+		o.linkRel = f
+	}
+}
+
+// WithEarlyHintsBatchSize sends the Link headers in several 103 Early Hints responses containing at most n Link headers,
+// as soon as they are computed, instead of a single one when the whole response is processed
+// It has no effect unless WithEarlyHints is set, WithJSONStreaming already sends the Link headers as soon as possible
+func WithEarlyHintsBatchSize(n int) Option {
+	return func(o *opt) {
+		o.earlyHintsBatchSize = n
+	}
+}
+
+// WithInlineRefs replaces the relations referencing another part of the same document (e.g. #/definitions/x) by the referenced value
+// instead of pushing them. References contained in the inlined values aren't resolved.
+func WithInlineRefs() Option {
+	return func(o *opt) {
+		o.inlineRefs = true
+	}
+}
+
+// WithFieldTransformer sets a function transforming the string values matched by the JSON pointer (e.g. to mask emails)
+// The pointer uses the same syntax as the selectors ("*" matches all elements of an array or all values of an object).
+// The values are transformed during the same traversal as the directives, unless they are removed by the "fields" directive.
+// Only the responses accepted by IsValidResponse to requests carrying directives (or to all requests if WithDefaultFields or WithDefaultPreload is used) are transformed:
+// it's not a security boundary, sensitive data must not be sent by the upstream.
+// It can be used several times.
+func WithFieldTransformer(pointer string, fn func(value string) string) Option {
+	return func(o *opt) {
+		o.fieldTransformers = append(o.fieldTransformers, fieldTransformer{pointer, fn})
+	}
+}
+
+// fieldTransformer is a transformer set using WithFieldTransformer
+type fieldTransformer struct {
+	pointer string
+	fn      func(value string) string
+}
+
+// WithRootPointer prefixes all the selectors of the "preload" and "fields" directives with the given JSON pointer,
+// so clients can omit it (e.g. "/data" for GraphQL responses: "/user/avatarUrl" then matches "/data/user/avatarUrl").
+// It also applies to the defaults and to the directives forwarded to the pushed relations, but not to the pointers set using other options.
+// The segments of the root pointer count toward the limit set using WithMaxPushDepth.
+func WithRootPointer(pointer string) Option {
+	return func(o *opt) {
+		o.rootPointer = pointer
+	}
+}
+
+// WithEmbeddedJSON parses the string values matched by the JSON pointer as JSON documents (e.g. "payload": "{\"author\": \"/authors/1\"}"),
+// applies the directives to them and encodes them back to strings. It's useful for legacy APIs double-encoding sub-documents.
+// The pointer uses the same syntax as the selectors ("*" matches all elements of an array or all values of an object). It can be used several times.
+func WithEmbeddedJSON(pointer string) Option {
+	return func(o *opt) {
+		o.embeddedJSON = append(o.embeddedJSON, pointer)
+	}
+}
+
+// WithPanicRecovery makes Apply recover from the panics occurring while applying the directives (e.g. in a RelationResolver or a JSONProcessor)
+// The panic is logged with its stack trace and a *PanicError is returned, the response headers are restored and the response must then be sent untransformed
+func WithPanicRecovery() Option {
+	return func(o *opt) {
+		o.panicRecovery = true
+	}
+}
+
+// WithOpenAPIContentNegotiation sets the Accept header of the pushed requests to the media type, documented in the OpenAPI definition
+// for the relation, preferred by the client. If none of the documented types is acceptable, the Accept header of the client is used as is.
+func WithOpenAPIContentNegotiation() Option {
+	return func(o *opt) {
+		o.openAPIContentNegotiation = true
+	}
+}
+
+// WithoutURLRewriting prevents Apply from rewriting the values of the relations, even when the directives are sent using query parameters
+// The returned body is left unchanged, except for the filtering of the fields, and the directives are propagated to pushes using headers
+func WithoutURLRewriting() Option {
+	return func(o *opt) {
+		o.withoutURLRewriting = true
+	}
+}
+
+// WithCanonicalPushURL pushes the URLs of the relations without the "preload" and "fields" query parameters added by Apply, the directives are sent using headers instead
+// The values of the relations in the returned body are still rewritten, the Link rel=preload headers contain the canonical URLs.
+// It prevents upstreams treating query parameters as cache-busting to compute the same resources twice
+func WithCanonicalPushURL() Option {
+	return func(o *opt) {
+		o.canonicalPushURL = true
+	}
+}
+
+// WithOpenAPIQueryRewrite propagates the "preload" and "fields" query parameters to the URLs of the relations resolved using OpenAPI
+// By default, the values of these relations are left untouched and the directives are only propagated to pushes using headers
+func WithOpenAPIQueryRewrite() Option {
+	return func(o *opt) {
+		o.openAPIQueryRewrite = true
+	}
+}
+
+// WithShouldPush sets a function called before pushing every relation
+// If it returns false, a Link rel=preload header with the nopush attribute is added instead
+func WithShouldPush(f func(u *url.URL) bool) Option {
+	return func(o *opt) {
+		o.shouldPush = f
+	}
+}
+
+// PushMode tells how a relation must be sent to the client
+type PushMode int
+
+const (
+	// PushModePush pushes the relation using HTTP/2 Server Push when possible
+	PushModePush PushMode = iota
+	// PushModePreload adds a Link rel=preload header with the nopush attribute instead of pushing the relation
+	PushModePreload
+)
+
+// FetchMetadataPushDecider is a push decider (see WithPushDecider) using the Fetch Metadata request headers:
+// relations are pushed for navigations, and preloaded for requests sent using fetch() or XMLHttpRequest (Sec-Fetch-Dest: empty).
+// Relations are pushed for clients not sending these headers.
+func FetchMetadataPushDecider(req *http.Request, _ *url.URL) PushMode {
+	if strings.EqualFold(req.Header.Get("Sec-Fetch-Mode"), "navigate") {
+		return PushModePush
+	}
+
+	if strings.EqualFold(req.Header.Get("Sec-Fetch-Dest"), "empty") {
+		return PushModePreload
+	}
+
+	return PushModePush
+}
+
+// WithOnPushLimitReached sets a function called when relations are preloaded using Link headers instead of being pushed because the limit set using WithMaxPushes (or x-vulcain-max-pushes) has been reached
+// It's called at most once per Apply call, dropped is the number of relations downgraded, it allows to tune the limit based on real traffic
+func WithOnPushLimitReached(f func(req *http.Request, dropped int)) Option {
+	return func(o *opt) {
+		o.onPushLimitReached = f
+	}
+}
+
+// WithPushDecider sets a function called before pushing every relation, it receives the request and the relation
+// It allows to tailor the behavior to the intent of the client, see FetchMetadataPushDecider
+func WithPushDecider(f func(req *http.Request, u *url.URL) PushMode) Option {
+	return func(o *opt) {
+		o.pushDecider = f
+	}
+}
+
+// WithMaxPushedBytes limits the cumulated size of the resources pushed for a response
+// estimate returns the expected size of the resource, or a negative value if it's unknown (unknown sizes aren't counted).
+// Relations exceeding the budget are preloaded using a Link rel=preload header with the nopush attribute instead
+func WithMaxPushedBytes(max int64, estimate func(u *url.URL) int64) Option {
+	return func(o *opt) {
+		o.maxPushedBytes = max
+		o.estimatePushSize = estimate
+	}
+}
+
+// WithUserAgentFilter sets a function called with the User-Agent of every request
+// If it returns false, the request isn't handled by Vulcain and the response is sent untouched (useful for crawlers)
+func WithUserAgentFilter(f func(ua string) bool) Option {
+	return func(o *opt) {
+		o.userAgentFilter = f
+	}
+}
+
+// WithServerTiming adds Server-Timing entries (https://www.w3.org/TR/server-timing/) to the response, to surface the overhead of Vulcain in the browser developer tools:
+// vulcain-parse (parsing the directives and reading the body) and vulcain-traverse (traversing the document) are added by Apply to the response headers.
+// vulcain-push (waiting for the PUSH_PROMISEs to be sent) is added by Finish as a trailer (using http.TrailerPrefix) to the headers of the http.ResponseWriter passed to Apply,
+// the request context must have been created using CreateRequestContext.
+// Trailers are only sent using chunked encoding (HTTP/1.1) or HTTP/2 and later: the vulcain-push entry is skipped for HTTP/1 responses having a Content-Length header.
+func WithServerTiming() Option {
+	return func(o *opt) {
+		o.serverTiming = true
+	}
+}
+
+// WithSkipPaths sets glob patterns (using the syntax of path.Match, e.g. "/metrics" or "/downloads/*") matching the paths of the requests never handled by Vulcain,
+// even if they contain directives: IsValidRequest returns false and the response is sent untouched. It can be used several times.
+// Invalid patterns are logged and ignored.
+func WithSkipPaths(patterns ...string) Option {
+	return func(o *opt) {
+		o.skipPaths = append(o.skipPaths, patterns...)
+	}
+}
+
+// WithPushConcurrency sets the maximum number of relations pushed in parallel for a response
+// By default, relations are pushed one after the other
+func WithPushConcurrency(n int) Option {
+	return func(o *opt) {
+		o.pushConcurrency = n
+	}
+}
+
+// WithoutContentLength prevents Apply from setting the Content-Length header of the transformed response
+// The stale Content-Length header is removed if the body is modified, the caller is then responsible for setting it, or for using another transfer encoding
+func WithoutContentLength() Option {
+	return func(o *opt) {
+		o.withoutContentLength = true
+	}
+}
+
+// WithRespectCacheControl prevents pushing the relations of responses marked as private or no-store using the Cache-Control header
+// Link rel=preload headers with the nopush attribute are added instead
+func WithRespectCacheControl() Option {
+	return func(o *opt) {
+		o.respectCacheControl = true
+	}
+}
+
+// WithNDJSONSupport enables the support of newline-delimited JSON responses (e.g. application/x-ndjson or application/jsonl)
+// The directives are applied to every line independently, the limits (such as the maximum number of pushes) apply to the whole response
+func WithNDJSONSupport() Option {
+	return func(o *opt) {
+		o.ndjsonSupport = true
+	}
+}
+
+// WithMaxSelectors limits the number of nodes of the tree built from the "preload" and "fields" directives
+// For instance, "/author/name" and "/author/email" count as 3 nodes. Apply returns ErrTooManySelectors if the limit is exceeded.
+// It protects against clients sending thousands of selectors.
+func WithMaxSelectors(n int) Option {
+	return func(o *opt) {
+		o.maxSelectors = n
+	}
+}
+
+// WithPropagateCacheControl copies the Cache-Control directives of the explicit response to the requests of the pushed relations
+// The max-age, s-maxage, must-revalidate, proxy-revalidate, no-cache and no-transform directives are copied,
+// other ones (e.g. private, public, no-store or immutable) only apply to the explicit response and are stripped.
+// Directives sent by the client take precedence.
+func WithPropagateCacheControl() Option {
+	return func(o *opt) {
+		o.propagateCacheControl = true
+	}
+}
+
+// WithPushCircuitBreaker stops pushing after failures consecutive push failures, for the cooldown duration
+// While the circuit is open, Link rel=preload headers are added instead
+func WithPushCircuitBreaker(failures int, cooldown time.Duration) Option {
+	return func(o *opt) {
+		o.pushCircuitBreakerFailures = failures
+		o.pushCircuitBreakerCooldown = cooldown
+	}
+}
+
+// WithBufferPool reuses the buffers used to read the upstream responses across requests, to reduce allocations
+// The buffers are released by Finish: the body returned by Apply must not be used after calling Finish
+func WithBufferPool() Option {
+	return func(o *opt) {
+		o.bufferPool = true
+	}
+}
+
+// WithCBORSupport enables the support for CBOR responses (application/cbor and +cbor content types)
+// CBOR documents are converted to JSON to be traversed, the "preload" and "fields" directives work as for JSON documents
+// Documents containing values without JSON equivalent (byte strings, tags, integral floats...) aren't transformed: Apply returns ErrLossyCBOR
+// JSON streaming (see WithJSONStreaming) isn't supported for CBOR responses
+func WithCBORSupport() Option {
+	return func(o *opt) {
+		o.cborSupport = true
+	}
+}
+
+// RedirectPolicy controls how redirect (3xx) responses are handled
+type RedirectPolicy int
+
+const (
+	// RedirectIgnore doesn't transform redirect responses, unless their status code is passed to WithTransformableStatuses
+	RedirectIgnore RedirectPolicy = iota
+	// RedirectFilterFields transforms redirect responses according to the "fields" directive, relations are never pushed nor preloaded
+	RedirectFilterFields
+)
+
+// WithRedirectPolicy sets how redirect (3xx) responses are handled
+// Regardless of the policy, relations contained in redirect responses are never pushed nor preloaded
+// Default to RedirectIgnore
+func WithRedirectPolicy(policy RedirectPolicy) Option {
+	return func(o *opt) {
+		o.redirectPolicy = policy
+	}
+}
+
+// WithStrictFields instructs Apply to return a *FieldError for every "fields" selector targeting a value missing from the document
+// By default, such selectors are silently ignored. The filtered document is still returned along with the errors
+func WithStrictFields() Option {
+	return func(o *opt) {
+		o.strictFields = true
+	}
+}
+
+// WithRelationPathPrefix adds a prefix (e.g. /api/v2) to the path of the relations, for APIs exposed to clients under a different path than the upstream one
+// Only root-relative relations (e.g. /books/1) are rewritten, absolute URLs, relative paths and paths already starting with the prefix are left untouched
+// The relations are rewritten in the response body, as well as in the pushes and Link headers
+func WithRelationPathPrefix(prefix string) Option {
+	return func(o *opt) {
+		if prefix = strings.Trim(prefix, "/"); prefix != "" {
+			o.relationPathPrefix = "/" + prefix
+		}
+	}
+}
+
+// WithPushHeaderFilter sets a function allowing to modify the headers of the requests sent in PUSH_PROMISE frames
+// The headers are copied from the explicit request, the Preload, Fields and TE headers are removed before calling the filter
+// For instance, it can remove the Authorization and Cookie headers if the pushed resources have different access rules
+func WithPushHeaderFilter(filter func(h http.Header)) Option {
+	return func(o *opt) {
+		o.pushHeaderFilter = filter
+	}
+}
+
+// WithPreserveBOM keeps the UTF-8 byte order mark at the beginning of the transformed JSON documents
+// The BOM is always stripped before traversing the document, by default it isn't added back as recommended by RFC 8259
+func WithPreserveBOM() Option {
+	return func(o *opt) {
+		o.preserveBOM = true
+	}
+}
+
+// WithRelationFieldPattern sets a regular expression matching the names of the fields containing relations (e.g. `(Url|Href)$` for "authorUrl" and "coverHref").
+// The "~r" segment of a "preload" selector then matches the fields of an object whose names match the pattern and whose values are strings (e.g. "/~r" or "/members/*/~r"),
+// instead of enumerating them. The number of relations matched this way is bounded by WithMaxPushes, as for wildcard selectors.
+// An invalid pattern is logged and ignored.
+func WithRelationFieldPattern(re string) Option {
+	return func(o *opt) {
+		o.relationFieldPattern = re
+	}
+}
+
+// WithDefaultFields sets the "fields" directive applied when the request contains neither a "fields" nor a "preload" directive.
+// The list uses the same syntax as the Fields HTTP header (e.g. `"/title", "/author"`).
+func WithDefaultFields(list string) Option {
+	return func(o *opt) {
+		o.defaultFields = list
+	}
+}
+
+// WithDefaultPreload sets the "preload" directive applied when the request contains neither a "fields" nor a "preload" directive.
+// The list uses the same syntax as the Preload HTTP header (e.g. `"/author", "/related/*"`).
+func WithDefaultPreload(list string) Option {
+	return func(o *opt) {
+		o.defaultPreload = list
+	}
+}
+
+// WithPreferMinimal honors the "Prefer: return=minimal" request header (RFC 7240) when the request has no "fields" directive:
+// the fields set for the operation using the x-vulcain-minimal-fields OpenAPI extension, or the ones set using WithDefaultFields, are kept.
+// The Preference-Applied response header is set when the preference is honored.
+func WithPreferMinimal() Option {
+	return func(o *opt) {
+		o.preferMinimal = true
+	}
+}
+
+// WithTransformableContentTypes sets the media types (e.g. application/json or application/ld+json) of the responses that can be transformed
+// By default, all media types containing the word "json" can be transformed, including application/problem+json
+// Parameters such as charset are ignored, and CBOR responses are still handled according to WithCBORSupport
+func WithTransformableContentTypes(types ...string) Option {
+	return func(o *opt) {
+		o.transformableContentTypes = make(map[string]struct{}, len(types))
+		for _, t := range types {
+			o.transformableContentTypes[mediaType(t)] = struct{}{}
+		}
+	}
+}
+
+// WithStrictDirectives makes Apply return a DirectiveError when a "preload" or "fields" directive is malformed, instead of ignoring it
+// Handler replies with a 400 Bad Request status code to such requests
+func WithStrictDirectives() Option {
+	return func(o *opt) {
+		o.strictDirectives = true
+	}
+}
+
+type opt struct {
+	openAPIFile                string
+	openAPIFiles               []string
+	openAPIURL                 string
+	enableEarlyHints           bool
+	maxPushes                  int
+	maxPushDepth               int
+	apiUrl                     string
+	logger                     *zap.Logger
+	metrics                    Metrics
+	jsonProcessor              JSONProcessor
+	halSupport                 bool
+	allowedPushHosts           map[string]struct{}
+	transformableStatuses      map[int]struct{}
+	coalesceLinkHeader         bool
+	internalRequestHeader      string
+	jsonStreaming              bool
+	nopushByDefault            bool
+	relationResolver           RelationResolver
+	maxBodySize                int64
+	requestIDHeader            string
+	pushTimeout                time.Duration
+	dryRun                     bool
+	varyPolicy                 VaryPolicy
+	linkRel                    LinkRelFunc
+	earlyHintsBatchSize        int
+	inlineRefs                 bool
+	openAPIQueryRewrite        bool
+	shouldPush                 func(u *url.URL) bool
+	maxPushedBytes             int64
+	estimatePushSize           func(u *url.URL) int64
+	userAgentFilter            func(ua string) bool
+	pushConcurrency            int
+	jsonAPISupport             bool
+	withoutContentLength       bool
+	respectCacheControl        bool
+	pushCircuitBreakerFailures int
+	pushCircuitBreakerCooldown time.Duration
+	bufferPool                 bool
+	cborSupport                bool
+	redirectPolicy             RedirectPolicy
+	tracer                     trace.Tracer
+	strictFields               bool
+	relationPathPrefix         string
+	pushHeaderFilter           func(h http.Header)
+	preserveBOM                bool
+	defaultFields              string
+	defaultPreload             string
+	transformableContentTypes  map[string]struct{}
+	strictDirectives           bool
+	pushDecider                func(req *http.Request, u *url.URL) PushMode
+	propagateCacheControl      bool
+	maxSelectors               int
+	ndjsonSupport              bool
+	withoutURLRewriting        bool
+	openAPIContentNegotiation  bool
+	panicRecovery              bool
+	fieldTransformers          []fieldTransformer
+	onPushLimitReached         func(req *http.Request, dropped int)
+	canonicalPushURL           bool
+	preferMinimal              bool
+	embeddedJSON               []string
+	rootPointer                string
+	preconnect                 bool
+	maxLinkHeaderBytes         int
+	relationFieldPattern       string
+	openAPIRouter              func(spec *openapi3.T) (routers.Router, error)
+	skipPaths                  []string
+	serverTiming               bool
+}
+
+// Vulcain is the entrypoint of the library
+// Use New() to create an instance
+type Vulcain struct {
+	enableEarlyHints          bool
+	maxPushDepth              int
+	pushers                   *pushers
+	openAPI                   *openAPI
+	logger                    *zap.Logger
+	metrics                   Metrics
+	jsonProcessor             JSONProcessor
+	halSupport                bool
+	allowedPushHosts          map[string]struct{}
+	transformableStatuses     map[int]struct{}
+	coalesceLinkHeader        bool
+	jsonStreaming             bool
+	nopushByDefault           bool
+	relationResolver          RelationResolver
+	maxBodySize               int64
+	requestIDHeader           string
+	dryRun                    bool
+	varyPolicy                VaryPolicy
+	linkRel                   LinkRelFunc
+	earlyHintsBatchSize       int
+	inlineRefs                bool
+	openAPIQueryRewrite       bool
+	shouldPush                func(u *url.URL) bool
+	maxPushedBytes            int64
+	estimatePushSize          func(u *url.URL) int64
+	userAgentFilter           func(ua string) bool
+	pushConcurrency           int
+	withoutContentLength      bool
+	respectCacheControl       bool
+	bufferPool                *sync.Pool
+	cborSupport               bool
+	redirectPolicy            RedirectPolicy
+	tracer                    trace.Tracer
+	strictFields              bool
+	relationPathPrefix        string
+	pushHeaderFilter          func(h http.Header)
+	preserveBOM               bool
+	defaultFields             httpsfv.List
+	defaultPreload            httpsfv.List
+	transformableContentTypes map[string]struct{}
+	strictDirectives          bool
+	pushDecider               func(req *http.Request, u *url.URL) PushMode
+	propagateCacheControl     bool
+	maxSelectors              int
+	ndjsonSupport             bool
+	withoutURLRewriting       bool
+	openAPIContentNegotiation bool
+	panicRecovery             bool
+	fieldTransformers         []fieldTransformer
+	onPushLimitReached        func(req *http.Request, dropped int)
+	canonicalPushURL          bool
+	preferMinimal             bool
+	embeddedJSON              []string
+	rootPointer               string
+	preconnect                bool
+	maxLinkHeaderBytes        int
+	relationFieldPattern      *regexp.Regexp
+	skipPaths                 []string
+	serverTiming              bool
+	apiUrl                    string
+}
+
+// New creates a Vulcain instance
+func New(options ...Option) *Vulcain {
+	opt := &opt{
+		maxPushes:             -1,
+		maxPushDepth:          -1,
+		maxBodySize:           -1,
+		maxSelectors:          -1,
+		varyPolicy:            VaryPreload | VaryFields,
+		internalRequestHeader: defaultInternalRequestHeader,
+	}
+
+	for _, o := range options {
+		o(opt)
+	}
+
+	if !httpguts.ValidHeaderFieldName(opt.internalRequestHeader) {
+		panic(fmt.Sprintf("invalid internal request header name %q", opt.internalRequestHeader))
+	}
+
+	if opt.logger == nil {
+		opt.logger = zap.NewNop()
+	}
+
+	if opt.metrics == nil {
+		opt.metrics = nopMetrics{}
+	}
+
+	if opt.tracer == nil {
+		opt.tracer = trace.NewNoopTracerProvider().Tracer("github.com/dunglas/vulcain")
+	}
+
+	openAPIFiles := opt.openAPIFiles
+	if opt.openAPIFile != "" {
+		openAPIFiles = append([]string{opt.openAPIFile}, openAPIFiles...)
+	}
+
+	var breaker *circuitBreaker
+	if opt.pushCircuitBreakerFailures > 0 {
+		breaker = newCircuitBreaker(opt.pushCircuitBreakerFailures, opt.pushCircuitBreakerCooldown)
+	}
+
+	var bufferPool *sync.Pool
+	if opt.bufferPool {
+		bufferPool = &sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+	}
+
+	var o *openAPI
+	if len(openAPIFiles) > 0 {
+		var err error
+		if o, err = newOpenAPIFiles(openAPIFiles, opt.openAPIRouter, opt.logger); err != nil {
+			// Local definitions are part of the configuration, only a compressed definition that cannot be read doesn't prevent the startup
+			if !errors.Is(err, errDecompression) {
+				panic(err)
+			}
+
+			opt.logger.Error("OpenAPI support disabled", zap.Strings("files", openAPIFiles), zap.Error(err))
+		}
+	} else if opt.openAPIURL != "" {
+		var err error
+		if o, err = newOpenAPIFromURL(opt.openAPIURL, opt.openAPIRouter, opt.logger); err != nil {
+			opt.logger.Error("cannot load the OpenAPI definition", zap.String("url", opt.openAPIURL), zap.Error(err))
+		}
+	}
+
+	v := &Vulcain{
+		enableEarlyHints:          opt.enableEarlyHints,
+		maxPushDepth:              opt.maxPushDepth,
+		pushers:                   &pushers{maxPushes: opt.maxPushes, internalRequestHeader: opt.internalRequestHeader, pushTimeout: opt.pushTimeout, breaker: breaker, pusherMap: make(map[string]*waitPusher), logger: opt.logger},
+		openAPI:                   o,
+		logger:                    opt.logger,
+		metrics:                   opt.metrics,
+		tracer:                    opt.tracer,
+		strictFields:              opt.strictFields,
+		relationPathPrefix:        opt.relationPathPrefix,
+		pushHeaderFilter:          opt.pushHeaderFilter,
+		preserveBOM:               opt.preserveBOM,
+		jsonProcessor:             opt.jsonProcessor,
+		halSupport:                opt.halSupport,
+		allowedPushHosts:          opt.allowedPushHosts,
+		transformableStatuses:     opt.transformableStatuses,
+		coalesceLinkHeader:        opt.coalesceLinkHeader,
+		jsonStreaming:             opt.jsonStreaming,
+		nopushByDefault:           opt.nopushByDefault,
+		relationResolver:          opt.relationResolver,
+		maxBodySize:               opt.maxBodySize,
+		requestIDHeader:           opt.requestIDHeader,
+		dryRun:                    opt.dryRun,
+		varyPolicy:                opt.varyPolicy,
+		linkRel:                   opt.linkRel,
+		earlyHintsBatchSize:       opt.earlyHintsBatchSize,
+		inlineRefs:                opt.inlineRefs,
+		openAPIQueryRewrite:       opt.openAPIQueryRewrite,
+		shouldPush:                opt.shouldPush,
+		maxPushedBytes:            opt.maxPushedBytes,
+		estimatePushSize:          opt.estimatePushSize,
+		userAgentFilter:           opt.userAgentFilter,
+		pushConcurrency:           opt.pushConcurrency,
+		withoutContentLength:      opt.withoutContentLength,
+		respectCacheControl:       opt.respectCacheControl,
+		bufferPool:                bufferPool,
+		cborSupport:               opt.cborSupport,
+		redirectPolicy:            opt.redirectPolicy,
+		defaultFields:             parseDefaultDirective("fields", opt.defaultFields, opt.logger),
+		defaultPreload:            parseDefaultDirective("preload", opt.defaultPreload, opt.logger),
+		transformableContentTypes: opt.transformableContentTypes,
+		strictDirectives:          opt.strictDirectives,
+		pushDecider:               opt.pushDecider,
+		propagateCacheControl:     opt.propagateCacheControl,
+		maxSelectors:              opt.maxSelectors,
+		ndjsonSupport:             opt.ndjsonSupport,
+		withoutURLRewriting:       opt.withoutURLRewriting,
+		openAPIContentNegotiation: opt.openAPIContentNegotiation,
+		panicRecovery:             opt.panicRecovery,
+		fieldTransformers:         opt.fieldTransformers,
+		onPushLimitReached:        opt.onPushLimitReached,
+		canonicalPushURL:          opt.canonicalPushURL,
+		preferMinimal:             opt.preferMinimal,
+		embeddedJSON:              opt.embeddedJSON,
+		rootPointer:               opt.rootPointer,
+		preconnect:                opt.preconnect,
+		maxLinkHeaderBytes:        opt.maxLinkHeaderBytes,
+		relationFieldPattern:      compileRelationFieldPattern(opt.relationFieldPattern, opt.logger),
+		skipPaths:                 validSkipPaths(opt.skipPaths, opt.logger),
+		serverTiming:              opt.serverTiming,
+		apiUrl:                    opt.apiUrl,
+	}
+
+	if v.jsonProcessor == nil && opt.jsonAPISupport {
+		v.jsonProcessor = jsonAPIProcessor{v}
+	}
+	if v.jsonProcessor == nil {
+		v.jsonProcessor = defaultJSONProcessor{v}
+	}
+
+	return v
+}
+
+// extractFromRequest extracts the "fields" and "preload" directives from the appropriate HTTP headers and query parameters
+// For each directive, the header takes precedence over the query parameter: the query parameter is ignored if a valid header is present
+// The directives are then propagated to the relations using the same channel they were received from
+func extractFromRequest(req *http.Request) (fields, preload httpsfv.List, fieldsHeader, fieldsQuery, preloadHeader, preloadQuery bool) {
+	query := req.URL.Query()
+	var err error
+	if values := directiveValues(req.Header["Fields"]); len(values) > 0 {
+		if fields, err = httpsfv.UnmarshalList(values); err == nil {
+			fieldsHeader = true
+		}
+	}
+
+	if values := directiveValues(query["fields"]); !fieldsHeader && len(values) > 0 {
+		if fields, err = httpsfv.UnmarshalList(values); err == nil {
+			fieldsQuery = true
+		}
+	}
+
+	if values := directiveValues(req.Header["Preload"]); len(values) > 0 {
+		if preload, err = httpsfv.UnmarshalList(values); err == nil {
+			preloadHeader = true
+		}
+	}
+
+	if values := directiveValues(query["preload"]); !preloadHeader && len(values) > 0 {
+		if preload, err = httpsfv.UnmarshalList(values); err == nil {
+			preloadQuery = true
+		}
+	}
+
+	return fields, preload, fieldsHeader, fieldsQuery, preloadHeader, preloadQuery
+}
+
+// directiveValues returns the values of a directive, ignoring the empty and whitespace-only ones
+// A directive having only such values is handled as if it was absent
+func directiveValues(values []string) []string {
+	var nonEmpty []string
+	for _, v := range values {
+		if strings.TrimSpace(v) != "" {
+			nonEmpty = append(nonEmpty, v)
+		}
+	}
+
+	return nonEmpty
+}
+
+// parseDefaultDirective parses a directive set using WithDefaultFields or WithDefaultPreload, an invalid directive is ignored
+func parseDefaultDirective(name, list string, logger *zap.Logger) httpsfv.List {
+	if list == "" {
+		return nil
+	}
+
+	l, err := httpsfv.UnmarshalList([]string{list})
+	if err != nil {
+		logger.Error("invalid default directive", zap.String("directive", name), zap.String("value", list), zap.Error(err))
+
+		return nil
+	}
+
+	return l
+}
+
+// validSkipPaths returns the valid patterns set using WithSkipPaths, the invalid ones are logged
+func validSkipPaths(patterns []string, logger *zap.Logger) []string {
+	var valid []string
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			logger.Error("invalid skip path pattern", zap.String("pattern", pattern), zap.Error(err))
+
+			continue
+		}
+
+		valid = append(valid, pattern)
+	}
+
+	return valid
+}
+
+// compileRelationFieldPattern compiles the pattern set using WithRelationFieldPattern, nil is returned if it isn't set or is invalid
+func compileRelationFieldPattern(pattern string, logger *zap.Logger) *regexp.Regexp {
+	if pattern == "" {
+		return nil
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		logger.Error("invalid relation field pattern", zap.String("pattern", pattern), zap.Error(err))
+
+		return nil
+	}
+
+	return re
+}
+
+// validateDirectives returns a DirectiveError if a directive sent by the client cannot be parsed
+// As in extractFromRequest, the query parameter is only used if the HTTP header isn't set
+func validateDirectives(req *http.Request) error {
+	query := req.URL.Query()
+	for _, d := range [...]struct{ name, header string }{{"fields", "Fields"}, {"preload", "Preload"}} {
+		values, source := directiveValues(req.Header[d.header]), DirectiveSourceHeader
+		if len(values) == 0 {
+			values, source = directiveValues(query[d.name]), DirectiveSourceQuery
+		}
+		if len(values) == 0 {
+			continue
+		}
+
+		if _, err := httpsfv.UnmarshalList(values); err != nil {
+			return &DirectiveError{Directive: d.name, Source: source, Err: err}
+		}
+	}
+
+	return nil
+}
+
+// extractDirectives extracts the directives using extractFromRequest.
+// If the request contains no directive, the defaults set using WithDefaultFields and WithDefaultPreload are used and defaults is true.
+// Defaults are handled like directives sent using HTTP headers, so they are forwarded to the pushed relations.
+func (v *Vulcain) extractDirectives(req *http.Request) (fields, preload httpsfv.List, fieldsHeader, fieldsQuery, preloadHeader, preloadQuery, defaults bool) {
+	fields, preload, fieldsHeader, fieldsQuery, preloadHeader, preloadQuery = extractFromRequest(req)
+	if fieldsHeader || fieldsQuery || preloadHeader || preloadQuery || !v.hasDefaultDirectives() {
+		return fields, preload, fieldsHeader, fieldsQuery, preloadHeader, preloadQuery, false
+	}
+
+	return v.defaultFields, v.defaultPreload, v.defaultFields != nil, false, v.defaultPreload != nil, false, true
+}
+
+// buildTree builds the tree of the "preload" and "fields" directives, enforcing the limit set using WithMaxSelectors
+func (v *Vulcain) buildTree(preloadList, fieldsList httpsfv.List) (*node, error) {
+	tree := &node{}
+	if err := tree.importPointers(preload, rebasePointers(preload, preloadList, v.rootPointer), v.maxSelectors); err != nil {
+		return nil, err
+	}
+	if err := tree.importPointers(fields, rebasePointers(fields, fieldsList, v.rootPointer), v.maxSelectors); err != nil {
+		return nil, err
+	}
+
+	return tree, nil
+}
+
+// minimalFields returns the "fields" directive to apply if the client prefers a minimal representation, or nil
+// The directive set for the operation using the x-vulcain-minimal-fields OpenAPI extension wins over the one set using WithDefaultFields
+func (v *Vulcain) minimalFields(req *http.Request) httpsfv.List {
+	if !v.preferMinimal || !prefersMinimal(req) {
+		return nil
+	}
+
+	if v.openAPI != nil {
+		if f, ok := v.openAPI.getMinimalFields(v.getOpenAPIRoute(openAPIRequestURL(req), nil, false)); ok {
+			return f
+		}
+	}
+
+	return v.defaultFields
+}
+
+// prefersMinimal checks if the request contains the "Prefer: return=minimal" header
+func prefersMinimal(req *http.Request) bool {
+	for _, p := range req.Header["Prefer"] {
+		if minimalRe.MatchString(p) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hasDefaultDirectives tells if directives have been set using WithDefaultFields or WithDefaultPreload
+func (v *Vulcain) hasDefaultDirectives() bool {
+	return v.defaultFields != nil || v.defaultPreload != nil
+}
+
+// PushCircuitOpen tells if pushes are currently disabled by the circuit breaker set using WithPushCircuitBreaker.
+func (v *Vulcain) PushCircuitOpen() bool {
+	return !v.pushers.allowPush()
+}
+
+// PusherStats returns process-wide push statistics, complementing the per-request Metrics.
+func (v *Vulcain) PusherStats() PusherStats {
+	return v.pushers.stats()
+}
+
+// Reload loads the OpenAPI definitions again from their files or URL, without restarting.
+// Requests handled during the reload keep using the previous definition, which is also kept if the new one is invalid.
+func (v *Vulcain) Reload() error {
+	if v.openAPI == nil {
+		return nil
+	}
+
+	return v.openAPI.reload()
+}
+
+// getOpenAPIRoute gets the routers.Route instance corresponding to the given URL
+func (v *Vulcain) getOpenAPIRoute(url *url.URL, route *routers.Route, routeTested bool) *routers.Route {
+	if routeTested || v.openAPI == nil {
+		return route
+	}
+
+	return v.openAPI.getRoute(url)
+}
+
+// openAPIRequestURL returns the URL of the request including its host, used to select the matching OpenAPI server
+func openAPIRequestURL(req *http.Request) *url.URL {
+	if req.URL.Host != "" || req.Host == "" {
+		return req.URL
+	}
+
+	u := *req.URL
+	u.Host = req.Host
+
+	return &u
+}
+
+// ResolveRelation returns the URL of the relation matched by selector in the response to req, as done by Apply.
+// The relation resolver and the OpenAPI definition are used if configured, the returned boolean is true if the URL has been resolved using OpenAPI.
+func (v *Vulcain) ResolveRelation(req *http.Request, selector, value string) (*url.URL, bool, error) {
+	u, useOA, _, err := v.parseRelation(selector, value, v.getOpenAPIRoute(openAPIRequestURL(req), nil, false), nil, v.requestLogger(req))
+	if err == nil {
+		v.prefixRelationPath(u)
+	}
+
+	return u, useOA, err
+}
+
+// CreateRequestContext assign the waitPusher and the request logger used by other functions to the request context.
+// CreateRequestContext must always be called first.
+func (v *Vulcain) CreateRequestContext(rw http.ResponseWriter, req *http.Request) context.Context {
+	var requestID string
+	if v.requestIDHeader != "" {
+		requestID = req.Header.Get(v.requestIDHeader)
+	}
+	if requestID == "" {
+		requestID = uuid.Must(uuid.NewV4()).String()
+	}
+
+	pusher := v.pushers.getPusherForRequest(rw, req, requestID)
+	if pusher != nil && pusher.requestID != "" {
+		// Pushed requests share the ID of their explicit request
+		requestID = pusher.requestID
+	}
+
+	ctx := context.WithValue(req.Context(), ctxKey{}, pusher)
+	ctx = context.WithValue(ctx, stateCtxKey{}, &requestState{})
+
+	return context.WithValue(ctx, loggerCtxKey{}, v.logger.With(zap.String("request_id", requestID)))
+}
+
+// requestLogger returns the logger associated with the request, or the global logger
+func (v *Vulcain) requestLogger(req *http.Request) *zap.Logger {
+	if logger, ok := req.Context().Value(loggerCtxKey{}).(*zap.Logger); ok {
+		return logger
+	}
+
+	return v.logger
+}
+
+// acceptsPush returns false if the client opted out of pushes using the Accept-Push-Policy: none header
+func acceptsPush(req *http.Request) bool {
+	for _, value := range req.Header.Values("Accept-Push-Policy") {
+		for _, policy := range strings.Split(value, ",") {
+			policy, _, _ = strings.Cut(policy, ";")
+			if strings.EqualFold(strings.TrimSpace(policy), "none") {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// IsValidRequest tells if this request contains at least one Vulcain directive.
+// Empty and whitespace-only directives (e.g. "Preload: " or "?preload=") are handled as if they were absent.
+// IsValidRequest must always be called before Apply.
+func (v *Vulcain) IsValidRequest(req *http.Request) bool {
+	// Filtered user agent (e.g. a crawler): don't modify the response
+	if v.userAgentFilter != nil && !v.userAgentFilter(req.UserAgent()) {
+		return false
+	}
+
+	if v.isSkippedPath(req.URL.Path) {
+		return false
+	}
+
+	// Default directives are applied to every request
+	if v.hasDefaultDirectives() {
+		return true
+	}
+
+	// The minimal fields may be documented using OpenAPI for the requested operation
+	if v.minimalFields(req) != nil {
+		return true
+	}
+
+	query := req.URL.Query()
+
+	// No Vulcain hints: don't modify the response, empty directives are ignored
+	return len(directiveValues(req.Header["Preload"])) > 0 ||
+		len(directiveValues(req.Header["Fields"])) > 0 ||
+		len(directiveValues(query["preload"])) > 0 ||
+		len(directiveValues(query["fields"])) > 0
+}
+
+// addServerTiming adds the Server-Timing entries of the parse and traversal phases to the response headers
+// The headers of rw are stored in the request state to add the entry of the push wait phase as a trailer in Finish:
+// the response headers passed to Apply may have already been copied to rw (e.g. by httputil.ReverseProxy) when Finish is called
+func (v *Vulcain) addServerTiming(req *http.Request, rw http.ResponseWriter, h http.Header, parse, traverse time.Duration) {
+	h.Add("Server-Timing", serverTimingEntry("vulcain-parse", parse))
+	h.Add("Server-Timing", serverTimingEntry("vulcain-traverse", traverse))
+
+	if state := getRequestState(req); state != nil {
+		state.Lock()
+		state.serverTimingHeader = rw.Header()
+		state.Unlock()
+	}
+}
+
+// canSendTrailers tells if the trailers of a response having these headers can be delivered to the client
+// HTTP/1 responses must use the chunked transfer encoding, which isn't used along with a Content-Length header
+func canSendTrailers(req *http.Request, h http.Header) bool {
+	if req.ProtoMajor >= 2 {
+		return true
+	}
+
+	return req.ProtoAtLeast(1, 1) && h.Get("Content-Length") == ""
+}
+
+// serverTimingEntry formats a Server-Timing entry, the duration is in milliseconds (https://www.w3.org/TR/server-timing/)
+func serverTimingEntry(name string, d time.Duration) string {
+	return name + ";dur=" + strconv.FormatFloat(float64(d.Microseconds())/1000, 'f', -1, 64)
+}
+
+// isSkippedPath checks if the path matches a pattern set using WithSkipPaths
+func (v *Vulcain) isSkippedPath(p string) bool {
+	for _, pattern := range v.skipPaths {
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsValidResponse checks if Apply will be able to deal with this response.
+func (v *Vulcain) IsValidResponse(req *http.Request, responseStatus int, responseHeaders http.Header) bool {
+	// Not a success, marked as no-transform or not JSON: don't modify the response
+	if !v.isTransformableStatus(responseStatus) ||
+		!v.isTransformableContentType(responseHeaders.Get("Content-Type")) ||
+		notransformRe.MatchString(responseHeaders.Get("Cache-Control")) {
+
+		return false
+	}
+
+	if state := getRequestState(req); state != nil {
+		state.Lock()
+		state.status = responseStatus
+		state.Unlock()
+	}
+
+	prefers, ok := req.Header["Prefer"]
+	if !ok {
+		return true
+	}
+
+	for _, p := range prefers {
+		if preferRe.MatchString(p) || (v.preferMinimal && minimalRe.MatchString(p)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isRedirect checks if the status code is the one of a redirect response
+func isRedirect(status int) bool {
+	return status >= 300 && status < 400
+}
+
+// isTransformableContentType checks if a response having this content type can be transformed
+func (v *Vulcain) isTransformableContentType(contentType string) bool {
+	if v.cborSupport && cborRe.MatchString(contentType) {
+		return true
+	}
+
+	if v.ndjsonSupport && ndjsonRe.MatchString(contentType) {
+		return true
+	}
+
+	if v.transformableContentTypes == nil {
+		return jsonRe.MatchString(contentType)
+	}
+
+	_, ok := v.transformableContentTypes[mediaType(contentType)]
+
+	return ok
+}
+
+// mediaType returns the lowercased media type of a Content-Type, without its parameters
+func mediaType(contentType string) string {
+	if t, _, err := mime.ParseMediaType(contentType); err == nil {
+		return t
+	}
+
+	t, _, _ := strings.Cut(contentType, ";")
+
+	return strings.ToLower(strings.TrimSpace(t))
+}
+
+// isTransformableStatus checks if a response having this status code can be transformed
+func (v *Vulcain) isTransformableStatus(status int) bool {
+	if v.redirectPolicy == RedirectFilterFields && isRedirect(status) {
+		return true
+	}
+
+	if v.transformableStatuses == nil {
+		return status >= 200 && status < 300
+	}
+
+	_, ok := v.transformableStatuses[status]
+
+	return ok
+}
+
+// Apply pushes the requested relations, modifies the response headers and returns a modified response to send to the client.
+// It's the responsibility of the caller to use the updated response body.
+// The whole body is buffered: the relations must be pushed and the response headers modified before the first byte of the body is sent.
+// If some relations cannot be handled, the modified response is returned along with the *ApplyError instances joined in a single error.
+// If the body is larger than the limit set using WithMaxBodySize, ErrBodyTooLarge is returned and the response must be sent untransformed.
+// If the request context is canceled, remaining relations aren't pushed and the context error is returned along with the modified response.
+// If the response has trailers (announced using the Trailer header or set using http.TrailerPrefix), the Content-Length header is removed instead of being updated:
+// trailers can only be sent using chunked encoding (HTTP/1.1) or HTTP/2 and later, and must be kept untouched by the caller.
+// Otherwise, the Transfer-Encoding header (e.g. set for a chunked upstream response) is removed along with the Content-Length header being set, unless WithoutContentLength is used.
+// The relations declared by the upstream using Link rel=preload headers whose anchor is a JSON pointer matched by a "preload" selector
+// (e.g. `</authors/1>; rel=preload; anchor="#/author"`) are pushed too, the existing Link headers being the fallback.
+// Apply must not be called if IsValidRequest or IsValidResponse return false.
+func (v *Vulcain) Apply(req *http.Request, rw http.ResponseWriter, responseBody io.Reader, responseHeaders http.Header) ([]byte, error) {
+	b, _, err := v.ApplyWithStats(req, rw, responseBody, responseHeaders)
+
+	return b, err
+}
+
+// ApplyWithStats is the same as Apply, but also returns the changes made to the response.
+func (v *Vulcain) ApplyWithStats(req *http.Request, rw http.ResponseWriter, responseBody io.Reader, responseHeaders http.Header) ([]byte, ApplyStats, error) {
+	ctx, span := v.tracer.Start(req.Context(), "vulcain.Apply")
+	defer span.End()
+
+	var (
+		b     []byte
+		stats ApplyStats
+		err   error
+	)
+	if v.panicRecovery {
+		b, stats, err = v.applyWithRecovery(req.WithContext(ctx), rw, responseBody, responseHeaders)
+	} else {
+		b, stats, err = v.applyWithStats(req.WithContext(ctx), rw, responseBody, responseHeaders)
+	}
+	span.SetAttributes(
+		attribute.Int("vulcain.relations", stats.RelationCount),
+		attribute.Int("vulcain.pushed", stats.PushedCount),
+		attribute.Int("vulcain.preloaded", stats.PreloadedCount),
+		attribute.Int("vulcain.body_size", len(b)),
+	)
+	if err != nil {
+		span.RecordError(err)
+	}
+	if b == nil && err != nil {
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	return b, stats, err
+}
+
+// applyWithRecovery calls applyWithStats and converts the panics, including the ones of the push workers, into a *PanicError
+// The response headers are restored, the response must be sent untransformed
+func (v *Vulcain) applyWithRecovery(req *http.Request, rw http.ResponseWriter, responseBody io.Reader, responseHeaders http.Header) (b []byte, stats ApplyStats, err error) {
+	snapshot := responseHeaders.Clone()
+	defer func() {
+		if r := recover(); r != nil {
+			panicErr, ok := r.(*PanicError)
+			if !ok {
+				panicErr = &PanicError{Value: r, Stack: debug.Stack()}
+			}
+			v.requestLogger(req).Error("panic recovered while applying the directives", zap.Any("panic", panicErr.Value), zap.ByteString("stack", panicErr.Stack))
+
+			for k := range responseHeaders {
+				delete(responseHeaders, k)
+			}
+			for k, vv := range snapshot {
+				responseHeaders[k] = vv
+			}
+
+			b, err = nil, panicErr
+		}
+	}()
+
+	return v.applyWithStats(req, rw, responseBody, responseHeaders)
+}
+
+// ApplyBytes is the same as Apply, but takes a body already in memory (e.g. buffered by a proxy) instead of an io.Reader.
+// The body isn't copied: it must not be modified by the caller until the returned slice isn't used anymore, they may share the same memory.
+func (v *Vulcain) ApplyBytes(req *http.Request, rw http.ResponseWriter, responseBody []byte, responseHeaders http.Header) ([]byte, error) {
+	return v.Apply(req, rw, &bytesBody{bytes.NewReader(responseBody), responseBody}, responseHeaders)
+}
+
+// bytesBody is a body already in memory, see ApplyBytes
+// It's still an io.Reader to be consumed by the code paths needing one (e.g. JSON streaming)
+type bytesBody struct {
+	*bytes.Reader
+	b []byte
+}
+
+// hasTrailers tells if the response has trailers, announced using the Trailer header or set using http.TrailerPrefix
+func hasTrailers(h http.Header) bool {
+	if _, ok := h["Trailer"]; ok {
+		return true
+	}
+
+	for k := range h {
+		if strings.HasPrefix(k, http.TrailerPrefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ApplyResult contains the transformed body and the changes to make to the response headers computed by ApplyWithResult
+type ApplyResult struct {
+	// Body is the transformed body
+	Body []byte
+	// Header contains the headers added or modified by Apply, with all their values: they replace the existing values of the response
+	Header http.Header
+	// DeletedHeaders contains the names of the headers removed by Apply (e.g. Content-Length when trailers are announced)
+	DeletedHeaders []string
+	// Stats describes the changes made to the response
+	Stats ApplyStats
+}
+
+// ApplyWithResult is the same as ApplyWithStats, but responseHeaders isn't modified: the changes to make to the headers are returned instead.
+// It allows to integrate with frameworks not relying on http.Header to manage the response headers.
+func (v *Vulcain) ApplyWithResult(req *http.Request, rw http.ResponseWriter, responseBody io.Reader, responseHeaders http.Header) (ApplyResult, error) {
+	h := responseHeaders.Clone()
+	if h == nil {
+		h = make(http.Header)
+	}
+
+	b, stats, err := v.ApplyWithStats(req, rw, responseBody, h)
+
+	result := ApplyResult{Body: b, Stats: stats}
+	if b == nil {
+		return result, err
+	}
+
+	for k, vv := range h {
+		if !slices.Equal(vv, responseHeaders[k]) {
+			if result.Header == nil {
+				result.Header = make(http.Header)
+			}
+			result.Header[k] = vv
+		}
+	}
+	for k := range responseHeaders {
+		if _, ok := h[k]; !ok {
+			result.DeletedHeaders = append(result.DeletedHeaders, k)
+		}
+	}
+	sort.Strings(result.DeletedHeaders)
+
+	return result, err
+}
+
+// applyWithStats implements ApplyWithStats, the request context contains the span of the Apply call
+func (v *Vulcain) applyWithStats(req *http.Request, rw http.ResponseWriter, responseBody io.Reader, responseHeaders http.Header) ([]byte, ApplyStats, error) {
+	var stats ApplyStats
+	start := time.Now()
+
+	if v.strictDirectives {
+		if err := validateDirectives(req); err != nil {
+			return nil, stats, err
+		}
+	}
+
+	f, p, fieldsHeader, fieldsQuery, preloadHeader, preloadQuery, defaults := v.extractDirectives(req)
+	logger := v.requestLogger(req)
+
+	var minimal bool
+	if !fieldsQuery && (!fieldsHeader || defaults) {
+		if m := v.minimalFields(req); m != nil {
+			f, fieldsHeader, minimal = m, true, true
+		}
+	}
+
+	negatedFields, err := fieldsNegation(f)
+	if err != nil {
+		return nil, stats, err
+	}
+
+	tree, err := v.buildTree(p, f)
+	if err != nil {
+		return nil, stats, err
+	}
+	for _, t := range v.fieldTransformers {
+		tree.importTransformer(t.pointer, t.fn)
+	}
+	for _, pointer := range v.embeddedJSON {
+		tree.markEmbeddedJSON(pointer)
+	}
+	if v.maxPushDepth >= 0 && tree.truncate(preload, v.maxPushDepth) {
+		logger.Debug("preload directive truncated", zap.Int("maxPushDepth", v.maxPushDepth))
+	}
+
+	var (
+		oaRoute                        *routers.Route
+		oaRouteTested, usePreloadLinks bool
+		applyErrors                    []error
+		earlyHintsSent                 int
+		wildcardRelations              int
+		dryRunPushes                   int
+		droppedPushes                  int
+		pushedBytes                    int64
+		ctxErr                         error
+	)
+	maxPushes := v.pushers.maxPushes
+
+	// Pushed responses could be stored in shared caches, only preload the relations of private responses
+	privateResponse := v.respectCacheControl && privateRe.MatchString(strings.Join(responseHeaders.Values("Cache-Control"), ","))
+
+	// Relations of redirect responses are never pushed nor preloaded
+	var redirect bool
+	if state := getRequestState(req); state != nil {
+		state.Lock()
+		redirect = isRedirect(state.status)
+		if v.propagateCacheControl {
+			state.pushCacheControl = propagatedCacheControl(responseHeaders.Values("Cache-Control"))
+		}
+		state.Unlock()
+	}
+
+	// Relations declared by the upstream using Link rel=preload headers, and resolved URLs of the relations already pushed
+	var upstreamLinks []preloadLink
+	if len(p) > 0 {
+		upstreamLinks = preloadLinks(responseHeaders["Link"])
+	}
+	pushedRelations := make(map[string]struct{})
+
+	// Relations for which a Link rel=preload header has already been added, or dropped (true) because of WithMaxLinkHeaderBytes
+	// The upstream Link headers are kept, they are the fallback if the relations cannot be pushed
+	preloadedRelations := make(map[string]bool)
+	for _, link := range upstreamLinks {
+		preloadedRelations[link.target] = false
+	}
+
+	lookupRoute := func() {
+		if oaRouteTested {
+			return
+		}
+
+		oaRoute, oaRouteTested = v.getOpenAPIRoute(openAPIRequestURL(req), nil, false), true
+		if m, ok := v.openAPI.getMaxPushes(oaRoute); ok {
+			maxPushes = m
+		}
+	}
+
+	// Link headers are accumulated in a separate map to be merged at the end
+	linkHeaders := responseHeaders
+	if v.coalesceLinkHeader || v.dryRun {
+		linkHeaders = make(http.Header)
+	}
+	initialLinkHeaders := len(linkHeaders["Link"])
+
+	// Relations already handled while streaming the response
+	type relation struct {
+		n   *node
+		val string
+	}
+	streamed := make(map[relation]struct{})
+
+	// Pushes running concurrently (see WithPushConcurrency)
+	var (
+		jobs          []*pushJob
+		pushWorkers   sync.WaitGroup
+		pushSemaphore chan struct{}
+	)
+	if v.pushConcurrency > 1 {
+		pushSemaphore = make(chan struct{}, v.pushConcurrency)
+		defer pushWorkers.Wait()
+	}
+
+	// flushEarlyHints sends a 103 response if at least min Link headers haven't been sent yet
+	flushEarlyHints := func(min int) {
+		if v.enableEarlyHints && len(linkHeaders["Link"])-earlyHintsSent >= min {
+			v.sendEarlyHints(rw, linkHeaders["Link"][earlyHintsSent:])
+			earlyHintsSent = len(linkHeaders["Link"])
+		}
+	}
+
+	relationHandler := func(n *node, val string) string {
+		var (
+			u        *url.URL
+			useOA    bool
+			method   string
+			newValue string
+			err      error
+		)
+
+		lookupRoute()
+
+		_, alreadyStreamed := streamed[relation{n, val}]
+		if u, useOA, method, err = v.parseRelation(n.String(), val, oaRoute, n, logger); err != nil {
+			if !alreadyStreamed {
+				applyErrors = append(applyErrors, &ApplyError{n.String(), val, err})
+			}
+
+			return ""
+		}
+
+		if v.prefixRelationPath(u) && !useOA && !v.withoutURLRewriting {
+			newValue = u.String()
+		}
+
+		// Don't rewrite values when using OpenAPI unless explicitly enabled, use headers instead of query parameters
+		forwardPreload, forwardFields := preloadHeader || preloadQuery, fieldsHeader || fieldsQuery
+		if (preloadQuery || fieldsQuery) && (!useOA || v.openAPIQueryRewrite) && !v.withoutURLRewriting {
+			if v.canonicalPushURL {
+				// Only the value in the body is rewritten, u is the canonical URL to push or to preload, the directives are sent using headers
+				rewritten := *u
+				urlRewriter(&rewritten, n, preloadQuery, fieldsQuery)
+				newValue = rewritten.String()
+			} else {
+				urlRewriter(u, n, preloadQuery, fieldsQuery)
+				newValue = u.String()
+				forwardPreload, forwardFields = preloadHeader, fieldsHeader
+			}
+		}
+
+		if n.preload && !alreadyStreamed {
+			stats.RelationCount++
+		}
+
+		if !n.preload || alreadyStreamed || ctxErr != nil || redirect {
+			return newValue
+		}
+
+		// The client is gone, don't push for nothing
+		if ctxErr = req.Context().Err(); ctxErr != nil {
+			logger.Debug("request canceled, skipping remaining pushes", zap.Error(ctxErr))
+
+			return newValue
+		}
+
+		if !v.isAllowedPushHost(req, u) {
+			logger.Debug("relation host not allowed", zap.Stringer("node", n), zap.Stringer("relation", u))
+			if v.dryRun {
+				stats.Decisions = append(stats.Decisions, PushDecision{n.String(), u.String(), PushActionSkippedHost})
+			}
+
+			return newValue
+		}
+
+		// Prevent runaway pushes on huge arrays, the relations over the limit are preloaded like the ones exceeding WithMaxPushes
+		var wildcardLimited bool
+		if maxPushes > 0 && n.hasWildcard() {
+			if wildcardRelations >= maxPushes {
+				logger.Debug("maximum number of wildcard relations reached", zap.Stringer("node", n), zap.Stringer("relation", u))
+				wildcardLimited = true
+			} else {
+				wildcardRelations++
+			}
+		}
+
+		// A limit of 0 adds a Link header with the nopush attribute instead of pushing, skipped is the reason reported in dry-run mode
+		pushLimit := maxPushes
+		var (
+			size    int64 = -1
+			skipped PushAction
+		)
+		if wildcardLimited {
+			pushLimit, skipped = 0, PushActionMaxExceeded
+		} else if privateResponse {
+			pushLimit, skipped = 0, PushActionSkippedPrivate
+		} else if n.hasPreloadParam("nopush") {
+			logger.Debug("relation not pushed as requested by the client", zap.Stringer("node", n), zap.Stringer("relation", u))
+			pushLimit, skipped = 0, PushActionSkippedNopush
+		} else if method != "" && method != http.MethodGet {
+			// Pushed requests always use the GET method
+			logger.Debug("relation not pushed, its OpenAPI operation isn't a GET one", zap.Stringer("node", n), zap.Stringer("relation", u), zap.String("method", method))
+			pushLimit, skipped = 0, PushActionSkippedMethod
+		} else if v.shouldPush != nil && !v.shouldPush(u) {
+			logger.Debug("relation not pushed by the push policy", zap.Stringer("node", n), zap.Stringer("relation", u))
+			pushLimit, skipped = 0, PushActionSkippedPolicy
+		} else if v.pushDecider != nil && v.pushDecider(req, u) == PushModePreload {
+			logger.Debug("relation not pushed by the push decider", zap.Stringer("node", n), zap.Stringer("relation", u))
+			pushLimit, skipped = 0, PushActionSkippedPolicy
+		} else if v.estimatePushSize != nil {
+			if size = v.estimatePushSize(u); size >= 0 && pushedBytes+size > v.maxPushedBytes {
+				logger.Debug("maximum pushed bytes reached", zap.Stringer("node", n), zap.Stringer("relation", u), zap.Int64("size", size))
+				pushLimit, skipped = 0, PushActionMaxBytesExceeded
+			}
+		}
+
+		if v.dryRun {
+			action := v.dryRunAction(u, req, pushLimit, dryRunPushes, skipped)
+			if action == PushActionPush {
+				dryRunPushes++
+				if size > 0 {
+					pushedBytes += size
+				}
+			}
+			stats.Decisions = append(stats.Decisions, PushDecision{n.String(), u.String(), action})
+
+			return newValue
+		}
+
+		pushedRelations[u.String()] = struct{}{}
+		if wildcardLimited {
+			droppedPushes++
+		}
+
+		// Run the push in the worker pool, the result is handled when all relations have been found
+		if v.pushConcurrency > 1 {
+			job, fallback := v.preparePush(u, req, linkHeaders, preloadedRelations, n, forwardPreload, forwardFields, pushLimit)
+			if fallback {
+				usePreloadLinks = true
+			}
+			if job != nil {
+				// The budget is reserved when the push is queued, the workers don't access it
+				if size > 0 {
+					pushedBytes += size
+				}
+				jobs = append(jobs, job)
+				pushWorkers.Add(1)
+				pushSemaphore <- struct{}{}
+				go func() {
+					defer pushWorkers.Done()
+					defer func() {
+						<-pushSemaphore
+						if r := recover(); r != nil {
+							var ok bool
+							if job.panicErr, ok = r.(*PanicError); !ok {
+								job.panicErr = &PanicError{Value: r, Stack: debug.Stack()}
+							}
+						}
+					}()
+					job.run()
+				}()
+			}
+
+			return newValue
+		}
+
+		pushed, fallback, limited := v.push(u, rw, req, linkHeaders, preloadedRelations, n, forwardPreload, forwardFields, pushLimit)
+		if limited {
+			droppedPushes++
+		}
+		if pushed {
+			stats.PushedCount++
+			if size > 0 {
+				pushedBytes += size
+			}
+		}
+		if fallback {
+			usePreloadLinks = true
+			if !v.jsonStreaming && v.earlyHintsBatchSize > 0 {
+				flushEarlyHints(v.earlyHintsBatchSize)
+			}
+		}
+
+		return newValue
+	}
+
+	isCBOR := v.cborSupport && cborRe.MatchString(responseHeaders.Get("Content-Type"))
+	isNDJSON := v.ndjsonSupport && !isCBOR && ndjsonRe.MatchString(responseHeaders.Get("Content-Type"))
+	streaming := v.jsonStreaming && !isCBOR && !isNDJSON
+
+	var (
+		currentBody []byte
+		hasBOM      bool
+	)
+	if in, ok := responseBody.(*bytesBody); ok && !streaming {
+		// The body is already in memory (see ApplyBytes), it's used without being copied
+		currentBody = in.b
+		if !isCBOR && bytes.HasPrefix(currentBody, utf8BOM) {
+			currentBody, hasBOM = currentBody[len(utf8BOM):], true
+		}
+	} else {
+		if v.maxBodySize >= 0 {
+			responseBody = io.LimitReader(responseBody, v.maxBodySize+1)
+		}
+
+		if !isCBOR {
+			if responseBody, hasBOM, err = stripBOM(responseBody); err != nil {
+				return nil, stats, err
+			}
+		}
+
+		if streaming {
+			currentBody, err = v.streamRelations(responseBody, v.getBuffer(req), tree, len(f) > 0 && !negatedFields, func(n *node, val string) {
+				// In-document references are inlined when traversing the document
+				if v.inlineRefs && strings.HasPrefix(val, "#/") {
+					return
+				}
+
+				relationHandler(n, val)
+				streamed[relation{n, val}] = struct{}{}
+
+				// Send the Link headers as soon as possible
+				flushEarlyHints(1)
+			})
+		} else if buf := v.getBuffer(req); buf != nil {
+			_, err = buf.ReadFrom(responseBody)
+			currentBody = buf.Bytes()
+		} else {
+			currentBody, err = io.ReadAll(responseBody)
+		}
+	}
+	if err != nil {
+		return nil, stats, err
+	}
+	if v.maxBodySize >= 0 && int64(len(currentBody)) > v.maxBodySize {
+		return nil, stats, ErrBodyTooLarge
+	}
+
+	jsonBody := currentBody
+	if isCBOR {
+		if jsonBody, err = cborToJSON(currentBody); err != nil {
+			return nil, stats, err
+		}
+	}
+
+	missing := make(map[string]struct{})
+	process := func(doc []byte) []byte {
+		if v.strictFields && len(f) > 0 && !negatedFields {
+			for _, selector := range missingFields(doc, tree) {
+				if _, ok := missing[selector]; !ok {
+					missing[selector] = struct{}{}
+					applyErrors = append(applyErrors, &FieldError{selector})
+				}
+			}
+		}
+
+		return v.jsonProcessor.Process(doc, tree, len(f) > 0 && !negatedFields, func(n Node, val string) string {
+			if n == nil {
+				return ""
+			}
+
+			return relationHandler(n.treeNode(), val)
+		})
+	}
+
+	parseDuration := time.Since(start)
+
+	_, traverseSpan := v.tracer.Start(req.Context(), "vulcain.traverse")
+	traverseStart := time.Now()
+	var newBody []byte
+	if isNDJSON {
+		newBody = processLines(jsonBody, process)
+	} else {
+		newBody = process(jsonBody)
+	}
+	traverseDuration := time.Since(traverseStart)
+	traverseSpan.End()
+
+	if isCBOR {
+		if bytes.Equal(jsonBody, newBody) {
+			newBody = currentBody
+		} else if newBody, err = jsonToCBOR(newBody); err != nil {
+			return nil, stats, err
+		}
+	}
+
+	// Relations declared by the upstream using Link rel=preload headers are handled like the ones of the body when their anchor is matched by a "preload" selector
+	for _, link := range upstreamLinks {
+		if _, ok := pushedRelations[link.target]; ok {
+			continue
+		}
+
+		if n := tree.match(strings.Split(link.pointer[1:], "/")); n != nil {
+			relationHandler(n, link.target)
+		}
+	}
+
+	pushWorkers.Wait()
+	for _, job := range jobs {
+		if job.panicErr != nil {
+			v.repanic(job.panicErr)
+		}
+	}
+	for _, job := range jobs {
+		pushed, fallback := v.finishPush(job, req, linkHeaders, preloadedRelations)
+		if pushed {
+			stats.PushedCount++
+		}
+		if errors.Is(job.err, errMaxPushesReached) {
+			droppedPushes++
+		}
+		if fallback {
+			usePreloadLinks = true
+		}
+	}
+
+	if droppedPushes > 0 && v.onPushLimitReached != nil {
+		v.onPushLimitReached(req, droppedPushes)
+	}
+
+	if v.maxLinkHeaderBytes > 0 {
+		var droppedLinks int
+		for _, dropped := range preloadedRelations {
+			if dropped {
+				droppedLinks++
+			}
+		}
+
+		if droppedLinks > 0 {
+			logger.Warn("link preload headers dropped, maximum size reached", zap.Int("dropped", droppedLinks), zap.Int("maxLinkHeaderBytes", v.maxLinkHeaderBytes))
+		}
+	}
+
+	stats.PreloadedCount = len(linkHeaders["Link"]) - initialLinkHeaders
+	// The BOM is stripped before traversing the document
+	stats.BodyModified = !bytes.Equal(currentBody, newBody) || (hasBOM && !v.preserveBOM)
+	if hasBOM && v.preserveBOM {
+		newBody = append(append(make([]byte, 0, len(utf8BOM)+len(newBody)), utf8BOM...), newBody...)
+	}
+
+	if v.coalesceLinkHeader && len(linkHeaders["Link"]) > 0 {
+		responseHeaders.Add("Link", strings.Join(linkHeaders["Link"], ", "))
+	}
+
+	if usePreloadLinks {
+		if v.enableEarlyHints {
+			if !v.jsonStreaming && v.earlyHintsBatchSize <= 0 {
+				v.sendEarlyHints(rw, responseHeaders["Link"])
+			} else {
+				flushEarlyHints(1)
+			}
+		}
+
+	}
+
+	if !v.dryRun {
+		if hasTrailers(responseHeaders) {
+			// A Content-Length header would prevent the trailers to be sent
+			responseHeaders.Del("Content-Length")
+		} else if !v.withoutContentLength {
+			// The body is entirely buffered, a stale chunked transfer encoding must not be sent along with the Content-Length header
+			responseHeaders.Del("Transfer-Encoding")
+			responseHeaders.Set("Content-Length", strconv.Itoa(len(newBody)))
+		} else if stats.BodyModified {
+			// The Content-Length header of the upstream response is stale
+			responseHeaders.Del("Content-Length")
+		}
+		v.addVaryHeaders(responseHeaders, usePreloadLinks, fieldsHeader)
+		if minimal {
+			responseHeaders.Add("Preference-Applied", "return=minimal")
+			responseHeaders.Add("Vary", "Prefer")
+		}
+		if v.serverTiming {
+			v.addServerTiming(req, rw, responseHeaders, parseDuration, traverseDuration)
+		}
+	}
+
+	if ctxErr != nil {
+		applyErrors = append(applyErrors, ctxErr)
 	}
+
+	return newBody, stats, errors.Join(applyErrors...)
 }
 
-// WithEarlyHints instructs the gateway server to send Preload hints in 103 Early Hints response.
-// Enabling this setting is usually useless because the gateway server doesn't supports JSON streaming yet,
-// consequently the server will have to wait for the full JSON response to be received from upstream before being able
-// to compute the Link headers to send.
-// When the full response is available, we can send the final response directly.
-// Better send Early Hints responses as soon as possible, directly from the upstream application.
-// The proxy will forward them even if this option is not enabled.
-func WithEarlyHints() Option {
-	return func(o *opt) {
-		o.enableEarlyHints = true
+// utf8BOM is the UTF-8 byte order mark
+var utf8BOM = []byte{0xef, 0xbb, 0xbf}
+
+// stripBOM removes the UTF-8 byte order mark at the beginning of r, if any
+func stripBOM(r io.Reader) (io.Reader, bool, error) {
+	prefix := make([]byte, len(utf8BOM))
+	n, err := io.ReadFull(r, prefix)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, false, err
 	}
-}
 
-// WithMaxPushes sets the maximum number of resources to push
-// There is no limit by default
-func WithMaxPushes(maxPushes int) Option {
-	return func(o *opt) {
-		o.maxPushes = maxPushes
+	if bytes.Equal(prefix[:n], utf8BOM) {
+		return r, true, nil
 	}
+
+	return io.MultiReader(bytes.NewReader(prefix[:n]), r), false, nil
 }
 
-// WithLogger sets the logger to use
-func WithLogger(logger *zap.Logger) Option {
-	return func(o *opt) {
-		o.logger = logger
+// addVaryHeaders adds the Vary headers allowed by the Vary policy
+func (v *Vulcain) addVaryHeaders(h http.Header, preload, fields bool) {
+	var vary []string
+	if preload && v.varyPolicy&VaryPreload != 0 {
+		vary = append(vary, "Preload")
+	}
+	if fields && v.varyPolicy&VaryFields != 0 {
+		vary = append(vary, "Fields")
 	}
-}
 
-func WithApiUrl(apiUrl string) Option {
-	return func(o *opt) {
-		o.apiUrl = apiUrl
+	if len(vary) == 0 {
+		return
 	}
-}
 
-type opt struct {
-	openAPIFile      string
-	enableEarlyHints bool
-	maxPushes        int
-	apiUrl			 string
-	logger           *zap.Logger
+	if v.varyPolicy&VaryMerged != 0 {
+		h.Add("Vary", strings.Join(vary, ", "))
+
+		return
+	}
+
+	for _, value := range vary {
+		h.Add("Vary", value)
+	}
 }
 
-// Vulcain is the entrypoint of the library
-// Use New() to create an instance
-type Vulcain struct {
-	enableEarlyHints bool
-	pushers          *pushers
-	openAPI          *openAPI
-	logger           *zap.Logger
-	apiUrl			 string
+// sendEarlyHints sends a 103 Early Hints response containing the given Link headers
+func (v *Vulcain) sendEarlyHints(rw http.ResponseWriter, links []string) {
+	h := rw.Header()
+
+	// rw.Header() isn't always the same as the response headers (e.g. when using the built-in reverse proxy),
+	// temporarily set the Link headers to send the 103 response
+	previous, ok := h["Link"]
+	h["Link"] = links
+	rw.WriteHeader(http.StatusEarlyHints)
+	if ok {
+		h["Link"] = previous
+	} else {
+		delete(h, "Link")
+	}
 }
 
-// New creates a Vulcain instance
-func New(options ...Option) *Vulcain {
-	opt := &opt{
-		maxPushes: -1,
+// negotiateContentType returns the offered media type preferred according to the Accept header values, or an empty string if none is acceptable
+// As defined by RFC 9110, the quality of an offer is the one of the most specific matching media range (e.g. application/json;q=0 excludes application/json even with */*)
+// Media types with the same quality are ordered as in the Accept header, then as in offers
+func negotiateContentType(accept []string, offers []string) string {
+	if len(offers) == 0 {
+		return ""
 	}
 
-	for _, o := range options {
-		o(opt)
+	type acceptedRange struct {
+		mediaRange string
+		q          float64
 	}
 
-	if opt.logger == nil {
-		opt.logger = zap.NewNop()
+	var ranges []acceptedRange
+	for _, r := range strings.Split(strings.Join(accept, ","), ",") {
+		mediaRange, params, _ := strings.Cut(r, ";")
+		mediaRange = strings.ToLower(strings.TrimSpace(mediaRange))
+		if mediaRange == "" {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			if name, value, ok := strings.Cut(param, "="); ok && strings.TrimSpace(name) == "q" {
+				if f, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+					q = f
+				}
+			}
+		}
+
+		ranges = append(ranges, acceptedRange{mediaRange, q})
 	}
 
-	var o *openAPI
-	if opt.openAPIFile != "" {
-		o = newOpenAPI(opt.openAPIFile, opt.logger)
+	var (
+		best    string
+		bestQ   float64
+		bestPos int
+	)
+	for _, offer := range offers {
+		mediaType := strings.ToLower(offer)
+
+		specificity, q, pos := -1, 0.0, 0
+		for i, r := range ranges {
+			if s := mediaRangeSpecificity(r.mediaRange); s > specificity && matchMediaRange(r.mediaRange, mediaType) {
+				specificity, q, pos = s, r.q, i
+			}
+		}
+
+		if q > 0 && (q > bestQ || (q == bestQ && pos < bestPos)) {
+			best, bestQ, bestPos = offer, q, pos
+		}
+	}
+
+	return best
+}
+
+// mediaRangeSpecificity returns 0 for */*, 1 for type/* and 2 for a media type
+func mediaRangeSpecificity(mediaRange string) int {
+	switch {
+	case mediaRange == "*/*":
+		return 0
+	case strings.HasSuffix(mediaRange, "/*"):
+		return 1
+	default:
+		return 2
 	}
+}
 
-	return &Vulcain{
-		opt.enableEarlyHints,
-		&pushers{maxPushes: opt.maxPushes, pusherMap: make(map[string]*waitPusher), logger: opt.logger},
-		o,
-		opt.logger,
-		opt.apiUrl,
+// matchMediaRange tells if the media type matches the media range (e.g. application/*)
+func matchMediaRange(mediaRange, mediaType string) bool {
+	if mediaRange == "*/*" || mediaRange == mediaType {
+		return true
 	}
+
+	prefix, ok := strings.CutSuffix(mediaRange, "/*")
+
+	return ok && strings.HasPrefix(mediaType, prefix+"/")
 }
 
-// extractFromRequest extracts the "fields" and "preload" directives from the appropriate HTTP headers and query parameters
-func extractFromRequest(req *http.Request) (fields, preload httpsfv.List, fieldsHeader, fieldsQuery, preloadHeader, preloadQuery bool) {
-	query := req.URL.Query()
-	var err error
-	if len(req.Header["Fields"]) > 0 {
-		if fields, err = httpsfv.UnmarshalList(req.Header["Fields"]); err == nil {
-			fieldsHeader = true
+// propagatedCacheControlDirectives are the Cache-Control directives copied by WithPropagateCacheControl
+var propagatedCacheControlDirectives = map[string]struct{}{
+	"max-age":          {},
+	"s-maxage":         {},
+	"must-revalidate":  {},
+	"proxy-revalidate": {},
+	"no-cache":         {},
+	"no-transform":     {},
+}
+
+// propagatedCacheControl returns the directives of the Cache-Control header values to copy to the pushed requests
+func propagatedCacheControl(values []string) (directives []string) {
+	for _, value := range values {
+		for _, directive := range strings.Split(value, ",") {
+			directive = strings.TrimSpace(directive)
+			name, _, _ := strings.Cut(directive, "=")
+			if _, ok := propagatedCacheControlDirectives[strings.ToLower(strings.TrimSpace(name))]; ok {
+				directives = append(directives, directive)
+			}
 		}
 	}
 
-	if !fieldsHeader && len(query["fields"]) > 0 {
-		if fields, err = httpsfv.UnmarshalList(query["fields"]); err == nil {
-			fieldsQuery = true
-		}
+	return directives
+}
+
+// mergeCacheControl adds the directives to the Cache-Control header, except the ones already set
+func mergeCacheControl(h http.Header, directives []string) {
+	if len(directives) == 0 {
+		return
 	}
 
-	if len(req.Header["Preload"]) > 0 {
-		if preload, err = httpsfv.UnmarshalList(req.Header["Preload"]); err == nil {
-			preloadHeader = true
+	existing := make(map[string]struct{})
+	for _, value := range h.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			name, _, _ := strings.Cut(directive, "=")
+			existing[strings.ToLower(strings.TrimSpace(name))] = struct{}{}
 		}
 	}
 
-	if !preloadHeader && len(query["preload"]) > 0 {
-		if preload, err = httpsfv.UnmarshalList(query["preload"]); err == nil {
-			preloadQuery = true
+	var added []string
+	for _, directive := range directives {
+		name, _, _ := strings.Cut(directive, "=")
+		if _, ok := existing[strings.ToLower(strings.TrimSpace(name))]; !ok {
+			added = append(added, directive)
 		}
 	}
 
-	return fields, preload, fieldsHeader, fieldsQuery, preloadHeader, preloadQuery
+	if len(added) > 0 {
+		h.Add("Cache-Control", strings.Join(added, ", "))
+	}
 }
 
-// getOpenAPIRoute gets the routers.Route instance corresponding to the given URL
-func (v *Vulcain) getOpenAPIRoute(url *url.URL, route *routers.Route, routeTested bool) *routers.Route {
-	if routeTested || v.openAPI == nil {
-		return route
+// Finish cleanups the waitPusher and, if it's the explicit response, waits for all PUSH_PROMISEs to be sent before returning.
+// Finish must always be called, even if IsValidRequest or IsValidResponse returns false.
+// If the current response is the explicit one and wait is false, then the body is sent instantly, even if all PUSH_PROMISEs haven't been sent yet.
+func (v *Vulcain) Finish(req *http.Request, wait bool) {
+	v.FinishWithDuration(req, wait)
+}
+
+// FinishWithDuration is like Finish, but returns how long it waited for the PUSH_PROMISEs to be sent.
+// It allows to identify when waiting for pushes adds latency to the explicit response.
+// The returned duration is always 0 for pushed requests, and when wait is false.
+func (v *Vulcain) FinishWithDuration(req *http.Request, wait bool) time.Duration {
+	waited := v.pushers.finish(req, wait)
+	v.releaseBuffers(req)
+
+	if v.serverTiming && wait {
+		if state := getRequestState(req); state != nil {
+			state.Lock()
+			if h := state.serverTimingHeader; h != nil && canSendTrailers(req, h) {
+				h.Add(http.TrailerPrefix+"Server-Timing", serverTimingEntry("vulcain-push", waited))
+			}
+			state.Unlock()
+		}
 	}
 
-	return v.openAPI.getRoute(url)
+	if waited > 0 {
+		v.requestLogger(req).Debug("waited for PUSH_PROMISEs", zap.Duration("duration", waited))
+	}
+
+	return waited
 }
 
-// CreateRequestContext assign the waitPusher used by other functions to the request context.
-// CreateRequestContext must always be called first.
-func (v *Vulcain) CreateRequestContext(rw http.ResponseWriter, req *http.Request) context.Context {
-	return context.WithValue(req.Context(), ctxKey{}, v.pushers.getPusherForRequest(rw, req))
+// stateCtxKey is the context key of the requestState
+type stateCtxKey struct{}
+
+// maxPooledBufferSize is the maximum capacity of a buffer put back in the pool, to not retain huge responses in memory
+const maxPooledBufferSize = 1 << 20
+
+// requestState stores the data collected during the request by IsValidResponse and Apply
+type requestState struct {
+	sync.Mutex
+	// buffers borrowed from the pool
+	buffers []*bytes.Buffer
+	// status is the status code of the response checked by IsValidResponse
+	status int
+	// pushCacheControl contains the Cache-Control directives to copy to the pushed requests (see WithPropagateCacheControl)
+	pushCacheControl []string
+	// serverTimingHeader contains the headers of the http.ResponseWriter to which the Server-Timing entry of the push wait phase is added (see WithServerTiming)
+	serverTimingHeader http.Header
 }
 
-// IsValidRequest tells if this request contains at least one Vulcain directive.
-// IsValidRequest must always be called before Apply.
-func (v *Vulcain) IsValidRequest(req *http.Request) bool {
-	query := req.URL.Query()
+// getRequestState returns the requestState of the request, or nil if the request context hasn't been created using CreateRequestContext
+func getRequestState(req *http.Request) *requestState {
+	state, _ := req.Context().Value(stateCtxKey{}).(*requestState)
 
-	// No Vulcain hints: don't modify the response
-	return req.Header.Get("Preload") != "" ||
-		req.Header.Get("Fields") != "" ||
-		query.Get("preload") != "" ||
-		query.Get("fields") != ""
+	return state
 }
 
-// IsValidResponse checks if Apply will be able to deal with this response.
-func (v *Vulcain) IsValidResponse(req *http.Request, responseStatus int, responseHeaders http.Header) bool {
-	// Not a success, marked as no-transform or not JSON: don't modify the response
-	if responseStatus < 200 ||
-		responseStatus > 300 ||
-		!jsonRe.MatchString(responseHeaders.Get("Content-Type")) ||
-		notransformRe.MatchString(responseHeaders.Get("Cache-Control")) {
+// getBuffer gets an empty buffer from the pool, it is released when calling Finish
+// It returns nil if the buffer pool isn't enabled or if the request context hasn't been created using CreateRequestContext
+func (v *Vulcain) getBuffer(req *http.Request) *bytes.Buffer {
+	if v.bufferPool == nil {
+		return nil
+	}
 
-		return false
+	state := getRequestState(req)
+	if state == nil {
+		return nil
 	}
 
-	prefers, ok := req.Header["Prefer"]
-	if !ok {
-		return true
+	buf := v.bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+
+	state.Lock()
+	state.buffers = append(state.buffers, buf)
+	state.Unlock()
+
+	return buf
+}
+
+// releaseBuffers puts the buffers used for the request back in the pool, too large buffers are dropped
+func (v *Vulcain) releaseBuffers(req *http.Request) {
+	if v.bufferPool == nil {
+		return
 	}
 
-	for _, p := range prefers {
-		if preferRe.MatchString(p) {
-			return true
-		}
+	state := getRequestState(req)
+	if state == nil {
+		return
 	}
 
-	return false
+	state.Lock()
+	defer state.Unlock()
+
+	for _, buf := range state.buffers {
+		if buf.Cap() <= maxPooledBufferSize {
+			v.bufferPool.Put(buf)
+		}
+	}
+	state.buffers = nil
 }
 
-// Apply pushes the requested relations, modifies the response headers and returns a modified response to send to the client.
-// It's the responsibility of the caller to use the updated response body.
-// Apply must not be called if IsValidRequest or IsValidResponse return false.
-func (v *Vulcain) Apply(req *http.Request, rw http.ResponseWriter, responseBody io.Reader, responseHeaders http.Header) ([]byte, error) {
-	f, p, fieldsHeader, fieldsQuery, preloadHeader, preloadQuery := extractFromRequest(req)
+// addPreloadHeader sets preload Link rel=preload headers as fallback when Server Push isn't available (https://www.w3.org/TR/preload/).
+// The nopush attribute is always added if WithNopushByDefault is set.
+// If preloaded isn't nil, it's used to skip the links already added during the current request.
+// The header isn't added if it would exceed the limit set using WithMaxLinkHeaderBytes, the link is then marked as dropped in preloaded.
+func (v *Vulcain) addPreloadHeader(h http.Header, preloaded map[string]bool, link string, nopush bool, logger *zap.Logger) {
+	if preloaded != nil {
+		if _, ok := preloaded[link]; ok {
+			logger.Debug("link preload header already added", zap.String("relation", link))
 
-	currentBody, err := io.ReadAll(responseBody)
-	if err != nil {
-		return nil, err
+			return
+		}
+
+		preloaded[link] = false
 	}
 
-	tree := &node{}
-	tree.importPointers(preload, p)
-	tree.importPointers(fields, f)
+	if len(v.apiUrl) > 0 {
+		link = v.apiUrl + link
+	}
 
-	var (
-		oaRoute                        *routers.Route
-		oaRouteTested, usePreloadLinks bool
-	)
-	newBody := v.traverseJSON(currentBody, tree, len(f) > 0, func(n *node, val string) string {
-		var (
-			u        *url.URL
-			useOA    bool
-			newValue string
-		)
+	rel, as := "preload", "fetch"
+	if v.linkRel != nil {
+		rel, as = v.linkRel(link)
+	}
 
-		oaRoute, oaRouteTested = v.getOpenAPIRoute(req.URL, oaRoute, oaRouteTested), true
-		if u, useOA, err = v.parseRelation(n.String(), val, oaRoute); err != nil {
-			return ""
-		}
+	attributes := "; rel=" + rel
+	if as != "" {
+		attributes += "; as=" + as
+	}
+	if nopush || v.nopushByDefault {
+		attributes += "; nopush"
+	}
 
-		// Never rewrite values when using OpenAPI, use headers instead of query parameters
-		if (preloadQuery || fieldsQuery) && !useOA {
-			urlRewriter(u, n)
-			newValue = u.String()
+	value := "<" + link + ">" + attributes
+	if v.maxLinkHeaderBytes > 0 && linkHeaderSize(h)+len(value) > v.maxLinkHeaderBytes {
+		if preloaded != nil {
+			preloaded[link] = true
 		}
+		logger.Debug("link preload header dropped, maximum size reached", zap.String("relation", link))
+
+		return
+	}
+
+	h.Add("Link", value)
+	v.metrics.PreloadHeaderAdded(link)
+	logger.Debug("link preload header added", zap.String("relation", link))
+}
+
+// linkHeaderSize returns the cumulative size of the values of the Link headers
+func linkHeaderSize(h http.Header) int {
+	var size int
+	for _, l := range h["Link"] {
+		size += len(l)
+	}
+
+	return size
+}
+
+// addPreconnectHeader adds a Link rel=preconnect header for the origin of a cross-origin relation (https://www.w3.org/TR/resource-hints/#preconnect), once per origin
+func addPreconnectHeader(h http.Header, req *http.Request, u *url.URL, logger *zap.Logger) {
+	if u.Host == "" || strings.EqualFold(u.Host, req.Host) {
+		return
+	}
 
-		if n.preload {
-			usePreloadLinks = !v.push(u, rw, req, responseHeaders, n, preloadHeader, fieldsHeader)
+	origin := u.Scheme + "://" + u.Host
+	link := "<" + origin + ">; rel=preconnect"
+	for _, l := range h["Link"] {
+		if l == link {
+			return
 		}
+	}
 
-		return newValue
-	})
+	h.Add("Link", link)
+	logger.Debug("link preconnect header added", zap.String("origin", origin))
+}
 
-	if usePreloadLinks {
-		if v.enableEarlyHints {
-			h := rw.Header()
+// preloadLink is a relation declared by the upstream using a Link rel=preload header
+type preloadLink struct {
+	target string
+	// pointer is the JSON pointer of the relation in the document, set using the anchor parameter (e.g. anchor="#/author")
+	pointer string
+}
 
-			// If responseHeaders is not the same as rw.Header() (e.g. when using the built-in reverse proxy)
-			// temporarly copy Link headers to send the 103 response
-			_, ok := h["Link"]
-			if !ok {
-				h["Link"] = responseHeaders["Link"]
+// preloadLinks extracts the Link rel=preload headers having a JSON pointer as anchor
+func preloadLinks(values []string) []preloadLink {
+	var links []preloadLink
+	for _, value := range values {
+		for {
+			start := strings.IndexByte(value, '<')
+			end := strings.IndexByte(value, '>')
+			if start == -1 || end < start {
+				break
 			}
-			rw.WriteHeader(http.StatusEarlyHints)
-			if !ok {
-				delete(h, "Link")
+
+			target := value[start+1 : end]
+			value = value[end+1:]
+
+			params := value
+			if i := strings.IndexByte(value, ','); i != -1 {
+				params, value = value[:i], value[i+1:]
+			} else {
+				value = ""
+			}
+
+			var (
+				isPreload bool
+				pointer   string
+				hasAnchor bool
+			)
+			for _, param := range strings.Split(params, ";") {
+				k, v, _ := strings.Cut(strings.TrimSpace(param), "=")
+				v = strings.Trim(strings.TrimSpace(v), `"`)
+
+				switch strings.ToLower(strings.TrimSpace(k)) {
+				case "rel":
+					for _, rel := range strings.Fields(v) {
+						if strings.EqualFold(rel, "preload") {
+							isPreload = true
+							break
+						}
+					}
+				case "anchor":
+					// The URI fragment identifier representation of a JSON pointer (RFC 6901, section 6)
+					if fragment, ok := strings.CutPrefix(v, "#"); ok {
+						pointer, hasAnchor = fragment, true
+						if p, err := url.PathUnescape(fragment); err == nil {
+							pointer = p
+						}
+					}
+				}
+			}
+
+			if isPreload && hasAnchor && strings.HasPrefix(pointer, "/") {
+				links = append(links, preloadLink{target, pointer})
 			}
 		}
+	}
+
+	return links
+}
 
-		responseHeaders.Add("Vary", "Preload")
+// isAllowedPushHost checks if the host of the relation is allowed to be pushed or preloaded
+func (v *Vulcain) isAllowedPushHost(req *http.Request, u *url.URL) bool {
+	if v.allowedPushHosts == nil {
+		return true
 	}
 
-	responseHeaders.Set("Content-Length", strconv.Itoa(len(newBody)))
-	if fieldsHeader {
-		responseHeaders.Add("Vary", "Fields")
+	// Protocol-relative relations (//example.com/foo) have a host even if they aren't absolute
+	host := u.Hostname()
+	if host == "" && u.Host == "" {
+		if v.apiUrl == "" {
+			host = (&url.URL{Host: req.Host}).Hostname()
+		} else if apiURL, err := url.Parse(v.apiUrl + u.String()); err == nil {
+			// Resolved the same way as by addPreloadHeader
+			host = apiURL.Hostname()
+		}
 	}
 
-	return newBody, nil
+	_, ok := v.allowedPushHosts[strings.ToLower(host)]
+
+	return ok
 }
 
-// Finish cleanups the waitPusher and, if it's the explicit response, waits for all PUSH_PROMISEs to be sent before returning.
-// Finish must always be called, even if IsValidRequest or IsValidResponse returns false.
-// If the current response is the explicit one and wait is false, then the body is sent instantly, even if all PUSH_PROMISEs haven't been sent yet.
-func (v *Vulcain) Finish(req *http.Request, wait bool) {
-	v.pushers.finish(req, wait)
+// pushJob is a relation ready to be pushed
+type pushJob struct {
+	pusher    *waitPusher
+	url       string
+	options   *http.PushOptions
+	n         *node
+	maxPushes int
+	err       error
+	span      trace.Span
+	// panicErr is set if the push panicked in a worker or in the goroutine of the push timeout, the panic is propagated to the goroutine of Apply
+	panicErr *PanicError
 }
 
-// addPreloadHeader sets preload Link rel=preload headers as fallback when Server Push isn't available (https://www.w3.org/TR/preload/).
-func (v *Vulcain) addPreloadHeader(h http.Header, link string, nopush bool) {
-	var suffix string
-	if nopush {
-		suffix = "; nopush"
+// run pushes the relation, the error is stored in the job
+func (j *pushJob) run() {
+	j.err = j.pusher.Push(j.url, j.options, j.maxPushes)
+
+	// The underlying pusher panicked in another goroutine (see WithPushTimeout)
+	if panicErr, ok := j.err.(*PanicError); ok {
+		j.panicErr = panicErr
 	}
-	if len(v.apiUrl) > 0 {
-		link = v.apiUrl + link
+}
+
+// repanic propagates a panic recovered in another goroutine to the goroutine of Apply
+// The original value is used, as if the panic occurred in this goroutine, unless WithPanicRecovery is set: applyWithRecovery then reuses the stack trace of the *PanicError
+func (v *Vulcain) repanic(panicErr *PanicError) {
+	if v.panicRecovery {
+		panic(panicErr)
 	}
-	h.Add("Link", "<"+link+">; rel=preload; as=fetch"+suffix)
-	v.logger.Debug("link preload header added", zap.String("relation", link))
+
+	panic(panicErr.Value)
 }
 
 // push pushes a relation or adds a Link rel=preload header as a fallback.
-// TODO: allow to set the nopush attribute using the configuration (https://www.w3.org/TR/preload/#server-push-http-2)
-func (v *Vulcain) push(u *url.URL, rw http.ResponseWriter, req *http.Request, newHeaders http.Header, n *node, preloadHeader, fieldsHeader bool) bool {
+// maxPushes is the maximum number of resources to push (-1 for unlimited).
+// pushed is true if the relation has been pushed, fallback is true if the relation must be preloaded using the Link header instead.
+// limited is true if the relation hasn't been pushed because the maximum number of pushes has been reached.
+func (v *Vulcain) push(u *url.URL, rw http.ResponseWriter, req *http.Request, newHeaders http.Header, preloaded map[string]bool, n *node, preloadHeader, fieldsHeader bool, maxPushes int) (pushed, fallback, limited bool) {
+	job, fallback := v.preparePush(u, req, newHeaders, preloaded, n, preloadHeader, fieldsHeader, maxPushes)
+	if job == nil {
+		return false, fallback, false
+	}
+
+	job.run()
+	if job.panicErr != nil {
+		v.repanic(job.panicErr)
+	}
+	pushed, fallback = v.finishPush(job, req, newHeaders, preloaded)
+
+	return pushed, fallback, errors.Is(job.err, errMaxPushesReached)
+}
+
+// preparePush adds a Link rel=preload header if the relation cannot be pushed, or returns the job to run to push it.
+func (v *Vulcain) preparePush(u *url.URL, req *http.Request, newHeaders http.Header, preloaded map[string]bool, n *node, preloadHeader, fieldsHeader bool, maxPushes int) (job *pushJob, fallback bool) {
 	url := u.String()
+	logger := v.requestLogger(req)
 
-	if v.pushers.maxPushes == 0 || u.IsAbs() {
-		v.addPreloadHeader(newHeaders, url, true)
+	if maxPushes == 0 || u.IsAbs() {
+		if v.preconnect && u.IsAbs() {
+			addPreconnectHeader(newHeaders, req, u, logger)
+		}
+		v.addPreloadHeader(newHeaders, preloaded, url, true, logger)
 
-		return false
+		return nil, true
 	}
 
 	pusher := req.Context().Value(ctxKey{}).(*waitPusher)
-	if pusher == nil {
-		v.addPreloadHeader(newHeaders, url, false)
+	if pusher == nil || !acceptsPush(req) || !v.pushers.allowPush() {
+		v.addPreloadHeader(newHeaders, preloaded, url, false, logger)
 
-		return false
+		return nil, true
 	}
 
 	pushOptions := &http.PushOptions{Header: req.Header.Clone()}
-	pushOptions.Header.Set(internalRequestHeader, pusher.id)
 	pushOptions.Header.Del("Preload")
 	pushOptions.Header.Del("Fields")
 	pushOptions.Header.Del("Te") // Trailing headers aren't supported by Firefox for pushes, and we don't use them
+	if v.openAPIContentNegotiation && v.openAPI != nil {
+		ru := *u
+		if ru.Host == "" {
+			ru.Host = req.Host
+		}
+
+		route := v.openAPI.getRoute(&ru)
+		if t := negotiateContentType(req.Header.Values("Accept"), v.openAPI.getContentTypes(route)); t != "" {
+			pushOptions.Header.Set("Accept", t)
+		}
+	}
+	if v.propagateCacheControl {
+		if state := getRequestState(req); state != nil {
+			state.Lock()
+			mergeCacheControl(pushOptions.Header, state.pushCacheControl)
+			state.Unlock()
+		}
+	}
+	if v.pushHeaderFilter != nil {
+		v.pushHeaderFilter(pushOptions.Header)
+	}
+	pushOptions.Header.Set(v.pushers.internalRequestHeader, pusher.id)
 
 	if preloadHeader {
 		if preload := n.httpList(preload, ""); len(preload) > 0 {
@@ -332,38 +2719,124 @@ func (v *Vulcain) push(u *url.URL, rw http.ResponseWriter, req *http.Request, ne
 	}
 
 	// HTTP/2, and relative relation, push!
-	if err := pusher.Push(url, pushOptions); err != nil {
+	v.metrics.PushAttempted(url)
+
+	_, span := v.tracer.Start(req.Context(), "vulcain.push", trace.WithAttributes(attribute.String("vulcain.relation", url)))
+
+	return &pushJob{pusher: pusher, url: url, options: pushOptions, n: n, maxPushes: maxPushes, span: span}, false
+}
+
+// finishPush handles the result of a job, it adds a Link rel=preload header if the push failed.
+func (v *Vulcain) finishPush(job *pushJob, req *http.Request, newHeaders http.Header, preloaded map[string]bool) (pushed, fallback bool) {
+	logger := v.requestLogger(req)
+	defer job.span.End()
+
+	if err := job.err; err != nil {
 		// Don't add the preload header for something already pushed
 		if errors.Is(err, errRelationAlreadyPushed) {
-			return true
+			v.pushers.alreadyPushed.Add(1)
+
+			return false, false
+		}
+
+		v.pushers.failures.Add(1)
+
+		job.span.RecordError(err)
+		job.span.SetStatus(codes.Error, err.Error())
+
+		if v.pushers.breaker != nil && !errors.Is(err, errMaxPushesReached) {
+			v.pushers.breaker.failure()
+		}
+
+		v.metrics.PushFailed(job.url, err)
+		v.addPreloadHeader(newHeaders, preloaded, job.url, false, logger)
+		if errors.Is(err, errPushTimeout) {
+			logger.Warn("push timed out", zap.Stringer("node", job.n), zap.String("relation", job.url))
+		} else {
+			logger.Debug("failed to push", zap.Stringer("node", job.n), zap.String("relation", job.url), zap.Error(err))
 		}
 
-		v.addPreloadHeader(newHeaders, url, false)
-		v.logger.Debug("failed to push", zap.Stringer("node", n), zap.String("relation", url), zap.Error(err))
+		return false, true
+	}
+
+	if v.pushers.breaker != nil {
+		v.pushers.breaker.success()
+	}
+
+	v.pushers.promisesSent.Add(1)
+	v.metrics.PushSucceeded(job.url)
+	logger.Debug("relation pushed", zap.String("relation", job.url))
+	return true, false
+}
+
+// dryRunAction returns what push would do for the given relation, without pushing it.
+// pushes is the number of relations that would have been pushed for the current response, skipped is the reason why the relation mustn't be pushed, if any.
+func (v *Vulcain) dryRunAction(u *url.URL, req *http.Request, maxPushes, pushes int, skipped PushAction) PushAction {
+	if u.IsAbs() {
+		return PushActionSkippedAbsolute
+	}
+
+	if skipped != "" {
+		return skipped
+	}
+
+	if maxPushes == 0 || (maxPushes > 0 && pushes >= maxPushes) {
+		return PushActionMaxExceeded
+	}
+
+	if pusher, _ := req.Context().Value(ctxKey{}).(*waitPusher); pusher == nil || !acceptsPush(req) {
+		return PushActionPreload
+	}
+
+	return PushActionPush
+}
+
+// prefixRelationPath adds the prefix set using WithRelationPathPrefix to the path of a root-relative relation
+// It returns true if the path has been changed
+func (v *Vulcain) prefixRelationPath(u *url.URL) bool {
+	if v.relationPathPrefix == "" || u.IsAbs() || u.Host != "" || !strings.HasPrefix(u.Path, "/") {
+		return false
+	}
 
+	if u.Path == v.relationPathPrefix || strings.HasPrefix(u.Path, v.relationPathPrefix+"/") {
 		return false
 	}
 
-	v.logger.Debug("relation pushed", zap.String("relation", url))
+	u.Path = v.relationPathPrefix + u.Path
+	if u.RawPath != "" {
+		u.RawPath = v.relationPathPrefix + u.RawPath
+	}
+
 	return true
 }
 
-// parseRelation returns the URL of a relation, using OpenAPI to build it if necessary.
-func (v *Vulcain) parseRelation(selector, rel string, oaRoute *routers.Route) (*url.URL, bool, error) {
-	var useOA bool
+// parseRelation returns the URL of a relation, using the relation resolver or OpenAPI to build it if necessary.
+// n is the node matching the relation, if known.
+func (v *Vulcain) parseRelation(selector, rel string, oaRoute *routers.Route, n *node, logger *zap.Logger) (*url.URL, bool, string, error) {
+	var (
+		useOA  bool
+		method string
+	)
+	if v.relationResolver != nil {
+		if resolved, ok := v.relationResolver(selector, rel); ok {
+			rel = resolved
+			oaRoute = nil
+		}
+	}
+
 	if oaRoute != nil {
-		if oaRel := v.openAPI.getRelation(oaRoute, selector, rel); oaRel != "" {
-			rel = oaRel
+		if oaRel, oaMethod := v.openAPI.getRelationOperation(oaRoute, selector, rel, n); oaRel != "" {
+			rel, method = oaRel, oaMethod
 			useOA = true
 		}
 	}
 
 	u, err := url.Parse(rel)
 	if err == nil {
-		return u, useOA, nil
+		return u, useOA, method, nil
 	}
 
-	v.logger.Debug("the relation is an invalid URL", zap.String("node", selector), zap.String("relation", rel), zap.Error(err))
+	logger.Debug("the relation is an invalid URL", zap.String("node", selector), zap.String("relation", rel), zap.Error(err))
 
-	return nil, useOA, err
+	return nil, useOA, method, err
 }
@@ -1,11 +1,26 @@
 package vulcain
 
 import (
+	"bytes"
+	"context"
 	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
 	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
 )
 
 func TestNew(t *testing.T) {
@@ -18,13 +33,36 @@ func TestParseRelation(t *testing.T) {
 
 	u, _ := url.Parse("/oa/books/123")
 
-	u, _, _ = v.parseRelation("/author", "123", v.getOpenAPIRoute(u, nil, false))
+	u, _, method, _ := v.parseRelation("/author", "123", v.getOpenAPIRoute(u, nil, false), nil, v.logger)
 	assert.Equal(t, "/oa/authors/123", u.String())
+	assert.Equal(t, http.MethodGet, method)
 
-	u, _, _ = v.parseRelation("/invalid", " http://foo.com", nil)
+	u, _ = url.Parse("/oa/authors/1")
+	u, _, method, _ = v.parseRelation("/reviews", "1", v.getOpenAPIRoute(u, nil, false), nil, v.logger)
+	assert.Equal(t, "/oa/authors/1/reviews", u.String())
+	assert.Equal(t, http.MethodPost, method)
+
+	u, _, _, _ = v.parseRelation("/invalid", " http://foo.com", nil, nil, v.logger)
 	assert.Nil(t, u)
 }
 
+func TestResolveRelation(t *testing.T) {
+	v := New(WithOpenAPIFile(openapiFixture))
+
+	u, useOA, err := v.ResolveRelation(httptest.NewRequest("GET", "/oa/books/123", nil), "/author", "456")
+	assert.NoError(t, err)
+	assert.True(t, useOA)
+	assert.Equal(t, "/oa/authors/456", u.String())
+
+	u, useOA, err = v.ResolveRelation(httptest.NewRequest("GET", "/books/1", nil), "/author", "/authors/1")
+	assert.NoError(t, err)
+	assert.False(t, useOA)
+	assert.Equal(t, "/authors/1", u.String())
+
+	_, _, err = v.ResolveRelation(httptest.NewRequest("GET", "/books/1", nil), "/author", " http://foo.com")
+	assert.Error(t, err)
+}
+
 func TestIsValidRequest(t *testing.T) {
 	v := New()
 
@@ -41,6 +79,58 @@ func TestIsValidRequest(t *testing.T) {
 	}))
 }
 
+func TestIsValidRequestEmptyDirectives(t *testing.T) {
+	v := New()
+
+	assert.False(t, v.IsValidRequest(&http.Request{
+		Header: http.Header{"Preload": []string{""}},
+		URL:    &url.URL{},
+	}))
+	assert.False(t, v.IsValidRequest(&http.Request{
+		Header: http.Header{"Fields": []string{"  "}, "Preload": []string{"", "\t"}},
+		URL:    &url.URL{},
+	}))
+	assert.False(t, v.IsValidRequest(&http.Request{URL: &url.URL{RawQuery: "preload="}}))
+	assert.False(t, v.IsValidRequest(&http.Request{URL: &url.URL{RawQuery: "fields=&preload=%20"}}))
+
+	// Non-empty values of a directive are still taken into account
+	assert.True(t, v.IsValidRequest(&http.Request{
+		Header: http.Header{"Preload": []string{"", `"/foo"`}},
+		URL:    &url.URL{},
+	}))
+}
+
+func TestSkipPaths(t *testing.T) {
+	core, logs := observer.New(zap.ErrorLevel)
+	v := New(WithSkipPaths("/metrics", "/downloads/*"), WithSkipPaths("[", "/healthz"), WithLogger(zap.New(core)))
+	assert.Equal(t, 1, logs.FilterMessage("invalid skip path pattern").Len())
+
+	for target, valid := range map[string]bool{
+		`/metrics?preload="/foo"`:                  false,
+		`/downloads/1984.pdf?preload="/foo"`:       false,
+		`/healthz?fields="/foo"`:                   false,
+		`/downloads/1984/cover.jpg?preload="/foo"`: true,
+		`/books/1?preload="/foo"`:                  true,
+	} {
+		assert.Equal(t, valid, v.IsValidRequest(httptest.NewRequest("GET", target, nil)), target)
+	}
+}
+
+func TestUserAgentFilter(t *testing.T) {
+	v := New(WithUserAgentFilter(func(ua string) bool {
+		return !strings.Contains(ua, "Googlebot")
+	}))
+
+	assert.False(t, v.IsValidRequest(&http.Request{
+		Header: http.Header{"Preload": []string{`"/foo"`}, "User-Agent": []string{"Mozilla/5.0 (compatible; Googlebot/2.1)"}},
+		URL:    &url.URL{},
+	}))
+	assert.True(t, v.IsValidRequest(&http.Request{
+		Header: http.Header{"Preload": []string{`"/foo"`}, "User-Agent": []string{"Mozilla/5.0"}},
+		URL:    &url.URL{},
+	}))
+}
+
 func TestIsValidResponse(t *testing.T) {
 	v := New()
 	assert.False(t, v.IsValidResponse(
@@ -111,3 +201,2120 @@ func TestIsValidResponse(t *testing.T) {
 		http.Header{"Content-Type": []string{"application/ld+json"}},
 	))
 }
+
+// pushRecorder is an http.ResponseWriter supporting HTTP/2 Server Push
+type pushRecorder struct {
+	*httptest.ResponseRecorder
+	pushed  []string
+	options []*http.PushOptions
+}
+
+func (p *pushRecorder) Push(target string, opts *http.PushOptions) error {
+	p.pushed = append(p.pushed, target)
+	p.options = append(p.options, opts)
+
+	return nil
+}
+
+// newTestRequest creates a request and its context, as done by the gateway server and the Caddy module
+func newTestRequest(v *Vulcain, rw http.ResponseWriter, target string, header http.Header) *http.Request {
+	req := httptest.NewRequest("GET", target, nil)
+	for k, values := range header {
+		req.Header[k] = values
+	}
+
+	return req.WithContext(v.CreateRequestContext(rw, req))
+}
+
+type recordingMetrics struct {
+	attempted, succeeded, failed, preloadHeaders []string
+}
+
+func (m *recordingMetrics) PushAttempted(relation string) {
+	m.attempted = append(m.attempted, relation)
+}
+
+func (m *recordingMetrics) PushSucceeded(relation string) {
+	m.succeeded = append(m.succeeded, relation)
+}
+
+func (m *recordingMetrics) PushFailed(relation string, err error) {
+	m.failed = append(m.failed, relation)
+}
+
+func (m *recordingMetrics) PreloadHeaderAdded(relation string) {
+	m.preloadHeaders = append(m.preloadHeaders, relation)
+}
+
+func TestMetrics(t *testing.T) {
+	m := &recordingMetrics{}
+	v := New(WithMetrics(m), WithMaxPushes(1))
+
+	rw := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	req := newTestRequest(v, rw, "/books/1", http.Header{"Preload": []string{`"/author", "/related"`}})
+	defer v.Finish(req, false)
+
+	_, err := v.Apply(req, rw, strings.NewReader(`{"author": "/authors/1", "related": "/books/2"}`), rw.Header())
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"/authors/1", "/books/2"}, m.attempted)
+	assert.Equal(t, []string{"/authors/1"}, m.succeeded)
+	assert.Equal(t, []string{"/books/2"}, m.failed)
+	assert.Equal(t, []string{"/books/2"}, m.preloadHeaders)
+	assert.Equal(t, []string{"/authors/1"}, rw.pushed)
+}
+
+func TestApplyUpstreamLinkHeaders(t *testing.T) {
+	v := New()
+
+	rw := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	rw.Header().Add("Link", `</authors/1>; rel=preload; as=fetch; anchor="#/author", </style.css>; rel="stylesheet"`)
+	rw.Header().Add("Link", `</books/2>; rel="preload"; anchor="#/related/0"`)
+	rw.Header().Add("Link", `</books/3>; rel="preload"; anchor="#/other"`)
+	rw.Header().Add("Link", `</books/4>; rel="preload"`)
+	req := newTestRequest(v, rw, "/books/1", http.Header{"Preload": []string{`"/author", "/related/*"`}})
+	defer v.Finish(req, false)
+
+	_, stats, err := v.ApplyWithStats(req, rw, strings.NewReader(`{"author": "/authors/1"}`), rw.Header())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/authors/1", "/books/2"}, rw.pushed)
+	assert.Equal(t, 2, stats.PushedCount)
+	assert.Len(t, rw.Header()["Link"], 4)
+}
+
+func TestApplyUpstreamLinkHeadersFallback(t *testing.T) {
+	v := New(WithMaxPushes(0))
+
+	rw := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	rw.Header().Add("Link", `</books/2>; rel=preload; as=fetch; anchor="#/related"`)
+	req := newTestRequest(v, rw, "/books/1", http.Header{"Preload": []string{`"/author", "/related"`}})
+	defer v.Finish(req, false)
+
+	_, err := v.Apply(req, rw, strings.NewReader(`{"author": "/authors/1"}`), rw.Header())
+	assert.NoError(t, err)
+	assert.Empty(t, rw.pushed)
+
+	// The upstream Link header isn't duplicated
+	assert.Equal(t, []string{`</books/2>; rel=preload; as=fetch; anchor="#/related"`, "</authors/1>; rel=preload; as=fetch; nopush"}, rw.Header()["Link"])
+}
+
+func TestPreloadLinks(t *testing.T) {
+	assert.Equal(t, []preloadLink{{"/a", "/a"}, {"/c", "/c/d~1e"}}, preloadLinks([]string{
+		`</a>; rel=preload; as=fetch; anchor="#/a", </b>; rel=next; anchor="#/b"`,
+		`</c>; rel="prefetch preload"; anchor="#/c/d~1e", </d>; rel=preload, </e>; rel=preload; anchor="/e"`,
+	}))
+	assert.Equal(t, []preloadLink{{"/a", "/a b"}}, preloadLinks([]string{`</a>; rel=preload; anchor="#/a%20b"`}))
+	assert.Empty(t, preloadLinks([]string{"invalid"}))
+}
+
+// stalledPusher is an http.Pusher blocking until release is closed
+type stalledPusher struct {
+	*httptest.ResponseRecorder
+	release chan struct{}
+}
+
+func (p *stalledPusher) Push(target string, opts *http.PushOptions) error {
+	<-p.release
+
+	return http.ErrNotSupported
+}
+
+func TestPushTimeout(t *testing.T) {
+	m := &recordingMetrics{}
+	v := New(WithMetrics(m), WithPushTimeout(10*time.Millisecond))
+
+	rw := &stalledPusher{ResponseRecorder: httptest.NewRecorder(), release: make(chan struct{})}
+	req := newTestRequest(v, rw, "/books/1", http.Header{"Preload": []string{`"/author"`}})
+
+	_, err := v.Apply(req, rw, strings.NewReader(`{"author": "/authors/1"}`), rw.Header())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"</authors/1>; rel=preload; as=fetch"}, rw.Header()["Link"])
+	assert.Equal(t, []string{"/authors/1"}, m.failed)
+
+	// The promise is released once the stalled push fails
+	close(rw.release)
+	v.Finish(req, true)
+}
+
+func TestFinishWithDuration(t *testing.T) {
+	v := New()
+
+	rw := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	req := newTestRequest(v, rw, "/books/1", http.Header{"Preload": []string{`"/author"`}})
+
+	_, err := v.Apply(req, rw, strings.NewReader(`{"author": "/authors/1"}`), rw.Header())
+	assert.NoError(t, err)
+	if !assert.Len(t, rw.options, 1) {
+		return
+	}
+
+	// The pushed request finishes later
+	pushedReq := newTestRequest(v, rw, "/authors/1", rw.options[0].Header)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		assert.Zero(t, v.FinishWithDuration(pushedReq, true))
+	}()
+
+	assert.GreaterOrEqual(t, v.FinishWithDuration(req, true), 20*time.Millisecond)
+
+	req = newTestRequest(v, rw, "/books/1", nil)
+	assert.Zero(t, v.FinishWithDuration(req, false))
+}
+
+func TestApplyDeduplicatePreloadHeaders(t *testing.T) {
+	v := New()
+
+	rw := httptest.NewRecorder()
+	req := newTestRequest(v, rw, "/posts", http.Header{"Preload": []string{`"/member/*/author"`}})
+	defer v.Finish(req, false)
+
+	_, err := v.Apply(req, rw, strings.NewReader(`{"member": [{"author": "/authors/1"}, {"author": "/authors/2"}, {"author": "/authors/1"}]}`), rw.Header())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"</authors/1>; rel=preload; as=fetch", "</authors/2>; rel=preload; as=fetch"}, rw.Header()["Link"])
+}
+
+func TestApplyWithStats(t *testing.T) {
+	v := New(WithMaxPushes(1))
+
+	rw := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	req := newTestRequest(v, rw, "/books/1", http.Header{"Preload": []string{`"/author", "/related"`}, "Fields": []string{`"/author", "/related"`}})
+	defer v.Finish(req, false)
+
+	_, stats, err := v.ApplyWithStats(req, rw, strings.NewReader(`{"title": "1984", "author": "/authors/1", "related": "/books/2"}`), rw.Header())
+	assert.NoError(t, err)
+	assert.Equal(t, ApplyStats{RelationCount: 2, PushedCount: 1, PreloadedCount: 1, BodyModified: true}, stats)
+
+	rw2 := httptest.NewRecorder()
+	req = newTestRequest(v, rw2, "/books/1", http.Header{"Preload": []string{`"/notexists"`}})
+	defer v.Finish(req, false)
+
+	_, stats, err = v.ApplyWithStats(req, rw2, strings.NewReader(`{"title": "1984"}`), rw2.Header())
+	assert.NoError(t, err)
+	assert.Equal(t, ApplyStats{}, stats)
+}
+
+func TestApplyOnPushLimitReached(t *testing.T) {
+	for _, concurrency := range []int{1, 2} {
+		var (
+			calls   int
+			dropped int
+		)
+		v := New(WithMaxPushes(1), WithPushConcurrency(concurrency), WithOnPushLimitReached(func(_ *http.Request, d int) {
+			calls++
+			dropped = d
+		}))
+
+		rw := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+		req := newTestRequest(v, rw, "/books/1", http.Header{"Preload": []string{`"/author", "/related", "/editor"`}})
+
+		_, err := v.Apply(req, rw, strings.NewReader(`{"author": "/authors/1", "related": "/books/2", "editor": "/editors/1"}`), rw.Header())
+		assert.NoError(t, err)
+		assert.Equal(t, 1, calls)
+		assert.Equal(t, 2, dropped)
+		v.Finish(req, false)
+
+		// Not called when the limit isn't reached
+		calls = 0
+		rw = &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+		req = newTestRequest(v, rw, "/books/1", http.Header{"Preload": []string{`"/author"`}})
+
+		_, err = v.Apply(req, rw, strings.NewReader(`{"author": "/authors/1"}`), rw.Header())
+		assert.NoError(t, err)
+		assert.Equal(t, 0, calls)
+		v.Finish(req, false)
+	}
+}
+
+func TestApplyBytes(t *testing.T) {
+	doc, err := os.ReadFile("fixtures/bom.json")
+	assert.NoError(t, err)
+
+	for _, tc := range []struct {
+		options  []Option
+		expected string
+	}{
+		{nil, `{"author":"/authors/1"}`},
+		{[]Option{WithPreserveBOM()}, "\ufeff" + `{"author":"/authors/1"}`},
+		{[]Option{WithJSONStreaming()}, `{"author":"/authors/1"}`},
+	} {
+		v := New(tc.options...)
+
+		rw := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+		req := newTestRequest(v, rw, "/books/1", http.Header{"Preload": []string{`"/author"`}, "Fields": []string{`"/author"`}})
+
+		b, err := v.ApplyBytes(req, rw, doc, rw.Header())
+		assert.NoError(t, err)
+		assert.Equal(t, tc.expected, string(b))
+		assert.Equal(t, []string{"/authors/1"}, rw.pushed)
+		v.Finish(req, false)
+	}
+
+	v := New(WithMaxBodySize(20))
+	rw := httptest.NewRecorder()
+	req := newTestRequest(v, rw, "/books/1", http.Header{"Preload": []string{`"/author"`}})
+	defer v.Finish(req, false)
+
+	_, err = v.ApplyBytes(req, rw, []byte(`{"title": "1984", "author": "/authors/1"}`), rw.Header())
+	assert.ErrorIs(t, err, ErrBodyTooLarge)
+}
+
+func TestApplyWithResult(t *testing.T) {
+	v := New(WithMaxPushes(0))
+
+	rw := httptest.NewRecorder()
+	req := newTestRequest(v, rw, "/books/1", http.Header{"Preload": []string{`"/author"`}, "Fields": []string{`"/author"`}})
+	defer v.Finish(req, false)
+
+	h := http.Header{"Content-Type": []string{"application/json"}, "Content-Length": []string{"42"}, "Transfer-Encoding": []string{"chunked"}, "Link": []string{"</>; rel=index"}}
+	result, err := v.ApplyWithResult(req, rw, strings.NewReader(`{"title": "1984", "author": "/authors/1"}`), h)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"author":"/authors/1"}`, string(result.Body))
+	assert.Equal(t, http.Header{
+		"Content-Length": []string{"23"},
+		"Link":           []string{"</>; rel=index", "</authors/1>; rel=preload; as=fetch; nopush"},
+		"Vary":           []string{"Preload", "Fields"},
+	}, result.Header)
+	assert.Equal(t, []string{"Transfer-Encoding"}, result.DeletedHeaders)
+	assert.Equal(t, ApplyStats{RelationCount: 1, PreloadedCount: 1, BodyModified: true}, result.Stats)
+
+	// The response headers are left untouched
+	assert.Equal(t, http.Header{"Content-Type": []string{"application/json"}, "Content-Length": []string{"42"}, "Transfer-Encoding": []string{"chunked"}, "Link": []string{"</>; rel=index"}}, h)
+
+	// The Content-Length header is removed when trailers are announced
+	v = New(WithCoalescedLinkHeader())
+	req = newTestRequest(v, rw, "/books/1", http.Header{"Preload": []string{`"/author", "/related"`}})
+	defer v.Finish(req, false)
+
+	h = http.Header{"Content-Length": []string{"42"}, "Trailer": []string{"X-Checksum"}, "Link": []string{"</>; rel=index"}}
+	result, err = v.ApplyWithResult(req, rw, strings.NewReader(`{"author": "/authors/1", "related": "/books/2"}`), h)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"</>; rel=index", "</authors/1>; rel=preload; as=fetch, </books/2>; rel=preload; as=fetch"}, result.Header["Link"])
+	assert.Equal(t, []string{"Content-Length"}, result.DeletedHeaders)
+
+	v = New(WithoutContentLength())
+	req = newTestRequest(v, rw, "/books/1", http.Header{"Fields": []string{`"/author"`}})
+	defer v.Finish(req, false)
+
+	result, err = v.ApplyWithResult(req, rw, strings.NewReader(`{"title": "1984", "author": "/authors/1"}`), nil)
+	assert.NoError(t, err)
+	assert.Empty(t, result.Header["Content-Length"])
+	assert.Empty(t, result.Header["Link"])
+}
+
+func TestTracer(t *testing.T) {
+	sr := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+	v := New(WithTracer(tp.Tracer("test")), WithMaxPushes(1))
+
+	ctx, parent := tp.Tracer("test").Start(context.Background(), "parent")
+	rw := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	req := httptest.NewRequest("GET", "/books/1", nil).WithContext(ctx)
+	req.Header.Set("Preload", `"/author", "/related"`)
+	req = req.WithContext(v.CreateRequestContext(rw, req))
+	defer v.Finish(req, false)
+
+	_, err := v.Apply(req, rw, strings.NewReader(`{"author": "/authors/1", "related": "/books/2"}`), rw.Header())
+	assert.NoError(t, err)
+	parent.End()
+
+	spans := sr.Ended()
+	names := make([]string, 0, len(spans))
+	for _, s := range spans {
+		names = append(names, s.Name())
+	}
+	assert.Equal(t, []string{"vulcain.push", "vulcain.push", "vulcain.traverse", "vulcain.Apply", "parent"}, names)
+
+	apply := spans[3]
+	assert.Equal(t, parent.SpanContext().SpanID(), apply.Parent().SpanID())
+	assert.Contains(t, apply.Attributes(), attribute.Int("vulcain.relations", 2))
+	assert.Contains(t, apply.Attributes(), attribute.Int("vulcain.pushed", 1))
+	assert.Contains(t, apply.Attributes(), attribute.Int("vulcain.body_size", 47))
+
+	assert.Equal(t, apply.SpanContext().SpanID(), spans[0].Parent().SpanID())
+	assert.Contains(t, spans[0].Attributes(), attribute.String("vulcain.relation", "/authors/1"))
+	assert.Equal(t, codes.Unset, spans[0].Status().Code)
+	assert.Contains(t, spans[1].Attributes(), attribute.String("vulcain.relation", "/books/2"))
+	assert.Equal(t, codes.Error, spans[1].Status().Code)
+}
+
+func TestApplyPushNestedDirectives(t *testing.T) {
+	v := New()
+
+	rw := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	req := newTestRequest(v, rw, "/books/1", http.Header{
+		"Preload": []string{`"/author/address", "/author/books/*"`},
+		"Fields":  []string{`"/title", "/author/name", "/author/address/city", "/author/books/*/title"`},
+	})
+	defer v.Finish(req, false)
+
+	b, err := v.Apply(req, rw, strings.NewReader(`{"title": "1984", "genre": "novel", "author": "/authors/1"}`), rw.Header())
+	assert.NoError(t, err)
+	assert.Equal(t, `{"author":"/authors/1","title":"1984"}`, string(b))
+	assert.Equal(t, []string{"/authors/1"}, rw.pushed)
+	assert.Equal(t, `"/address", "/books/*"`, rw.options[0].Header.Get("Preload"))
+	assert.Equal(t, `"/address/city", "/books/*/title", "/name"`, rw.options[0].Header.Get("Fields"))
+
+	// The pushed request must behave like a direct request to the sub-resource with the narrowed directives
+	pushed := rw.options[0].Header
+	rw = &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	req = newTestRequest(v, rw, "/authors/1", http.Header{"Preload": pushed["Preload"], "Fields": pushed["Fields"]})
+	defer v.Finish(req, false)
+
+	b, err = v.Apply(req, rw, strings.NewReader(`{"name": "George", "born": 1903, "address": "/addresses/1", "books": ["/books/1", "/books/2"]}`), rw.Header())
+	assert.NoError(t, err)
+	assert.Equal(t, `{"address":"/addresses/1","books":["/books/1","/books/2"],"name":"George"}`, string(b))
+	assert.Equal(t, []string{"/addresses/1", "/books/1", "/books/2"}, rw.pushed)
+	assert.Empty(t, rw.options[0].Header.Get("Preload"))
+	assert.Equal(t, `"/city"`, rw.options[0].Header.Get("Fields"))
+	assert.Equal(t, `"/title"`, rw.options[1].Header.Get("Fields"))
+}
+
+func TestApplyMaxPushDepth(t *testing.T) {
+	v := New(WithMaxPushDepth(3))
+
+	rw := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	req := newTestRequest(v, rw, "/books/1", http.Header{
+		"Preload": []string{`"/author/books/*/author"`},
+		"Fields":  []string{`"/author/books/*/title"`},
+	})
+	defer v.Finish(req, false)
+
+	b, err := v.Apply(req, rw, strings.NewReader(`{"title": "1984", "author": "/authors/1"}`), rw.Header())
+	assert.NoError(t, err)
+	assert.Equal(t, `{"author":"/authors/1"}`, string(b))
+	assert.Equal(t, []string{"/authors/1"}, rw.pushed)
+	// The truncated selector must not hide the remaining preload selector of its parent
+	assert.Equal(t, `"/books/*"`, rw.options[0].Header.Get("Preload"))
+	assert.Equal(t, `"/books/*/title"`, rw.options[0].Header.Get("Fields"))
+}
+
+func TestApplyDryRun(t *testing.T) {
+	v := New(WithDryRun(), WithMaxPushes(1), WithAllowedPushHosts("example.com"))
+
+	rw := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	req := newTestRequest(v, rw, "/books/1", http.Header{"Preload": []string{`"/author", "/related", "/cover", "/external"`}, "Fields": []string{`"/author", "/related", "/cover", "/external"`}})
+	defer v.Finish(req, false)
+
+	b, stats, err := v.ApplyWithStats(req, rw, strings.NewReader(`{"title": "1984", "author": "/authors/1", "related": "/books/2", "cover": "https://example.com/1984.jpg", "external": "https://example.net/1984"}`), rw.Header())
+	assert.NoError(t, err)
+	assert.Equal(t, `{"author":"/authors/1","related":"/books/2","cover":"https://example.com/1984.jpg","external":"https://example.net/1984"}`, string(b))
+	assert.Equal(t, []PushDecision{
+		{"/author", "/authors/1", PushActionPush},
+		{"/related", "/books/2", PushActionMaxExceeded},
+		{"/cover", "https://example.com/1984.jpg", PushActionSkippedAbsolute},
+		{"/external", "https://example.net/1984", PushActionSkippedHost},
+	}, stats.Decisions)
+	assert.Empty(t, rw.pushed)
+	assert.Empty(t, rw.Header())
+}
+
+func TestApplyDryRunSkipReasons(t *testing.T) {
+	sizes := map[string]int64{"/books/3": 2000}
+	v := New(
+		WithDryRun(),
+		WithShouldPush(func(u *url.URL) bool { return u.Path != "/books/2" }),
+		WithMaxPushedBytes(1000, func(u *url.URL) int64 { return sizes[u.Path] }),
+	)
+
+	rw := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	req := newTestRequest(v, rw, "/books/1", http.Header{"Preload": []string{`"/author";nopush, "/related", "/sequel", "/editor"`}})
+	defer v.Finish(req, false)
+
+	_, stats, err := v.ApplyWithStats(req, rw, strings.NewReader(`{"author": "/authors/1", "related": "/books/2", "sequel": "/books/3", "editor": "/editors/1"}`), rw.Header())
+	assert.NoError(t, err)
+	assert.Equal(t, []PushDecision{
+		{"/author", "/authors/1", PushActionSkippedNopush},
+		{"/related", "/books/2", PushActionSkippedPolicy},
+		{"/sequel", "/books/3", PushActionMaxBytesExceeded},
+		{"/editor", "/editors/1", PushActionPush},
+	}, stats.Decisions)
+
+	v = New(WithDryRun(), WithRespectCacheControl())
+	rw = &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	rw.Header().Set("Cache-Control", "private")
+	req = newTestRequest(v, rw, "/books/1", http.Header{"Preload": []string{`"/author"`}})
+	defer v.Finish(req, false)
+
+	_, stats, err = v.ApplyWithStats(req, rw, strings.NewReader(`{"author": "/authors/1"}`), rw.Header())
+	assert.NoError(t, err)
+	assert.Equal(t, []PushDecision{{"/author", "/authors/1", PushActionSkippedPrivate}}, stats.Decisions)
+}
+
+func TestVaryPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		policy   VaryPolicy
+		expected []string
+	}{
+		{VaryPreload | VaryFields, []string{"Preload", "Fields"}},
+		{VaryFields, []string{"Fields"}},
+		{VaryPreload | VaryFields | VaryMerged, []string{"Preload, Fields"}},
+		{0, nil},
+	} {
+		v := New(WithVaryPolicy(tc.policy))
+
+		rw := httptest.NewRecorder()
+		req := newTestRequest(v, rw, "/books/1", http.Header{"Preload": []string{`"/author"`}, "Fields": []string{`"/author"`}})
+
+		_, err := v.Apply(req, rw, strings.NewReader(`{"title": "1984", "author": "/authors/1"}`), rw.Header())
+		assert.NoError(t, err)
+		assert.Equal(t, tc.expected, rw.Header()["Vary"])
+
+		v.Finish(req, false)
+	}
+}
+
+func TestPreloadLinkRel(t *testing.T) {
+	v := New(WithPreloadLinkRel(func(relation string) (string, string) {
+		if strings.HasSuffix(relation, ".jpg") {
+			return "prefetch", "image"
+		}
+
+		return "prefetch", ""
+	}))
+
+	rw := httptest.NewRecorder()
+	req := newTestRequest(v, rw, "/books/1", http.Header{"Preload": []string{`"/author", "/cover"`}})
+	defer v.Finish(req, false)
+
+	_, err := v.Apply(req, rw, strings.NewReader(`{"author": "/authors/1", "cover": "/covers/1.jpg"}`), rw.Header())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"</authors/1>; rel=prefetch", "</covers/1.jpg>; rel=prefetch; as=image"}, rw.Header()["Link"])
+}
+
+func TestEarlyHintsBatchSize(t *testing.T) {
+	v := New(WithEarlyHints(), WithEarlyHintsBatchSize(2))
+
+	body := &chunkReader{chunks: []string{`{"member": ["/books/1", "/books/2", "/books/3"]}`}}
+	rw := &earlyHintsRecorder{ResponseRecorder: httptest.NewRecorder(), reader: body}
+	req := newTestRequest(v, rw, "/books", http.Header{"Preload": []string{`"/member/*"`}})
+	defer v.Finish(req, false)
+
+	_, err := v.Apply(req, rw, body, rw.Header())
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{
+		{"</books/1>; rel=preload; as=fetch", "</books/2>; rel=preload; as=fetch"},
+		{"</books/3>; rel=preload; as=fetch"},
+	}, rw.earlyHints)
+	assert.Len(t, rw.Header()["Link"], 3)
+}
+
+func TestWithoutURLRewriting(t *testing.T) {
+	target := "/books/1?preload=" + url.QueryEscape(`"/author/address"`) + "&fields=" + url.QueryEscape(`"/author/name"`)
+	body := `{"title": "1984", "author": "/authors/1"}`
+
+	v := New()
+	rw := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	req := newTestRequest(v, rw, target, nil)
+
+	b, err := v.Apply(req, rw, strings.NewReader(body), rw.Header())
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"author": "/authors/1?fields=%22%2Fname%22&preload=%22%2Faddress%22"}`, string(b))
+	v.Finish(req, false)
+
+	v = New(WithoutURLRewriting(), WithRelationPathPrefix("/api"))
+	rw = &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	req = newTestRequest(v, rw, target, nil)
+	defer v.Finish(req, false)
+
+	b, err = v.Apply(req, rw, strings.NewReader(body), rw.Header())
+	assert.NoError(t, err)
+	assert.Equal(t, `{"author":"/authors/1"}`, string(b))
+
+	// The directives are propagated using headers
+	assert.Equal(t, []string{"/api/authors/1"}, rw.pushed)
+	if assert.Len(t, rw.options, 1) {
+		assert.Equal(t, `"/address"`, rw.options[0].Header.Get("Preload"))
+		assert.Equal(t, `"/name"`, rw.options[0].Header.Get("Fields"))
+	}
+}
+
+func TestPushAccept(t *testing.T) {
+	header := http.Header{"Preload": []string{`"/member/*"`}, "Accept": []string{"application/ld+json, application/json;q=0.5"}}
+
+	// The Accept header of the client is used by default
+	v := New(WithOpenAPIFile(openapiFixture))
+	rw := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	req := newTestRequest(v, rw, "/oa/books.json", header)
+
+	_, err := v.Apply(req, rw, strings.NewReader(`{"member": [1]}`), rw.Header())
+	assert.NoError(t, err)
+	if assert.Len(t, rw.options, 1) {
+		assert.Equal(t, "application/ld+json, application/json;q=0.5", rw.options[0].Header.Get("Accept"))
+	}
+	v.Finish(req, false)
+
+	// The relation is only documented as application/json
+	v = New(WithOpenAPIFile(openapiFixture), WithOpenAPIContentNegotiation())
+	rw = &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	req = newTestRequest(v, rw, "/oa/books.json", header)
+	defer v.Finish(req, false)
+
+	_, err = v.Apply(req, rw, strings.NewReader(`{"member": [1]}`), rw.Header())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/oa/books/1"}, rw.pushed)
+	if assert.Len(t, rw.options, 1) {
+		assert.Equal(t, "application/json", rw.options[0].Header.Get("Accept"))
+	}
+}
+
+func TestNegotiateContentType(t *testing.T) {
+	offers := []string{"application/json", "application/ld+json"}
+
+	assert.Equal(t, "application/ld+json", negotiateContentType([]string{"application/ld+json, application/json;q=0.9"}, offers))
+	assert.Equal(t, "application/json", negotiateContentType([]string{"text/html", "application/*;q=0.8"}, offers))
+	assert.Equal(t, "application/ld+json", negotiateContentType([]string{"application/ld+json;q=0.5, application/json;q=0"}, offers))
+	assert.Equal(t, "application/json", negotiateContentType([]string{"*/*"}, offers))
+	// The most specific media range wins
+	assert.Equal(t, "application/ld+json", negotiateContentType([]string{"application/json;q=0, */*"}, offers))
+	assert.Equal(t, "application/ld+json", negotiateContentType([]string{"*/*;q=0.1, application/*;q=0.5, application/json;q=0.2"}, offers))
+	assert.Equal(t, "", negotiateContentType([]string{"*/*, application/*;q=0"}, offers))
+	assert.Equal(t, "", negotiateContentType([]string{"text/html"}, offers))
+	assert.Equal(t, "", negotiateContentType(nil, offers))
+	assert.Equal(t, "", negotiateContentType([]string{"*/*"}, nil))
+}
+
+func TestOpenAPIQueryRewrite(t *testing.T) {
+	target := "/oa/books.json?preload=" + url.QueryEscape(`"/member/*/author"`)
+
+	v := New(WithOpenAPIFile(openapiFixture))
+	rw := httptest.NewRecorder()
+	req := newTestRequest(v, rw, target, nil)
+
+	b, err := v.Apply(req, rw, strings.NewReader(`{"member": [1]}`), rw.Header())
+	assert.NoError(t, err)
+	assert.Equal(t, `{"member": [1]}`, string(b))
+	v.Finish(req, false)
+
+	v = New(WithOpenAPIFile(openapiFixture), WithOpenAPIQueryRewrite())
+	rw = httptest.NewRecorder()
+	req = newTestRequest(v, rw, target, nil)
+
+	b, err = v.Apply(req, rw, strings.NewReader(`{"member": [1]}`), rw.Header())
+	assert.NoError(t, err)
+	assert.Equal(t, `{"member": ["/oa/books/1?preload=%22%2Fauthor%22"]}`, string(b))
+	v.Finish(req, false)
+}
+
+func TestShouldPush(t *testing.T) {
+	v := New(WithShouldPush(func(u *url.URL) bool {
+		return u.Path != "/books/2"
+	}))
+
+	rw := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	req := newTestRequest(v, rw, "/books/1", http.Header{"Preload": []string{`"/author", "/related"`}})
+	defer v.Finish(req, false)
+
+	_, err := v.Apply(req, rw, strings.NewReader(`{"author": "/authors/1", "related": "/books/2"}`), rw.Header())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/authors/1"}, rw.pushed)
+	assert.Equal(t, []string{"</books/2>; rel=preload; as=fetch; nopush"}, rw.Header()["Link"])
+}
+
+func TestPushDecider(t *testing.T) {
+	v := New(WithPushDecider(FetchMetadataPushDecider))
+
+	for _, tc := range []struct {
+		header http.Header
+		pushed bool
+	}{
+		{http.Header{}, true},
+		{http.Header{"Sec-Fetch-Mode": []string{"navigate"}, "Sec-Fetch-Dest": []string{"document"}}, true},
+		{http.Header{"Sec-Fetch-Mode": []string{"cors"}, "Sec-Fetch-Dest": []string{"empty"}}, false},
+	} {
+		tc.header.Set("Preload", `"/author"`)
+
+		rw := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+		req := newTestRequest(v, rw, "/books/1", tc.header)
+
+		_, err := v.Apply(req, rw, strings.NewReader(`{"author": "/authors/1"}`), rw.Header())
+		assert.NoError(t, err)
+		if tc.pushed {
+			assert.Equal(t, []string{"/authors/1"}, rw.pushed)
+			assert.Empty(t, rw.Header()["Link"])
+		} else {
+			assert.Empty(t, rw.pushed)
+			assert.Equal(t, []string{"</authors/1>; rel=preload; as=fetch; nopush"}, rw.Header()["Link"])
+		}
+
+		v.Finish(req, false)
+	}
+}
+
+func TestMaxPushedBytes(t *testing.T) {
+	sizes := map[string]int64{"/books/1": 600, "/books/2": 500, "/books/3": -1, "/books/4": 400}
+	v := New(WithMaxPushedBytes(1000, func(u *url.URL) int64 {
+		return sizes[u.Path]
+	}))
+
+	rw := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	req := newTestRequest(v, rw, "/books", http.Header{"Preload": []string{`"/member/*"`}})
+	defer v.Finish(req, false)
+
+	_, err := v.Apply(req, rw, strings.NewReader(`{"member": ["/books/1", "/books/2", "/books/3", "/books/4"]}`), rw.Header())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/books/1", "/books/3", "/books/4"}, rw.pushed)
+	assert.Equal(t, []string{"</books/2>; rel=preload; as=fetch; nopush"}, rw.Header()["Link"])
+}
+
+func TestMaxPushedBytesConcurrency(t *testing.T) {
+	sizes := map[string]int64{"/books/1": 600, "/books/2": 500, "/books/3": -1, "/books/4": 400}
+	v := New(WithPushConcurrency(2), WithMaxPushedBytes(1000, func(u *url.URL) int64 {
+		return sizes[u.Path]
+	}))
+
+	rw := &slowPusher{ResponseRecorder: httptest.NewRecorder()}
+	req := newTestRequest(v, rw, "/books", http.Header{"Preload": []string{`"/member/*"`}})
+	defer v.Finish(req, false)
+
+	_, err := v.Apply(req, rw, strings.NewReader(`{"member": ["/books/1", "/books/2", "/books/3", "/books/4"]}`), rw.Header())
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"/books/1", "/books/3", "/books/4"}, rw.pushed)
+	assert.Equal(t, []string{"</books/2>; rel=preload; as=fetch; nopush"}, rw.Header()["Link"])
+}
+
+func TestAcceptPushPolicy(t *testing.T) {
+	v := New()
+
+	rw := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	req := newTestRequest(v, rw, "/books/1", http.Header{"Preload": []string{`"/author"`}, "Accept-Push-Policy": []string{"none"}})
+	defer v.Finish(req, false)
+
+	_, err := v.Apply(req, rw, strings.NewReader(`{"author": "/authors/1"}`), rw.Header())
+	assert.NoError(t, err)
+	assert.Empty(t, rw.pushed)
+	assert.Equal(t, []string{"</authors/1>; rel=preload; as=fetch"}, rw.Header()["Link"])
+
+	assert.True(t, acceptsPush(&http.Request{Header: http.Header{"Accept-Push-Policy": []string{"fast-load"}}}))
+	assert.False(t, acceptsPush(&http.Request{Header: http.Header{"Accept-Push-Policy": []string{"fast-load, None"}}}))
+}
+
+func TestApplyHTTP3(t *testing.T) {
+	v := New()
+
+	rw := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	req := httptest.NewRequest("GET", "/books/1", nil)
+	req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/3.0", 3, 0
+	req.Header.Set("Preload", `"/author"`)
+	req = req.WithContext(v.CreateRequestContext(rw, req))
+	defer v.Finish(req, false)
+
+	_, err := v.Apply(req, rw, strings.NewReader(`{"author": "/authors/1"}`), rw.Header())
+	assert.NoError(t, err)
+	assert.Empty(t, rw.pushed)
+	assert.Equal(t, []string{"</authors/1>; rel=preload; as=fetch"}, rw.Header()["Link"])
+}
+
+// slowPusher is a concurrency-safe http.Pusher taking some time to push
+type slowPusher struct {
+	*httptest.ResponseRecorder
+	delay time.Duration
+
+	sync.Mutex
+	pushed []string
+}
+
+func (p *slowPusher) Push(target string, opts *http.PushOptions) error {
+	time.Sleep(p.delay)
+
+	p.Lock()
+	defer p.Unlock()
+	p.pushed = append(p.pushed, target)
+
+	return nil
+}
+
+func TestPushConcurrency(t *testing.T) {
+	m := &recordingMetrics{}
+	v := New(WithPushConcurrency(4), WithMaxPushes(3), WithMetrics(m))
+
+	rw := &slowPusher{ResponseRecorder: httptest.NewRecorder(), delay: time.Millisecond}
+	req := newTestRequest(v, rw, "/books/1", http.Header{"Preload": []string{`"/a", "/b", "/c", "/d"`}})
+	defer v.Finish(req, false)
+
+	_, stats, err := v.ApplyWithStats(req, rw, strings.NewReader(`{"a": "/a/1", "b": "/b/1", "c": "/c/1", "d": "/d/1"}`), rw.Header())
+	assert.NoError(t, err)
+	assert.Len(t, rw.pushed, 3)
+	assert.Equal(t, 3, stats.PushedCount)
+	assert.Len(t, rw.Header()["Link"], 1)
+	assert.Len(t, m.failed, 1)
+}
+
+func benchmarkApplyPushConcurrency(b *testing.B, concurrency int) {
+	v := New(WithPushConcurrency(concurrency))
+	body := `{"member": ["/books/1", "/books/2", "/books/3", "/books/4", "/books/5", "/books/6", "/books/7", "/books/8"]}`
+
+	for i := 0; i < b.N; i++ {
+		rw := &slowPusher{ResponseRecorder: httptest.NewRecorder(), delay: 100 * time.Microsecond}
+		req := newTestRequest(v, rw, "/books", http.Header{"Preload": []string{`"/member/*"`}})
+
+		_, _ = v.Apply(req, rw, strings.NewReader(body), rw.Header())
+		v.Finish(req, false)
+	}
+}
+
+func BenchmarkApplyPushSequential(b *testing.B) {
+	benchmarkApplyPushConcurrency(b, 0)
+}
+
+func BenchmarkApplyPushConcurrency(b *testing.B) {
+	benchmarkApplyPushConcurrency(b, 8)
+}
+
+func TestBufferPool(t *testing.T) {
+	v := New(WithBufferPool())
+
+	rw := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	req := newTestRequest(v, rw, "/books/1", http.Header{"Preload": []string{`"/author"`}})
+
+	b, err := v.Apply(req, rw, strings.NewReader(`{"author": "/authors/1"}`), rw.Header())
+	assert.NoError(t, err)
+	assert.Equal(t, `{"author": "/authors/1"}`, string(b))
+
+	state := getRequestState(req)
+	assert.Len(t, state.buffers, 1)
+
+	v.Finish(req, false)
+	assert.Empty(t, state.buffers)
+
+	// Without a request context created using CreateRequestContext, buffers aren't pooled
+	assert.Nil(t, v.getBuffer(httptest.NewRequest("GET", "/", nil)))
+	assert.Nil(t, New().getBuffer(req))
+}
+
+func benchmarkApplyBufferPool(b *testing.B, options ...Option) {
+	v := New(options...)
+
+	var sb strings.Builder
+	sb.WriteString(`{"author": "/authors/1", "reviews": [`)
+	for i := 0; i < 1000; i++ {
+		if i > 0 {
+			sb.WriteString(",")
+		}
+		sb.WriteString(`{"rating": 5, "body": "Lorem ipsum dolor sit amet, consectetur adipiscing elit"}`)
+	}
+	sb.WriteString("]}")
+	body := sb.String()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rw := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+		req := newTestRequest(v, rw, "/books/1", http.Header{"Preload": []string{`"/author"`}})
+
+		_, _ = v.Apply(req, rw, strings.NewReader(body), rw.Header())
+		v.Finish(req, false)
+	}
+}
+
+func BenchmarkApply(b *testing.B) {
+	benchmarkApplyBufferPool(b)
+}
+
+func BenchmarkApplyBufferPool(b *testing.B) {
+	benchmarkApplyBufferPool(b, WithBufferPool())
+}
+
+func TestWithoutContentLength(t *testing.T) {
+	for _, tc := range []struct {
+		options  []Option
+		header   http.Header
+		expected string
+	}{
+		{nil, http.Header{"Fields": []string{`"/title"`}}, "16"},
+		{[]Option{WithoutContentLength()}, http.Header{"Fields": []string{`"/title"`}}, ""},
+		// The body isn't modified, the Content-Length header is still valid
+		{[]Option{WithoutContentLength()}, http.Header{"Preload": []string{`"/author"`}}, "42"},
+	} {
+		v := New(tc.options...)
+
+		rw := httptest.NewRecorder()
+		rw.Header().Set("Content-Length", "42")
+		req := newTestRequest(v, rw, "/books/1", tc.header)
+
+		_, err := v.Apply(req, rw, strings.NewReader(`{"title": "1984", "isbn": "9780451524935"}`), rw.Header())
+		assert.NoError(t, err)
+		assert.Equal(t, tc.expected, rw.Header().Get("Content-Length"))
+
+		v.Finish(req, false)
+	}
+}
+
+func TestRespectCacheControl(t *testing.T) {
+	v := New(WithRespectCacheControl())
+
+	rw := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	rw.Header().Set("Cache-Control", "max-age=60, private")
+	req := newTestRequest(v, rw, "/books/1", http.Header{"Preload": []string{`"/author"`}})
+	defer v.Finish(req, false)
+
+	_, err := v.Apply(req, rw, strings.NewReader(`{"author": "/authors/1"}`), rw.Header())
+	assert.NoError(t, err)
+	assert.Empty(t, rw.pushed)
+	assert.Equal(t, []string{"</authors/1>; rel=preload; as=fetch; nopush"}, rw.Header()["Link"])
+
+	rw = &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	rw.Header().Set("Cache-Control", "public, max-age=60")
+	req = newTestRequest(v, rw, "/books/1", http.Header{"Preload": []string{`"/author"`}})
+	defer v.Finish(req, false)
+
+	_, err = v.Apply(req, rw, strings.NewReader(`{"author": "/authors/1"}`), rw.Header())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/authors/1"}, rw.pushed)
+}
+
+// failingPusher is an http.Pusher failing until fail is set to false
+type failingPusher struct {
+	*httptest.ResponseRecorder
+	fail bool
+}
+
+func (p *failingPusher) Push(target string, opts *http.PushOptions) error {
+	if p.fail {
+		return http.ErrNotSupported
+	}
+
+	return nil
+}
+
+func TestPusherStats(t *testing.T) {
+	v := New()
+	assert.Equal(t, PusherStats{}, v.PusherStats())
+
+	rw := &failingPusher{ResponseRecorder: httptest.NewRecorder()}
+	req := newTestRequest(v, rw, "/books/1", http.Header{"Preload": []string{`"/author", "/illustrator"`}})
+
+	_, err := v.Apply(req, rw, strings.NewReader(`{"author": "/authors/1", "illustrator": "/authors/1"}`), rw.Header())
+	assert.NoError(t, err)
+	assert.Equal(t, PusherStats{ActivePushers: 1, PromisesSent: 1, AlreadyPushed: 1}, v.PusherStats())
+	v.Finish(req, false)
+
+	rw = &failingPusher{ResponseRecorder: httptest.NewRecorder(), fail: true}
+	req = newTestRequest(v, rw, "/books/1", http.Header{"Preload": []string{`"/author"`}})
+	defer v.Finish(req, false)
+
+	_, err = v.Apply(req, rw, strings.NewReader(`{"author": "/authors/1"}`), rw.Header())
+	assert.NoError(t, err)
+	assert.Equal(t, PusherStats{ActivePushers: 1, PromisesSent: 1, AlreadyPushed: 1, Failures: 1}, v.PusherStats())
+}
+
+func TestPropagateCacheControl(t *testing.T) {
+	v := New(WithPropagateCacheControl())
+
+	rw := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	rw.Header().Set("Cache-Control", "public, max-age=60, s-maxage=3600, immutable")
+	rw.Header().Add("Cache-Control", "Must-Revalidate")
+	req := newTestRequest(v, rw, "/books/1", http.Header{"Preload": []string{`"/author"`}, "Cache-Control": []string{"max-age=0"}})
+	defer v.Finish(req, false)
+
+	_, err := v.Apply(req, rw, strings.NewReader(`{"author": "/authors/1"}`), rw.Header())
+	assert.NoError(t, err)
+	if assert.Len(t, rw.options, 1) {
+		assert.Equal(t, []string{"max-age=0", "s-maxage=3600, Must-Revalidate"}, rw.options[0].Header["Cache-Control"])
+	}
+
+	// Cache directives aren't propagated by default
+	v = New()
+	rw = &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	rw.Header().Set("Cache-Control", "max-age=60")
+	req = newTestRequest(v, rw, "/books/1", http.Header{"Preload": []string{`"/author"`}})
+	defer v.Finish(req, false)
+
+	_, err = v.Apply(req, rw, strings.NewReader(`{"author": "/authors/1"}`), rw.Header())
+	assert.NoError(t, err)
+	if assert.Len(t, rw.options, 1) {
+		assert.Empty(t, rw.options[0].Header["Cache-Control"])
+	}
+}
+
+func TestPushCircuitBreaker(t *testing.T) {
+	m := &recordingMetrics{}
+	v := New(WithMetrics(m), WithPushCircuitBreaker(2, time.Minute))
+
+	now := time.Now()
+	v.pushers.breaker.now = func() time.Time { return now }
+
+	rw := &failingPusher{ResponseRecorder: httptest.NewRecorder(), fail: true}
+	req := newTestRequest(v, rw, "/books/1", http.Header{"Preload": []string{`"/author", "/related", "/editor"`}})
+
+	_, err := v.Apply(req, rw, strings.NewReader(`{"author": "/authors/1", "related": "/books/2", "editor": "/editors/3"}`), rw.Header())
+	assert.NoError(t, err)
+	v.Finish(req, false)
+
+	// The third relation isn't pushed because the circuit is open
+	assert.Equal(t, []string{"/authors/1", "/books/2"}, m.attempted)
+	assert.Equal(t, []string{"</authors/1>; rel=preload; as=fetch", "</books/2>; rel=preload; as=fetch", "</editors/3>; rel=preload; as=fetch"}, rw.Header()["Link"])
+	assert.True(t, v.PushCircuitOpen())
+
+	// Pushes are attempted again after the cooldown
+	now = now.Add(time.Minute)
+	assert.False(t, v.PushCircuitOpen())
+
+	rw = &failingPusher{ResponseRecorder: httptest.NewRecorder()}
+	req = newTestRequest(v, rw, "/books/1", http.Header{"Preload": []string{`"/author"`}})
+
+	_, err = v.Apply(req, rw, strings.NewReader(`{"author": "/authors/1"}`), rw.Header())
+	assert.NoError(t, err)
+	v.Finish(req, false)
+
+	assert.Equal(t, []string{"/authors/1"}, m.succeeded)
+	assert.False(t, New().PushCircuitOpen())
+}
+
+func TestDirectivesPrecedence(t *testing.T) {
+	testCases := []struct {
+		name          string
+		target        string
+		header        http.Header
+		body          string
+		pushed        string
+		preloadHeader string
+		fieldsHeader  string
+	}{
+		{
+			"preload header, fields header",
+			"/books/1",
+			http.Header{"Preload": []string{`"/author/address"`}, "Fields": []string{`"/author/name"`}},
+			`{"author":"/authors/1"}`,
+			"/authors/1",
+			`"/address"`,
+			`"/name"`,
+		},
+		{
+			"preload query, fields header",
+			"/books/1?preload=%22%2Fauthor%2Faddress%22",
+			http.Header{"Fields": []string{`"/author/name"`}},
+			`{"author":"/authors/1?preload=%22%2Faddress%22"}`,
+			"/authors/1?preload=%22%2Faddress%22",
+			"",
+			`"/name"`,
+		},
+		{
+			"preload header, fields query",
+			"/books/1?fields=%22%2Fauthor%2Fname%22",
+			http.Header{"Preload": []string{`"/author/address"`}},
+			`{"author":"/authors/1?fields=%22%2Fname%22"}`,
+			"/authors/1?fields=%22%2Fname%22",
+			`"/address"`,
+			"",
+		},
+		{
+			"preload query, fields query",
+			"/books/1?preload=%22%2Fauthor%2Faddress%22&fields=%22%2Fauthor%2Fname%22",
+			nil,
+			`{"author":"/authors/1?fields=%22%2Fname%22\u0026preload=%22%2Faddress%22"}`,
+			"/authors/1?fields=%22%2Fname%22&preload=%22%2Faddress%22",
+			"",
+			"",
+		},
+		{
+			"headers take precedence over query parameters",
+			"/books/1?preload=%22%2Ftitle%22&fields=%22%2Ftitle%22",
+			http.Header{"Preload": []string{`"/author/address"`}, "Fields": []string{`"/author/name"`}},
+			`{"author":"/authors/1"}`,
+			"/authors/1",
+			`"/address"`,
+			`"/name"`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			v := New()
+
+			rw := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+			req := newTestRequest(v, rw, tc.target, tc.header)
+			defer v.Finish(req, false)
+
+			b, err := v.Apply(req, rw, strings.NewReader(`{"author": "/authors/1", "title": "1984"}`), rw.Header())
+			assert.NoError(t, err)
+			assert.Equal(t, tc.body, string(b))
+
+			if assert.Equal(t, []string{tc.pushed}, rw.pushed) {
+				assert.Equal(t, tc.preloadHeader, rw.options[0].Header.Get("Preload"))
+				assert.Equal(t, tc.fieldsHeader, rw.options[0].Header.Get("Fields"))
+			}
+		})
+	}
+}
+
+func TestStrictFields(t *testing.T) {
+	header := http.Header{"Fields": []string{`"/title", "/notexists"`}}
+	body := `{"title": "1984", "author": "/authors/1"}`
+
+	v := New()
+	rw := httptest.NewRecorder()
+	req := newTestRequest(v, rw, "/books/1", header)
+	defer v.Finish(req, false)
+
+	b, err := v.Apply(req, rw, strings.NewReader(body), rw.Header())
+	assert.NoError(t, err)
+	assert.Equal(t, `{"title":"1984"}`, string(b))
+
+	v = New(WithStrictFields())
+	rw = httptest.NewRecorder()
+	req = newTestRequest(v, rw, "/books/1", header)
+	defer v.Finish(req, false)
+
+	b, err = v.Apply(req, rw, strings.NewReader(body), rw.Header())
+	assert.Equal(t, `{"title":"1984"}`, string(b))
+	assert.ErrorIs(t, err, ErrFieldNotFound)
+
+	var fieldErr *FieldError
+	if assert.ErrorAs(t, err, &fieldErr) {
+		assert.Equal(t, "/notexists", fieldErr.Selector)
+	}
+}
+
+func TestRelationPathPrefix(t *testing.T) {
+	v := New(WithRelationPathPrefix("/api/v2/"))
+
+	rw := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	req := newTestRequest(v, rw, "/books/1", http.Header{"Preload": []string{`"/author", "/related", "/publisher", "/editor"`}})
+	defer v.Finish(req, false)
+
+	b, err := v.Apply(req, rw, strings.NewReader(`{"author": "/authors/1", "related": "/api/v2/books/2", "publisher": "https://example.com/publishers/3", "editor": "editors/4", "title": "1984"}`), rw.Header())
+	assert.NoError(t, err)
+	assert.Equal(t, `{"author": "/api/v2/authors/1", "related": "/api/v2/books/2", "publisher": "https://example.com/publishers/3", "editor": "editors/4", "title": "1984"}`, string(b))
+	assert.Equal(t, []string{"/api/v2/authors/1", "/api/v2/books/2", "editors/4"}, rw.pushed)
+	assert.Equal(t, []string{"<https://example.com/publishers/3>; rel=preload; as=fetch; nopush"}, rw.Header()["Link"])
+
+	u, _, err := v.ResolveRelation(req, "/author", "/authors/1")
+	assert.NoError(t, err)
+	assert.Equal(t, "/api/v2/authors/1", u.String())
+}
+
+func TestPushHeaderFilter(t *testing.T) {
+	v := New(WithPushHeaderFilter(func(h http.Header) {
+		h.Del("Authorization")
+		h.Del("Cookie")
+		h.Set(defaultInternalRequestHeader, "forged")
+	}))
+
+	rw := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	req := newTestRequest(v, rw, "/books/1", http.Header{
+		"Preload":       []string{`"/author/address"`},
+		"Authorization": []string{"Bearer secret"},
+		"Cookie":        []string{"session=secret"},
+		"X-Tenant":      []string{"acme"},
+	})
+	defer v.Finish(req, false)
+
+	_, err := v.Apply(req, rw, strings.NewReader(`{"author": "/authors/1"}`), rw.Header())
+	assert.NoError(t, err)
+
+	if assert.Len(t, rw.options, 1) {
+		h := rw.options[0].Header
+		assert.Empty(t, h.Get("Authorization"))
+		assert.Empty(t, h.Get("Cookie"))
+		assert.Equal(t, "acme", h.Get("X-Tenant"))
+		assert.Equal(t, `"/address"`, h.Get("Preload"))
+		// The internal header can't be altered by the filter
+		assert.NotEqual(t, "forged", h.Get(defaultInternalRequestHeader))
+	}
+}
+
+func TestApplyBOM(t *testing.T) {
+	doc, err := os.ReadFile("fixtures/bom.json")
+	assert.NoError(t, err)
+
+	for _, tc := range []struct {
+		options  []Option
+		expected string
+	}{
+		{nil, `{"author":"/authors/1"}`},
+		{[]Option{WithPreserveBOM()}, "\ufeff" + `{"author":"/authors/1"}`},
+		{[]Option{WithJSONStreaming()}, `{"author":"/authors/1"}`},
+	} {
+		v := New(tc.options...)
+
+		rw := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+		req := newTestRequest(v, rw, "/books/1", http.Header{"Preload": []string{`"/author"`}, "Fields": []string{`"/author"`}})
+
+		b, stats, err := v.ApplyWithStats(req, rw, bytes.NewReader(doc), rw.Header())
+		assert.NoError(t, err)
+		assert.Equal(t, tc.expected, string(b))
+		assert.True(t, stats.BodyModified)
+		assert.Equal(t, []string{"/authors/1"}, rw.pushed)
+		assert.Equal(t, strconv.Itoa(len(tc.expected)), rw.Header().Get("Content-Length"))
+
+		v.Finish(req, false)
+	}
+
+	// Without the "fields" directive, stripping the BOM is the only change
+	v := New()
+	rw := httptest.NewRecorder()
+	req := newTestRequest(v, rw, "/books/1", http.Header{"Preload": []string{`"/author"`}})
+	defer v.Finish(req, false)
+
+	b, stats, err := v.ApplyWithStats(req, rw, bytes.NewReader(doc), rw.Header())
+	assert.NoError(t, err)
+	assert.Equal(t, string(doc[3:]), string(b))
+	assert.True(t, stats.BodyModified)
+}
+
+func TestApplyNopushParam(t *testing.T) {
+	v := New()
+
+	rw := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	req := newTestRequest(v, rw, "/books/1", http.Header{"Preload": []string{`"/author";nopush, "/related/author";nopush`}})
+	defer v.Finish(req, false)
+
+	_, err := v.Apply(req, rw, strings.NewReader(`{"author": "/authors/1", "related": "/books/2"}`), rw.Header())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"</authors/1>; rel=preload; as=fetch; nopush"}, rw.Header()["Link"])
+
+	// The parameter is propagated to the nested request
+	assert.Equal(t, []string{"/books/2"}, rw.pushed)
+	assert.Equal(t, `"/author";nopush`, rw.options[0].Header.Get("Preload"))
+}
+
+func TestApplyDefaultDirectives(t *testing.T) {
+	v := New(WithDefaultFields(`"/title", "/author"`), WithDefaultPreload(`"/author"`))
+
+	req := httptest.NewRequest("GET", "/books/1", nil)
+	assert.True(t, v.IsValidRequest(req))
+	assert.False(t, New().IsValidRequest(req))
+
+	rw := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	req = newTestRequest(v, rw, "/books/1", nil)
+	defer v.Finish(req, false)
+
+	b, err := v.Apply(req, rw, strings.NewReader(`{"title": "1984", "author": "/authors/1", "summary": "Big Brother"}`), rw.Header())
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"title": "1984", "author": "/authors/1"}`, string(b))
+	assert.Equal(t, []string{"/authors/1"}, rw.pushed)
+
+	dt, err := v.ParseDirectives(req)
+	assert.NoError(t, err)
+	assert.Equal(t, DirectiveSourceDefault, dt.PreloadSource)
+	assert.Equal(t, DirectiveSourceDefault, dt.FieldsSource)
+
+	// Directives sent by the client replace the defaults
+	rw = &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	req = newTestRequest(v, rw, "/books/1", http.Header{"Fields": []string{`"/summary"`}})
+	defer v.Finish(req, false)
+
+	b, err = v.Apply(req, rw, strings.NewReader(`{"title": "1984", "author": "/authors/1", "summary": "Big Brother"}`), rw.Header())
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"summary": "Big Brother"}`, string(b))
+	assert.Empty(t, rw.pushed)
+
+	// Invalid defaults are ignored
+	assert.False(t, New(WithDefaultFields(`"/title`)).IsValidRequest(httptest.NewRequest("GET", "/books/1", nil)))
+}
+
+func TestApplyEmptyDirectives(t *testing.T) {
+	body := `{"title": "1984", "author": "/authors/1", "summary": "Big Brother"}`
+
+	// An empty header doesn't mask the query parameter
+	v := New()
+	rw := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	req := newTestRequest(v, rw, `/books/1?preload="/author"`, http.Header{"Preload": []string{""}})
+	defer v.Finish(req, false)
+
+	_, err := v.Apply(req, rw, strings.NewReader(body), rw.Header())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/authors/1"}, rw.pushed)
+
+	dt, err := v.ParseDirectives(req)
+	assert.NoError(t, err)
+	assert.Equal(t, DirectiveSourceQuery, dt.PreloadSource)
+
+	// Empty directives don't disable the defaults
+	v = New(WithDefaultFields(`"/title"`))
+	rw = &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	req = newTestRequest(v, rw, "/books/1?fields=", http.Header{"Preload": []string{" "}})
+	defer v.Finish(req, false)
+
+	b, err := v.Apply(req, rw, strings.NewReader(body), rw.Header())
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"title": "1984"}`, string(b))
+	assert.Empty(t, rw.pushed)
+}
+
+func TestApplyStrictDirectives(t *testing.T) {
+	body := `{"title": "1984", "author": "/authors/1"}`
+
+	// Malformed directives are ignored by default
+	v := New()
+	rw := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	req := newTestRequest(v, rw, `/books/1?fields="/title"`, http.Header{"Fields": []string{`"/title`}})
+	defer v.Finish(req, false)
+
+	b, err := v.Apply(req, rw, strings.NewReader(body), rw.Header())
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"title": "1984"}`, string(b))
+
+	v = New(WithStrictDirectives())
+	rw = &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	req = newTestRequest(v, rw, `/books/1?fields="/title"`, http.Header{"Fields": []string{`"/title`}})
+	defer v.Finish(req, false)
+	assert.True(t, v.IsValidRequest(req))
+
+	b, err = v.Apply(req, rw, strings.NewReader(body), rw.Header())
+	assert.Nil(t, b)
+	assert.ErrorIs(t, err, ErrInvalidDirective)
+
+	var directiveErr *DirectiveError
+	if assert.ErrorAs(t, err, &directiveErr) {
+		assert.Equal(t, "fields", directiveErr.Directive)
+		assert.Equal(t, DirectiveSourceHeader, directiveErr.Source)
+	}
+
+	req = newTestRequest(v, rw, `/books/1?preload=%22/author`, nil)
+	defer v.Finish(req, false)
+
+	_, err = v.ParseDirectives(req)
+	if assert.ErrorAs(t, err, &directiveErr) {
+		assert.Equal(t, "preload", directiveErr.Directive)
+		assert.Equal(t, DirectiveSourceQuery, directiveErr.Source)
+	}
+}
+
+func TestApplyMaxSelectors(t *testing.T) {
+	v := New(WithMaxSelectors(2))
+
+	rw := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	req := newTestRequest(v, rw, "/books/1", http.Header{"Preload": []string{`"/author"`}, "Fields": []string{`"/author", "/title"`}})
+	defer v.Finish(req, false)
+
+	b, err := v.Apply(req, rw, strings.NewReader(`{"title": "1984", "author": "/authors/1"}`), rw.Header())
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"title": "1984", "author": "/authors/1"}`, string(b))
+
+	req = newTestRequest(v, rw, "/books/1", http.Header{"Preload": []string{`"/author"`}, "Fields": []string{`"/author", "/title", "/isbn"`}})
+	defer v.Finish(req, false)
+
+	b, err = v.Apply(req, rw, strings.NewReader(`{"title": "1984", "author": "/authors/1"}`), rw.Header())
+	assert.Nil(t, b)
+	assert.ErrorIs(t, err, ErrTooManySelectors)
+}
+
+func TestApplyPanicRecovery(t *testing.T) {
+	resolver := WithRelationResolver(func(selector, value string) (string, bool) {
+		panic("resolver bug")
+	})
+	header := http.Header{"Preload": []string{`"/author"`}}
+
+	v := New(resolver)
+	rw := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	req := newTestRequest(v, rw, "/books/1", header)
+	defer v.Finish(req, false)
+
+	assert.PanicsWithValue(t, "resolver bug", func() {
+		_, _ = v.Apply(req, rw, strings.NewReader(`{"author": "/authors/1"}`), rw.Header())
+	})
+
+	v = New(resolver, WithPanicRecovery())
+	rw = &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	req = newTestRequest(v, rw, "/books/1", header)
+	defer v.Finish(req, false)
+
+	b, err := v.Apply(req, rw, strings.NewReader(`{"author": "/authors/1"}`), rw.Header())
+	assert.Nil(t, b)
+	assert.ErrorIs(t, err, ErrPanicRecovered)
+
+	var panicErr *PanicError
+	if assert.ErrorAs(t, err, &panicErr) {
+		assert.Equal(t, "resolver bug", panicErr.Value)
+		assert.NotEmpty(t, panicErr.Stack)
+	}
+
+	// The headers added before the panic are removed
+	v = New(WithRelationResolver(func(selector, value string) (string, bool) {
+		if value == "/books/2" {
+			panic("resolver bug")
+		}
+
+		return value, true
+	}), WithMaxPushes(0), WithPanicRecovery())
+	rw = &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	rw.Header().Set("Content-Type", "application/json")
+	req = newTestRequest(v, rw, "/books/1", http.Header{"Preload": []string{`"/author", "/related"`}})
+	defer v.Finish(req, false)
+
+	_, err = v.Apply(req, rw, strings.NewReader(`{"author": "/authors/1", "related": "/books/2"}`), rw.Header())
+	assert.ErrorIs(t, err, ErrPanicRecovered)
+	assert.Equal(t, http.Header{"Content-Type": []string{"application/json"}}, rw.Header())
+}
+
+// panickingPusher is an http.Pusher panicking when pushing
+type panickingPusher struct {
+	*httptest.ResponseRecorder
+}
+
+func (p *panickingPusher) Push(target string, opts *http.PushOptions) error {
+	panic("pusher bug")
+}
+
+func TestApplyPanicRecoveryPushWorkers(t *testing.T) {
+	for _, option := range []Option{WithPushConcurrency(1), WithPushConcurrency(2), WithPushTimeout(time.Second)} {
+		v := New(option, WithPanicRecovery())
+
+		rw := &panickingPusher{httptest.NewRecorder()}
+		req := newTestRequest(v, rw, "/books/1", http.Header{"Preload": []string{`"/author", "/related"`}})
+
+		b, err := v.Apply(req, rw, strings.NewReader(`{"author": "/authors/1", "related": "/books/2"}`), rw.Header())
+		assert.Nil(t, b)
+
+		var panicErr *PanicError
+		if assert.ErrorAs(t, err, &panicErr) {
+			assert.Equal(t, "pusher bug", panicErr.Value)
+			assert.Contains(t, string(panicErr.Stack), "panickingPusher")
+		}
+		assert.Empty(t, rw.Header())
+
+		// The promises have been released
+		v.Finish(req, true)
+	}
+}
+
+func TestApplyPanicPushWorkers(t *testing.T) {
+	// Without WithPanicRecovery, the original value is propagated whatever the goroutine in which the pusher panicked
+	for _, option := range []Option{WithPushConcurrency(1), WithPushConcurrency(2), WithPushTimeout(time.Second)} {
+		v := New(option)
+
+		rw := &panickingPusher{httptest.NewRecorder()}
+		req := newTestRequest(v, rw, "/books/1", http.Header{"Preload": []string{`"/author", "/related"`}})
+
+		assert.PanicsWithValue(t, "pusher bug", func() {
+			_, _ = v.Apply(req, rw, strings.NewReader(`{"author": "/authors/1", "related": "/books/2"}`), rw.Header())
+		})
+
+		v.Finish(req, true)
+	}
+}
+
+func TestApplyFieldTransformer(t *testing.T) {
+	mask := func(value string) string {
+		if name, _, ok := strings.Cut(value, "@"); ok {
+			return name[:1] + "***@example.com"
+		}
+
+		return value
+	}
+	v := New(WithFieldTransformer("/author/email", mask), WithFieldTransformer("/contacts/*/email", mask), WithFieldTransformer("/id", mask))
+
+	rw := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	req := newTestRequest(v, rw, "/books/1", http.Header{"Fields": []string{`"/author", "/contacts", "/id"`}})
+	defer v.Finish(req, false)
+
+	b, err := v.Apply(req, rw, strings.NewReader(`{"id": 1, "title": "1984", "author": {"name": "George", "email": "george@orwell.com"}, "contacts": [{"email": "eric@blair.com"}, {"phone": "42"}]}`), rw.Header())
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"id": 1, "author": {"name": "George", "email": "g***@example.com"}, "contacts": [{"email": "e***@example.com"}, {"phone": "42"}]}`, string(b))
+
+	// The responses of requests without directives are left untouched
+	req = newTestRequest(v, rw, "/books/1", nil)
+	defer v.Finish(req, false)
+
+	assert.False(t, v.IsValidRequest(req))
+}
+
+func TestApplyTrailers(t *testing.T) {
+	v := New()
+
+	rw := httptest.NewRecorder()
+	req := newTestRequest(v, rw, "/books/1", http.Header{"Fields": []string{`"/title"`}})
+	defer v.Finish(req, false)
+
+	h := http.Header{"Trailer": []string{"X-Checksum"}, "Content-Length": []string{"41"}}
+	b, err := v.Apply(req, rw, strings.NewReader(`{"title": "1984", "author": "/authors/1"}`), h)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"title":"1984"}`, string(b))
+	assert.Empty(t, h.Get("Content-Length"))
+
+	h = http.Header{http.TrailerPrefix + "X-Checksum": []string{"abc"}}
+	_, err = v.Apply(req, rw, strings.NewReader(`{"title": "1984"}`), h)
+	assert.NoError(t, err)
+	assert.Empty(t, h.Get("Content-Length"))
+}
+
+func TestApplyChunked(t *testing.T) {
+	var chunked bytes.Buffer
+	cw := httputil.NewChunkedWriter(&chunked)
+	for _, chunk := range []string{`{"title": "1984", `, `"author": "/authors/1"}`} {
+		_, err := cw.Write([]byte(chunk))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, cw.Close())
+
+	for _, tc := range []struct {
+		options       []Option
+		contentLength string
+		chunked       bool
+	}{
+		{nil, "16", false},
+		{[]Option{WithoutContentLength()}, "", true},
+	} {
+		v := New(tc.options...)
+
+		rw := httptest.NewRecorder()
+		req := newTestRequest(v, rw, "/books/1", http.Header{"Fields": []string{`"/title"`}})
+
+		h := http.Header{"Transfer-Encoding": []string{"chunked"}}
+		b, err := v.Apply(req, rw, httputil.NewChunkedReader(bytes.NewReader(chunked.Bytes())), h)
+		assert.NoError(t, err)
+		assert.Equal(t, `{"title":"1984"}`, string(b))
+		assert.Equal(t, tc.contentLength, h.Get("Content-Length"))
+		assert.Equal(t, tc.chunked, h.Get("Transfer-Encoding") == "chunked")
+		v.Finish(req, false)
+	}
+}
+
+func TestApplyCanonicalPushURL(t *testing.T) {
+	v := New(WithCanonicalPushURL())
+
+	rw := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	req := newTestRequest(v, rw, `/books/1?preload="/author/address"`, nil)
+	defer v.Finish(req, false)
+
+	// The value in the body is rewritten, but the canonical URL is pushed
+	b, err := v.Apply(req, rw, strings.NewReader(`{"author": "/authors/1"}`), rw.Header())
+	assert.NoError(t, err)
+	assert.Equal(t, `{"author": "/authors/1?preload=%22%2Faddress%22"}`, string(b))
+	assert.Equal(t, []string{"/authors/1"}, rw.pushed)
+	assert.Equal(t, `"/address"`, rw.options[0].Header.Get("Preload"))
+
+	// The fallback Link header contains the canonical URL too
+	frw := &failingPusher{ResponseRecorder: httptest.NewRecorder(), fail: true}
+	req = newTestRequest(v, frw, `/books/1?preload="/author/address"`, nil)
+	defer v.Finish(req, false)
+
+	_, err = v.Apply(req, frw, strings.NewReader(`{"author": "/authors/1"}`), frw.Header())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"</authors/1>; rel=preload; as=fetch"}, frw.Header()["Link"])
+}
+
+func TestApplyPreferMinimal(t *testing.T) {
+	v := New(WithPreferMinimal(), WithOpenAPIFile(openapiFixture))
+
+	rw := httptest.NewRecorder()
+	req := newTestRequest(v, rw, "/oa/books/1", http.Header{"Prefer": []string{"return=minimal"}})
+	defer v.Finish(req, false)
+
+	assert.True(t, v.IsValidRequest(req))
+	assert.True(t, v.IsValidResponse(req, http.StatusOK, http.Header{"Content-Type": []string{"application/json"}}))
+
+	// No minimal fields are documented for this operation
+	nreq := httptest.NewRequest("GET", "/oa/authors/1", nil)
+	nreq.Header.Set("Prefer", "return=minimal")
+	assert.False(t, v.IsValidRequest(nreq))
+
+	// The fields documented using OpenAPI
+	b, err := v.Apply(req, rw, strings.NewReader(`{"title": "1984", "author": 1}`), rw.Header())
+	assert.NoError(t, err)
+	assert.Equal(t, `{"title":"1984"}`, string(b))
+	assert.Equal(t, "return=minimal", rw.Header().Get("Preference-Applied"))
+	assert.Contains(t, rw.Header()["Vary"], "Prefer")
+
+	// The default fields
+	v = New(WithPreferMinimal(), WithDefaultFields(`"/author"`))
+
+	rw = httptest.NewRecorder()
+	req = newTestRequest(v, rw, "/books/1", http.Header{"Prefer": []string{"return=minimal"}, "Preload": []string{`"/author"`}})
+	defer v.Finish(req, false)
+
+	b, err = v.Apply(req, rw, strings.NewReader(`{"title": "1984", "author": "/authors/1"}`), rw.Header())
+	assert.NoError(t, err)
+	assert.Equal(t, `{"author":"/authors/1"}`, string(b))
+	assert.Equal(t, "return=minimal", rw.Header().Get("Preference-Applied"))
+
+	// An explicit "fields" directive wins
+	rw = httptest.NewRecorder()
+	req = newTestRequest(v, rw, "/books/1", http.Header{"Prefer": []string{"return=minimal"}, "Fields": []string{`"/title"`}})
+	defer v.Finish(req, false)
+
+	b, err = v.Apply(req, rw, strings.NewReader(`{"title": "1984", "author": "/authors/1"}`), rw.Header())
+	assert.NoError(t, err)
+	assert.Equal(t, `{"title":"1984"}`, string(b))
+	assert.Empty(t, rw.Header().Get("Preference-Applied"))
+
+	// The preference is ignored if the option isn't set
+	v = New()
+	req = newTestRequest(v, rw, "/books/1", http.Header{"Prefer": []string{"return=minimal"}, "Fields": []string{`"/title"`}})
+	defer v.Finish(req, false)
+	assert.False(t, v.IsValidResponse(req, http.StatusOK, http.Header{"Content-Type": []string{"application/json"}}))
+}
+
+func TestApplyEmbeddedJSON(t *testing.T) {
+	v := New(WithEmbeddedJSON("/payload"), WithEmbeddedJSON("/items/*/payload"))
+
+	rw := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	req := newTestRequest(v, rw, "/books/1", http.Header{"Preload": []string{`"/payload/author", "/items/*/payload/author"`}, "Fields": []string{`"/payload/author", "/items"`}})
+	defer v.Finish(req, false)
+
+	b, err := v.Apply(req, rw, strings.NewReader(`{"title": "1984", "payload": "{\"author\": \"/authors/1\", \"title\": \"1984\"}", "items": [{"payload": "{\"author\": \"/authors/2\"}"}, {"payload": "not JSON"}]}`), rw.Header())
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"payload": "{\"author\":\"/authors/1\"}", "items": [{"payload": "{\"author\": \"/authors/2\"}"}, {"payload": "not JSON"}]}`, string(b))
+	assert.Equal(t, []string{"/authors/1", "/authors/2"}, rw.pushed)
+}
+
+func TestApplyRootPointer(t *testing.T) {
+	v := New(WithRootPointer("/data"))
+
+	rw := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	req := newTestRequest(v, rw, "/graphql", http.Header{"Preload": []string{`"/user/avatarUrl"`}, "Fields": []string{`"/user"`}})
+	defer v.Finish(req, false)
+
+	b, err := v.Apply(req, rw, strings.NewReader(`{"data": {"user": {"avatarUrl": "/avatars/1"}, "post": {"title": "1984"}}}`), rw.Header())
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"data": {"user": {"avatarUrl": "/avatars/1"}}}`, string(b))
+	assert.Equal(t, []string{"/avatars/1"}, rw.pushed)
+
+	dt, err := v.ParseDirectives(req)
+	assert.NoError(t, err)
+	assert.Equal(t, "/data/user/avatarUrl", dt.Root.Children[0].Children[0].Children[0].Pointer)
+}
+
+func TestApplyRelationFieldPattern(t *testing.T) {
+	body := `{"title": "1984", "authorUrl": "/authors/1", "coverHref": "/covers/1", "ratingUrl": 4, "related": {"editorUrl": "/editors/1"}}`
+
+	v := New(WithRelationFieldPattern(`(Url|Href)$`))
+	rw := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	req := newTestRequest(v, rw, "/books/1", http.Header{"Preload": []string{`"/~r", "/related/~r"`}})
+	defer v.Finish(req, false)
+
+	_, err := v.Apply(req, rw, strings.NewReader(body), rw.Header())
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"/authors/1", "/covers/1", "/editors/1"}, rw.pushed)
+
+	// Keys containing dots are kept untouched
+	for _, header := range []http.Header{
+		{"Preload": []string{`"/~r"`}},
+		{"Preload": []string{`"/~r"`}, "Fields": []string{`"/~r"`}},
+	} {
+		rw = &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+		req = newTestRequest(v, rw, "/books/1", header)
+		defer v.Finish(req, false)
+
+		b, err := v.Apply(req, rw, strings.NewReader(`{"cover.Href": "/covers/1"}`), rw.Header())
+		assert.NoError(t, err)
+		assert.JSONEq(t, `{"cover.Href": "/covers/1"}`, string(b))
+		assert.Equal(t, []string{"/covers/1"}, rw.pushed)
+	}
+
+	// Bounded by the maximum number of pushes
+	v = New(WithRelationFieldPattern(`(Url|Href)$`), WithMaxPushes(1))
+	rw = &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	req = newTestRequest(v, rw, "/books/1", http.Header{"Preload": []string{`"/~r"`}})
+	defer v.Finish(req, false)
+
+	_, err = v.Apply(req, rw, strings.NewReader(body), rw.Header())
+	assert.NoError(t, err)
+	assert.Len(t, rw.pushed, 1)
+
+	// Invalid patterns are ignored
+	v = New(WithRelationFieldPattern(`(Url`))
+	rw = &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	req = newTestRequest(v, rw, "/books/1", http.Header{"Preload": []string{`"/~r"`}})
+	defer v.Finish(req, false)
+
+	_, err = v.Apply(req, rw, strings.NewReader(body), rw.Header())
+	assert.NoError(t, err)
+	assert.Empty(t, rw.pushed)
+}
+
+func TestApplyServerTiming(t *testing.T) {
+	v := New(WithServerTiming())
+
+	rw := httptest.NewRecorder()
+	req := newTestRequest(v, rw, "/books/1", http.Header{"Preload": []string{`"/author"`}})
+	req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/2.0", 2, 0
+
+	// The headers passed to Apply are copied to the http.ResponseWriter before Finish is called (e.g. by httputil.ReverseProxy)
+	h := http.Header{}
+	_, err := v.Apply(req, rw, strings.NewReader(`{"author": "/authors/1"}`), h)
+	assert.NoError(t, err)
+	if assert.Len(t, h["Server-Timing"], 2) {
+		assert.Regexp(t, `^vulcain-parse;dur=[0-9.]+$`, h["Server-Timing"][0])
+		assert.Regexp(t, `^vulcain-traverse;dur=[0-9.]+$`, h["Server-Timing"][1])
+	}
+
+	v.Finish(req, true)
+	assert.Regexp(t, `^vulcain-push;dur=[0-9.]+$`, rw.Header().Get(http.TrailerPrefix+"Server-Timing"))
+	assert.Empty(t, h[http.TrailerPrefix+"Server-Timing"])
+
+	// HTTP/1.1 responses having a Content-Length header cannot have trailers
+	rw = httptest.NewRecorder()
+	req = newTestRequest(v, rw, "/books/1", http.Header{"Preload": []string{`"/author"`}})
+
+	_, err = v.Apply(req, rw, strings.NewReader(`{"author": "/authors/1"}`), rw.Header())
+	assert.NoError(t, err)
+	v.Finish(req, true)
+	assert.Len(t, rw.Header()["Server-Timing"], 2)
+	assert.Empty(t, rw.Header()[http.TrailerPrefix+"Server-Timing"])
+
+	v = New(WithServerTiming(), WithoutContentLength())
+	rw = httptest.NewRecorder()
+	req = newTestRequest(v, rw, "/books/1", http.Header{"Preload": []string{`"/author"`}})
+
+	_, err = v.Apply(req, rw, strings.NewReader(`{"author": "/authors/1"}`), rw.Header())
+	assert.NoError(t, err)
+	v.Finish(req, true)
+	assert.Regexp(t, `^vulcain-push;dur=[0-9.]+$`, rw.Header().Get(http.TrailerPrefix+"Server-Timing"))
+
+	// Disabled by default
+	v = New()
+	rw = httptest.NewRecorder()
+	req = newTestRequest(v, rw, "/books/1", http.Header{"Preload": []string{`"/author"`}})
+
+	_, err = v.Apply(req, rw, strings.NewReader(`{"author": "/authors/1"}`), rw.Header())
+	assert.NoError(t, err)
+	v.Finish(req, true)
+	assert.Empty(t, rw.Header()["Server-Timing"])
+	assert.Empty(t, rw.Header()[http.TrailerPrefix+"Server-Timing"])
+}
+
+func TestApplyOpenAPINonGetOperation(t *testing.T) {
+	v := New(WithOpenAPIFile(openapiFixture))
+
+	rw := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	req := newTestRequest(v, rw, "/oa/authors/1", http.Header{"Preload": []string{`"/reviews"`}})
+	defer v.Finish(req, false)
+
+	_, err := v.Apply(req, rw, strings.NewReader(`{"id": 1, "reviews": 7}`), rw.Header())
+	assert.NoError(t, err)
+	assert.Empty(t, rw.pushed)
+	assert.Equal(t, []string{"</oa/authors/7/reviews>; rel=preload; as=fetch; nopush"}, rw.Header()["Link"])
+
+	v = New(WithOpenAPIFile(openapiFixture), WithDryRun())
+	req = newTestRequest(v, rw, "/oa/authors/1", http.Header{"Preload": []string{`"/reviews"`}})
+	defer v.Finish(req, false)
+
+	_, stats, err := v.ApplyWithStats(req, rw, strings.NewReader(`{"id": 1, "reviews": 7}`), rw.Header())
+	assert.NoError(t, err)
+	assert.Equal(t, []PushDecision{{"/reviews", "/oa/authors/7/reviews", PushActionSkippedMethod}}, stats.Decisions)
+}
+
+func TestApplyMixedFieldsSelectors(t *testing.T) {
+	v := New()
+
+	rw := httptest.NewRecorder()
+	req := newTestRequest(v, rw, "/books/1", http.Header{"Fields": []string{`"/title", "!/author"`}})
+	defer v.Finish(req, false)
+
+	b, err := v.Apply(req, rw, strings.NewReader(`{"title": "1984", "author": "/authors/1"}`), rw.Header())
+	assert.Nil(t, b)
+	assert.ErrorIs(t, err, ErrMixedFieldsSelectors)
+}
+
+type staticJSONProcessor struct {
+	relation string
+}
+
+func (p staticJSONProcessor) Process(body []byte, tree Node, filter bool, relationHandler RelationHandler) []byte {
+	for _, c := range tree.Children() {
+		relationHandler(c, p.relation)
+	}
+
+	return body
+}
+
+func TestJSONProcessor(t *testing.T) {
+	v := New(WithJSONProcessor(staticJSONProcessor{"/authors/1"}))
+
+	rw := httptest.NewRecorder()
+	req := newTestRequest(v, rw, "/books/1", http.Header{"Preload": []string{`"/author"`}})
+	defer v.Finish(req, false)
+
+	b, err := v.Apply(req, rw, strings.NewReader(`{"title": "1984"}`), rw.Header())
+	assert.NoError(t, err)
+	assert.Equal(t, `{"title": "1984"}`, string(b))
+	assert.Equal(t, []string{"</authors/1>; rel=preload; as=fetch"}, rw.Header()["Link"])
+}
+
+func TestApplyOpenAPIMaxPushes(t *testing.T) {
+	v := New(WithOpenAPIFile(openapiFixture))
+
+	rw := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	req := newTestRequest(v, rw, "/oa/books/1", http.Header{"Preload": []string{`"/author"`}})
+	defer v.Finish(req, false)
+
+	_, err := v.Apply(req, rw, strings.NewReader(`{"id": 1, "author": 1}`), rw.Header())
+	assert.NoError(t, err)
+	assert.Empty(t, rw.pushed)
+	assert.Equal(t, []string{"</oa/authors/1>; rel=preload; as=fetch; nopush"}, rw.Header()["Link"])
+}
+
+func TestApplyOpenAPIIDs(t *testing.T) {
+	for _, streaming := range []bool{false, true} {
+		options := []Option{WithOpenAPIFile(openapiFixture)}
+		if streaming {
+			options = append(options, WithJSONStreaming())
+		}
+		v := New(options...)
+
+		for body, link := range map[string]string{
+			`{"author": 42}`:        "</oa/authors/42>; rel=preload; as=fetch; nopush",
+			`{"author": 4.2e1}`:     "</oa/authors/42>; rel=preload; as=fetch; nopush",
+			`{"author": "42"}`:      "</oa/authors/42>; rel=preload; as=fetch; nopush",
+			`{"author": "Le Guin"}`: "</oa/authors/Le%20Guin>; rel=preload; as=fetch; nopush",
+		} {
+			rw := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+			req := newTestRequest(v, rw, "/oa/books/1", http.Header{"Preload": []string{`"/author"`}})
+
+			_, err := v.Apply(req, rw, strings.NewReader(body), rw.Header())
+			assert.NoError(t, err)
+			assert.Equal(t, []string{link}, rw.Header()["Link"], body)
+
+			v.Finish(req, false)
+		}
+	}
+}
+
+func TestApplyOpenAPIDiscriminator(t *testing.T) {
+	v := New(WithOpenAPIFile("./fixtures/openapi-discriminator.yaml"))
+
+	rw := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	req := newTestRequest(v, rw, "/items", http.Header{"Preload": []string{`"/member/*/content/target"`}})
+	defer v.Finish(req, false)
+
+	_, err := v.Apply(req, rw, strings.NewReader(`{"member": [{"content": {"type": "Video", "target": 1}}, {"content": {"type": "article", "target": 2}}]}`), rw.Header())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/channels/1", "/authors/2"}, rw.pushed)
+}
+
+func TestApplyError(t *testing.T) {
+	v := New()
+
+	rw := httptest.NewRecorder()
+	req := newTestRequest(v, rw, "/books/1", http.Header{"Preload": []string{`"/author", "/related"`}})
+	defer v.Finish(req, false)
+
+	b, err := v.Apply(req, rw, strings.NewReader(`{"author": " http://example.com", "related": "/books/2"}`), rw.Header())
+	assert.Equal(t, `{"author": " http://example.com", "related": "/books/2"}`, string(b))
+	assert.Equal(t, []string{"</books/2>; rel=preload; as=fetch"}, rw.Header()["Link"])
+
+	var applyErr *ApplyError
+	if assert.ErrorAs(t, err, &applyErr) {
+		assert.Equal(t, "/author", applyErr.Selector)
+		assert.Equal(t, " http://example.com", applyErr.Relation)
+		assert.Error(t, applyErr.Unwrap())
+	}
+}
+
+func TestApplyMaxLinkHeaderBytes(t *testing.T) {
+	core, logs := observer.New(zap.WarnLevel)
+	v := New(WithMaxLinkHeaderBytes(80), WithLogger(zap.New(core)))
+
+	rw := httptest.NewRecorder()
+	req := newTestRequest(v, rw, "/books", http.Header{"Preload": []string{`"/members/*"`}})
+	defer v.Finish(req, false)
+
+	_, err := v.Apply(req, rw, strings.NewReader(`{"members": ["/books/1", "/books/2", "/books/3", "/books/1"]}`), rw.Header())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"</books/1>; rel=preload; as=fetch", "</books/2>; rel=preload; as=fetch"}, rw.Header()["Link"])
+
+	if assert.Equal(t, 1, logs.Len()) {
+		assert.Equal(t, int64(1), logs.All()[0].ContextMap()["dropped"])
+	}
+}
+
+func TestPreconnect(t *testing.T) {
+	v := New(WithPreconnect())
+
+	rw := httptest.NewRecorder()
+	req := newTestRequest(v, rw, "http://example.com/books/1", http.Header{"Preload": []string{`"/author", "/covers/*", "/self"`}})
+	defer v.Finish(req, false)
+
+	_, err := v.Apply(req, rw, strings.NewReader(`{"author": "/authors/1", "covers": ["https://cdn.example.com/1.jpg", "https://cdn.example.com/2.jpg"], "self": "http://example.com/books/1"}`), rw.Header())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"</authors/1>; rel=preload; as=fetch",
+		"<https://cdn.example.com>; rel=preconnect",
+		"<https://cdn.example.com/1.jpg>; rel=preload; as=fetch; nopush",
+		"<https://cdn.example.com/2.jpg>; rel=preload; as=fetch; nopush",
+		"<http://example.com/books/1>; rel=preload; as=fetch; nopush",
+	}, rw.Header()["Link"])
+}
+
+func TestAllowedPushHosts(t *testing.T) {
+	v := New(WithAllowedPushHosts("example.com", "CDN.example.com"))
+
+	rw := httptest.NewRecorder()
+	req := newTestRequest(v, rw, "http://example.com:8080/books/1", http.Header{"Preload": []string{`"/author", "/cover", "/publisher"`}})
+	defer v.Finish(req, false)
+
+	_, err := v.Apply(req, rw, strings.NewReader(`{"author": "/authors/1", "cover": "https://cdn.example.com/1.jpg", "publisher": "https://evil.com/1"}`), rw.Header())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"</authors/1>; rel=preload; as=fetch", "<https://cdn.example.com/1.jpg>; rel=preload; as=fetch; nopush"}, rw.Header()["Link"])
+
+	v = New(WithAllowedPushHosts("api.example.com"), WithApiUrl("https://api.example.com"))
+	assert.True(t, v.isAllowedPushHost(req, &url.URL{Path: "/authors/1"}))
+	assert.False(t, v.isAllowedPushHost(req, &url.URL{Scheme: "https", Host: "example.com", Path: "/authors/1"}))
+	assert.False(t, v.isAllowedPushHost(req, &url.URL{Host: "evil.example", Path: "/x"}))
+	// The relation is appended to the API URL, it must not change its host
+	assert.False(t, v.isAllowedPushHost(req, &url.URL{Path: ".evil.example/x"}))
+
+	// Protocol-relative relations are neither pushed nor preloaded
+	v = New(WithAllowedPushHosts("example.com"))
+	rw = httptest.NewRecorder()
+	req = newTestRequest(v, rw, "http://example.com/books/1", http.Header{"Preload": []string{`"/author"`}})
+	defer v.Finish(req, false)
+
+	_, err = v.Apply(req, rw, strings.NewReader(`{"author": "//evil.example/authors/1"}`), rw.Header())
+	assert.NoError(t, err)
+	assert.Empty(t, rw.Header()["Link"])
+}
+
+func TestRedirectPolicy(t *testing.T) {
+	h := http.Header{"Content-Type": []string{"application/json"}}
+	header := http.Header{"Preload": []string{`"/author"`}, "Fields": []string{`"/author"`}}
+
+	v := New()
+	rw := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	assert.False(t, v.IsValidResponse(newTestRequest(v, rw, "/books/1", header), http.StatusFound, h))
+
+	v = New(WithRedirectPolicy(RedirectFilterFields))
+	req := newTestRequest(v, rw, "/books/1", header)
+	defer v.Finish(req, false)
+
+	assert.True(t, v.IsValidResponse(req, http.StatusFound, h))
+	assert.True(t, v.IsValidResponse(req, http.StatusMultipleChoices, h))
+
+	b, err := v.Apply(req, rw, strings.NewReader(`{"author": "/authors/1", "title": "1984"}`), rw.Header())
+	assert.NoError(t, err)
+	assert.Equal(t, `{"author":"/authors/1"}`, string(b))
+	assert.Empty(t, rw.pushed)
+	assert.Empty(t, rw.Header()["Link"])
+
+	// Success responses are still pushed
+	req = newTestRequest(v, rw, "/books/1", header)
+	defer v.Finish(req, false)
+
+	assert.True(t, v.IsValidResponse(req, http.StatusOK, h))
+	_, err = v.Apply(req, rw, strings.NewReader(`{"author": "/authors/1", "title": "1984"}`), rw.Header())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/authors/1"}, rw.pushed)
+
+	// The Location header of a success response doesn't make it a redirect
+	rw = &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	rw.Header().Set("Location", "/books/2")
+	req = newTestRequest(v, rw, "/books/1", header)
+	defer v.Finish(req, false)
+
+	assert.True(t, v.IsValidResponse(req, http.StatusCreated, h))
+	_, err = v.Apply(req, rw, strings.NewReader(`{"author": "/authors/1", "title": "1984"}`), rw.Header())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/authors/1"}, rw.pushed)
+}
+
+func TestIsValidResponseStatus(t *testing.T) {
+	req := &http.Request{URL: &url.URL{}}
+	h := http.Header{"Content-Type": []string{"application/json"}}
+
+	v := New()
+	assert.True(t, v.IsValidResponse(req, 201, h))
+	assert.False(t, v.IsValidResponse(req, 300, h))
+	assert.False(t, v.IsValidResponse(req, 304, h))
+	assert.False(t, v.IsValidResponse(req, 199, h))
+
+	v = New(WithTransformableStatuses(200, 404))
+	assert.True(t, v.IsValidResponse(req, 200, h))
+	assert.True(t, v.IsValidResponse(req, 404, h))
+	assert.False(t, v.IsValidResponse(req, 201, h))
+}
+
+func TestIsValidResponseContentType(t *testing.T) {
+	req := &http.Request{URL: &url.URL{}}
+	ct := func(t string) http.Header { return http.Header{"Content-Type": []string{t}} }
+
+	v := New()
+	assert.True(t, v.IsValidResponse(req, 200, ct("application/problem+json")))
+	assert.False(t, v.IsValidResponse(req, 200, ct("text/html")))
+
+	v = New(WithTransformableContentTypes("application/json", "Application/LD+JSON"))
+	assert.True(t, v.IsValidResponse(req, 200, ct("application/json")))
+	assert.True(t, v.IsValidResponse(req, 200, ct("application/ld+json; charset=utf-8")))
+	assert.False(t, v.IsValidResponse(req, 200, ct("application/problem+json")))
+	assert.False(t, v.IsValidResponse(req, 200, ct("application/cbor")))
+
+	v = New(WithTransformableContentTypes("application/json"), WithCBORSupport())
+	assert.True(t, v.IsValidResponse(req, 200, ct("application/cbor")))
+}
+
+func TestCoalescedLinkHeader(t *testing.T) {
+	v := New(WithCoalescedLinkHeader(), WithMaxPushes(1))
+
+	rw := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	rw.Header().Set("Link", "</style.css>; rel=preload; as=style")
+	req := newTestRequest(v, rw, "/books/1", http.Header{"Preload": []string{`"/author", "/related", "/cover"`}})
+	defer v.Finish(req, false)
+
+	_, err := v.Apply(req, rw, strings.NewReader(`{"author": "/authors/1", "related": "/books/2", "cover": "https://example.com/1.jpg"}`), rw.Header())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/authors/1"}, rw.pushed)
+	assert.Equal(t, []string{
+		"</style.css>; rel=preload; as=style",
+		"</books/2>; rel=preload; as=fetch, <https://example.com/1.jpg>; rel=preload; as=fetch; nopush",
+	}, rw.Header()["Link"])
+}
+
+func TestInternalRequestHeader(t *testing.T) {
+	assert.Panics(t, func() {
+		New(WithInternalRequestHeader("Invalid Header"))
+	})
+
+	v := New(WithInternalRequestHeader("X-Vulcain-Push"))
+
+	rw := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	req := newTestRequest(v, rw, "/books/1", http.Header{"Preload": []string{`"/author"`}})
+	defer v.Finish(req, false)
+
+	_, err := v.Apply(req, rw, strings.NewReader(`{"author": "/authors/1"}`), rw.Header())
+	assert.NoError(t, err)
+	if assert.Len(t, rw.options, 1) {
+		id := rw.options[0].Header.Get("X-Vulcain-Push")
+		assert.NotEmpty(t, id)
+		assert.Empty(t, rw.options[0].Header.Get(defaultInternalRequestHeader))
+
+		// The pushed request retrieves the pusher of the explicit request
+		pushedReq := newTestRequest(v, rw, "/authors/1", rw.options[0].Header)
+		assert.Same(t, req.Context().Value(ctxKey{}), pushedReq.Context().Value(ctxKey{}))
+		v.Finish(pushedReq, false)
+	}
+}
+
+func TestNopushByDefault(t *testing.T) {
+	v := New(WithNopushByDefault())
+
+	rw := httptest.NewRecorder()
+	req := newTestRequest(v, rw, "/books/1", http.Header{"Preload": []string{`"/author"`}})
+	defer v.Finish(req, false)
+
+	_, err := v.Apply(req, rw, strings.NewReader(`{"author": "/authors/1"}`), rw.Header())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"</authors/1>; rel=preload; as=fetch; nopush"}, rw.Header()["Link"])
+}
+
+func TestWildcardMaxPushes(t *testing.T) {
+	var dropped int
+	v := New(WithMaxPushes(2), WithOnPushLimitReached(func(_ *http.Request, d int) {
+		dropped = d
+	}))
+
+	rw := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	req := newTestRequest(v, rw, "/books", http.Header{"Preload": []string{`"/members/*/author"`}})
+	defer v.Finish(req, false)
+
+	_, err := v.Apply(req, rw, strings.NewReader(`{"members": [{"author": "/authors/1"}, {"author": "/authors/2"}, {"author": "/authors/3"}, {"author": "/authors/4"}]}`), rw.Header())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/authors/1", "/authors/2"}, rw.pushed)
+	assert.Equal(t, []string{"</authors/3>; rel=preload; as=fetch; nopush", "</authors/4>; rel=preload; as=fetch; nopush"}, rw.Header()["Link"])
+	assert.Equal(t, 2, dropped)
+}
+
+func TestApplyCanceledContext(t *testing.T) {
+	v := New()
+
+	rw := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	req := newTestRequest(v, rw, "/books/1?fields=%22%2Fauthor%22", http.Header{"Preload": []string{`"/author"`}})
+	defer v.Finish(req, false)
+
+	ctx, cancel := context.WithCancel(req.Context())
+	cancel()
+
+	b, err := v.Apply(req.WithContext(ctx), rw, strings.NewReader(`{"author": "/authors/1", "title": "1984"}`), rw.Header())
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, `{"author":"/authors/1"}`, string(b))
+	assert.Empty(t, rw.pushed)
+	assert.Empty(t, rw.Header()["Link"])
+}
+
+func TestRelationResolver(t *testing.T) {
+	v := New(WithOpenAPIFile(openapiFixture), WithRelationResolver(func(selector, value string) (string, bool) {
+		if selector != "/author" {
+			return "", false
+		}
+
+		return "/legacy/authors?id=" + value, true
+	}))
+
+	u, _ := url.Parse("/oa/books/123")
+	route := v.getOpenAPIRoute(u, nil, false)
+
+	u, useOA, _, err := v.parseRelation("/author", "42", route, nil, v.logger)
+	assert.NoError(t, err)
+	assert.False(t, useOA)
+	assert.Equal(t, "/legacy/authors?id=42", u.String())
+
+	u, useOA, _, err = v.parseRelation("/member/*", "1936", v.getOpenAPIRoute(&url.URL{Path: "/oa/books.json"}, nil, false), nil, v.logger)
+	assert.NoError(t, err)
+	assert.True(t, useOA)
+	assert.Equal(t, "/oa/books/1936", u.String())
+}
+
+func TestMaxBodySize(t *testing.T) {
+	v := New(WithMaxBodySize(24))
+
+	rw := httptest.NewRecorder()
+	req := newTestRequest(v, rw, "/books/1", http.Header{"Fields": []string{`"/author"`}})
+	defer v.Finish(req, false)
+
+	b, err := v.Apply(req, rw, strings.NewReader(`{"author": "/authors/1"}`), rw.Header())
+	assert.NoError(t, err)
+	assert.Equal(t, `{"author":"/authors/1"}`, string(b))
+
+	b, err = v.Apply(req, rw, strings.NewReader(`{"author": "/authors/1", "title": "1984"}`), rw.Header())
+	assert.Nil(t, b)
+	assert.ErrorIs(t, err, ErrBodyTooLarge)
+}
+
+func TestRequestIDHeader(t *testing.T) {
+	core, logs := observer.New(zap.DebugLevel)
+	v := New(WithLogger(zap.New(core)), WithRequestIDHeader("X-Request-ID"))
+
+	rw := httptest.NewRecorder()
+	req := newTestRequest(v, rw, "/books.json", http.Header{"Preload": []string{`"/author"`}, "X-Request-Id": []string{"abc"}})
+
+	_, err := v.Apply(req, rw, strings.NewReader(`{"author":"/authors/1"}`), rw.Header())
+	assert.NoError(t, err)
+
+	entries := logs.FilterField(zap.String("request_id", "abc")).All()
+	assert.NotEmpty(t, entries)
+	assert.Len(t, entries, logs.Len())
+}
+
+func TestGeneratedRequestID(t *testing.T) {
+	core, logs := observer.New(zap.DebugLevel)
+	v := New(WithLogger(zap.New(core)))
+
+	rw := httptest.NewRecorder()
+	req := newTestRequest(v, rw, "/books.json", http.Header{"Preload": []string{`"/author"`}})
+
+	_, err := v.Apply(req, rw, strings.NewReader(`{"author":"/authors/1"}`), rw.Header())
+	assert.NoError(t, err)
+
+	assert.NotZero(t, logs.Len())
+	for _, e := range logs.All() {
+		assert.NotEmpty(t, e.ContextMap()["request_id"])
+	}
+}
+
+func TestPushedRequestID(t *testing.T) {
+	core, logs := observer.New(zap.DebugLevel)
+	v := New(WithLogger(zap.New(core)), WithRequestIDHeader("X-Request-ID"))
+
+	rw := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	req := newTestRequest(v, rw, "/books/1", http.Header{"Preload": []string{`"/author"`}})
+	defer v.Finish(req, false)
+
+	_, err := v.Apply(req, rw, strings.NewReader(`{"author": "/authors/1"}`), rw.Header())
+	assert.NoError(t, err)
+
+	if assert.Len(t, rw.options, 1) {
+		// The ID sent by the client in the pushed request is ignored
+		h := rw.options[0].Header.Clone()
+		h.Set("X-Request-ID", "forged")
+
+		pushedReq := newTestRequest(v, &pushRecorder{ResponseRecorder: httptest.NewRecorder()}, "/authors/1", h)
+		defer v.Finish(pushedReq, false)
+
+		v.requestLogger(req).Info("explicit")
+		v.requestLogger(pushedReq).Info("pushed")
+
+		explicitID := logs.FilterMessage("explicit").All()[0].ContextMap()["request_id"]
+		assert.NotEmpty(t, explicitID)
+		assert.Equal(t, explicitID, logs.FilterMessage("pushed").All()[0].ContextMap()["request_id"])
+	}
+}
@@ -0,0 +1,70 @@
+// Package vulcaintest provides utilities to test code using Vulcain without an HTTP/2 server.
+package vulcaintest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+
+	"github.com/dunglas/vulcain"
+)
+
+// Push is a relation pushed using RecordingPusher
+type Push struct {
+	Target  string
+	Options *http.PushOptions
+}
+
+// RecordingPusher is an http.ResponseWriter supporting HTTP/2 Server Push, it records the pushed relations
+type RecordingPusher struct {
+	*httptest.ResponseRecorder
+
+	mu     sync.Mutex
+	pushes []Push
+}
+
+// NewRecordingPusher creates a new RecordingPusher
+func NewRecordingPusher() *RecordingPusher {
+	return &RecordingPusher{ResponseRecorder: httptest.NewRecorder()}
+}
+
+// Push implements http.Pusher
+func (p *RecordingPusher) Push(target string, opts *http.PushOptions) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.pushes = append(p.pushes, Push{target, opts})
+
+	return nil
+}
+
+// Pushes returns the recorded pushes
+func (p *RecordingPusher) Pushes() []Push {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return append([]Push(nil), p.pushes...)
+}
+
+// Pushed returns the targets of the recorded pushes
+func (p *RecordingPusher) Pushed() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	targets := make([]string, 0, len(p.pushes))
+	for _, push := range p.pushes {
+		targets = append(targets, push.Target)
+	}
+
+	return targets
+}
+
+// NewRequest creates a GET request with the given headers and a context created by v for rw, as done by the gateway server and the Caddy module
+func NewRequest(v *vulcain.Vulcain, rw http.ResponseWriter, target string, header http.Header) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	for k, values := range header {
+		req.Header[k] = values
+	}
+
+	return req.WithContext(v.CreateRequestContext(rw, req))
+}
@@ -0,0 +1,24 @@
+package vulcaintest
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/dunglas/vulcain"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordingPusher(t *testing.T) {
+	v := vulcain.New()
+
+	rw := NewRecordingPusher()
+	req := NewRequest(v, rw, "/books/1", http.Header{"Preload": []string{`"/author/address"`}})
+	defer v.Finish(req, false)
+
+	_, err := v.Apply(req, rw, strings.NewReader(`{"author": "/authors/1"}`), rw.Header())
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"/authors/1"}, rw.Pushed())
+	assert.Equal(t, `"/address"`, rw.Pushes()[0].Options.Header.Get("Preload"))
+}